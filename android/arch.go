@@ -172,6 +172,11 @@ func newArch(name, multilib string) ArchType {
 	return archType
 }
 
+// ArchTypeList returns all the architecture types that modules can be built for.
+func ArchTypeList() []ArchType {
+	return append([]ArchType(nil), archTypeList...)
+}
+
 func (a ArchType) String() string {
 	return a.Name
 }
@@ -1074,6 +1079,12 @@ func getCommonTargets(targets []Target) []Target {
 	return ret
 }
 
+// DecodeMultilib selects the targets of a compile_multilib style setting from a target list, in
+// order of preference.
+func DecodeMultilib(multilib string, targets []Target, prefer32 bool) ([]Target, error) {
+	return decodeMultilib(multilib, targets, prefer32)
+}
+
 // Use the module multilib setting to select one or more targets from a target list
 func decodeMultilib(multilib string, targets []Target, prefer32 bool) ([]Target, error) {
 	buildTargets := []Target{}
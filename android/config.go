@@ -175,7 +175,8 @@ func saveToConfigFile(config jsonConfigurable, filename string) error {
 func TestConfig(buildDir string, env map[string]string) Config {
 	config := &config{
 		ProductVariables: productVariables{
-			DeviceName: stringPtr("test_device"),
+			DeviceName:           stringPtr("test_device"),
+			Platform_sdk_version: intPtr(26),
 		},
 
 		buildDir:     buildDir,
@@ -208,6 +209,7 @@ func TestArchConfig(buildDir string, env map[string]string) Config {
 			{BuildOs, Arch{ArchType: X86}},
 		},
 	}
+	config.BuildOsVariant = config.Targets[Host][0].String()
 
 	return testConfig
 }
@@ -443,6 +445,19 @@ func (c *config) DefaultAppTargetSdkInt() int {
 	}
 }
 
+// DefaultAppTargetSdk returns the SDK version that apps built against the current SDK are given in
+// their manifest: the platform SDK version once it is final, otherwise the codename of the platform
+// in development, matching PLATFORM_VERSION_CODENAME in Make.
+func (c *config) DefaultAppTargetSdk() string {
+	if Bool(c.ProductVariables.Platform_sdk_final) {
+		return c.PlatformSdkVersion()
+	}
+	if codenames := c.PlatformVersionActiveCodenames(); len(codenames) > 0 {
+		return codenames[len(codenames)-1]
+	}
+	return c.PlatformSdkVersion()
+}
+
 // Codenames that are active in the current lunch target.
 func (c *config) PlatformVersionActiveCodenames() []string {
 	return c.ProductVariables.Platform_version_active_codenames
@@ -496,6 +511,18 @@ func (c *config) UnbundledBuild() bool {
 	return Bool(c.ProductVariables.Unbundled_build)
 }
 
+// BootJars returns the names of the java libraries on the device's boot classpath, which are
+// compiled into the boot image instead of being dexpreopted individually.
+func (c *config) BootJars() []string {
+	return append([]string(nil), c.ProductVariables.BootJars...)
+}
+
+// DisableDexPreopt returns true if the module with the given name should not be dexpreopted.
+func (c *config) DisableDexPreopt(name string) bool {
+	return Bool(c.ProductVariables.DisableDexPreopt) ||
+		inList(name, c.ProductVariables.DisableDexPreoptModules)
+}
+
 func (c *config) DevicePrefer32BitExecutables() bool {
 	return Bool(c.ProductVariables.DevicePrefer32BitExecutables)
 }
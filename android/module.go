@@ -112,6 +112,7 @@ type Module interface {
 	InstallInData() bool
 	InstallInSanitizerDir() bool
 	SkipInstall()
+	FilesToInstall() Paths
 
 	AddProperties(props ...interface{})
 	GetProperties() []interface{}
@@ -409,14 +410,15 @@ func (a *ModuleBase) computeInstallDeps(
 	ctx.VisitDepsDepthFirstIf(isFileInstaller,
 		func(m blueprint.Module) {
 			fileInstaller := m.(fileInstaller)
-			files := fileInstaller.filesToInstall()
+			files := fileInstaller.FilesToInstall()
 			result = append(result, files...)
 		})
 
 	return result
 }
 
-func (a *ModuleBase) filesToInstall() Paths {
+// FilesToInstall returns the files installed by this variant of the module.
+func (a *ModuleBase) FilesToInstall() Paths {
 	return a.installFiles
 }
 
@@ -798,7 +800,7 @@ func (a *androidModuleContext) CheckbuildFile(srcPath Path) {
 }
 
 type fileInstaller interface {
-	filesToInstall() Paths
+	FilesToInstall() Paths
 }
 
 func isFileInstaller(m blueprint.Module) bool {
@@ -820,11 +822,25 @@ func findStringInSlice(str string, slice []string) int {
 	return -1
 }
 
+// SrcIsModule returns the name of the module referenced by a srcs entry in the format ":module" or
+// ":module{tag}", or "" if the entry is not a module reference.
 func SrcIsModule(s string) string {
+	module, _ := SrcIsModuleWithTag(s)
+	return module
+}
+
+// SrcIsModuleWithTag returns the name of the module and the tag referenced by a srcs entry in the
+// format ":module" or ":module{tag}", or "" if the entry is not a module reference.  The tag is ""
+// if the entry has none.
+func SrcIsModuleWithTag(s string) (module, tag string) {
 	if len(s) > 1 && s[0] == ':' {
-		return s[1:]
+		module = s[1:]
+		if i := strings.IndexByte(module, '{'); i > 0 && strings.HasSuffix(module, "}") {
+			return module[:i], module[i+1 : len(module)-1]
+		}
+		return module, ""
 	}
-	return ""
+	return "", ""
 }
 
 type sourceDependencyTag struct {
@@ -834,18 +850,22 @@ type sourceDependencyTag struct {
 var SourceDepTag sourceDependencyTag
 
 // Returns a list of modules that must be depended on to satisfy filegroup or generated sources
-// modules listed in srcFiles using ":module" syntax
+// modules listed in srcFiles using ":module" or ":module{tag}" syntax
 func ExtractSourcesDeps(ctx BottomUpMutatorContext, srcFiles []string) {
 	var deps []string
 	set := make(map[string]bool)
+	modules := make(map[string]bool)
 
 	for _, s := range srcFiles {
 		if m := SrcIsModule(s); m != "" {
-			if _, found := set[m]; found {
-				ctx.ModuleErrorf("found source dependency duplicate: %q!", m)
+			if _, found := set[s]; found {
+				ctx.ModuleErrorf("found source dependency duplicate: %q!", s)
 			} else {
-				set[m] = true
-				deps = append(deps, m)
+				set[s] = true
+				if !modules[m] {
+					modules[m] = true
+					deps = append(deps, m)
+				}
 			}
 		}
 	}
@@ -857,6 +877,12 @@ type SourceFileProducer interface {
 	Srcs() Paths
 }
 
+// OutputFileProducer is implemented by modules that can be referenced in srcs as ":module{tag}" to
+// use other files than their Srcs, for example ":module{.zip}".
+type OutputFileProducer interface {
+	OutputFiles(tag string) (Paths, error)
+}
+
 // Returns a list of paths expanded from globs and modules referenced using ":module" syntax.
 // ExtractSourcesDeps must have already been called during the dependency resolution phase.
 func (ctx *androidModuleContext) ExpandSources(srcFiles, excludes []string) Paths {
@@ -877,9 +903,20 @@ func (ctx *androidModuleContext) ExpandSourcesSubDir(srcFiles, excludes []string
 
 	expandedSrcFiles := make(Paths, 0, len(srcFiles))
 	for _, s := range srcFiles {
-		if m := SrcIsModule(s); m != "" {
+		if m, tag := SrcIsModuleWithTag(s); m != "" {
 			module := ctx.GetDirectDepWithTag(m, SourceDepTag)
-			if srcProducer, ok := module.(SourceFileProducer); ok {
+			if tag != "" {
+				if outputFileProducer, ok := module.(OutputFileProducer); ok {
+					paths, err := outputFileProducer.OutputFiles(tag)
+					if err != nil {
+						ctx.ModuleErrorf("srcs dependency %q: %s", s, err.Error())
+					} else {
+						expandedSrcFiles = append(expandedSrcFiles, paths...)
+					}
+				} else {
+					ctx.ModuleErrorf("srcs dependency %q does not have tagged output files", m)
+				}
+			} else if srcProducer, ok := module.(SourceFileProducer); ok {
 				expandedSrcFiles = append(expandedSrcFiles, srcProducer.Srcs()...)
 			} else {
 				ctx.ModuleErrorf("srcs dependency %q is not a source file producing module", m)
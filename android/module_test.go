@@ -0,0 +1,211 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package android
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/blueprint"
+)
+
+func TestSrcIsModuleWithTag(t *testing.T) {
+	testCases := []struct {
+		in     string
+		module string
+		tag    string
+	}{
+		{in: "foo.java"},
+		{in: ":"},
+		{in: ":foo", module: "foo"},
+		{in: ":foo{.zip}", module: "foo", tag: ".zip"},
+		{in: ":foo{}", module: "foo"},
+		{in: ":foo{.zip", module: "foo{.zip"},
+		{in: ":{.zip}", module: "{.zip}"},
+		{in: "foo{.zip}"},
+	}
+
+	for _, testCase := range testCases {
+		module, tag := SrcIsModuleWithTag(testCase.in)
+		if module != testCase.module || tag != testCase.tag {
+			t.Errorf("SrcIsModuleWithTag(%q) = %q, %q, expected %q, %q", testCase.in, module, tag,
+				testCase.module, testCase.tag)
+		}
+		if module := SrcIsModule(testCase.in); module != testCase.module {
+			t.Errorf("SrcIsModule(%q) = %q, expected %q", testCase.in, module, testCase.module)
+		}
+	}
+}
+
+var expandSourcesTests = []struct {
+	name  string
+	srcs  string
+	paths []string
+	deps  int
+	err   string
+}{
+	{
+		name:  "srcs",
+		srcs:  `[":producer"]`,
+		paths: []string{"producer/a", "producer/b"},
+		deps:  1,
+	},
+	{
+		name:  "tag",
+		srcs:  `[":producer{.zip}"]`,
+		paths: []string{"producer.zip"},
+		deps:  1,
+	},
+	{
+		name:  "srcs and tag",
+		srcs:  `[":producer", ":producer{.zip}"]`,
+		paths: []string{"producer/a", "producer/b", "producer.zip"},
+		deps:  1,
+	},
+	{
+		name: "duplicate",
+		srcs: `[":producer{.zip}", ":producer{.zip}"]`,
+		err:  `found source dependency duplicate: ":producer{.zip}"!`,
+	},
+	{
+		name: "unsupported tag",
+		srcs: `[":producer{.tar}"]`,
+		err:  `srcs dependency ":producer{.tar}": unsupported tag ".tar"`,
+	},
+	{
+		name: "no tagged output files",
+		srcs: `[":plain{.zip}"]`,
+		err:  `srcs dependency "plain" does not have tagged output files`,
+	},
+}
+
+func TestExpandSources(t *testing.T) {
+	buildDir, err := ioutil.TempDir("", "soong_module_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(buildDir)
+
+	config := TestConfig(buildDir, nil)
+
+	for _, test := range expandSourcesTests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := NewTestContext()
+			ctx.RegisterModuleType("source", ModuleFactoryAdaptor(newSrcsModule))
+			ctx.RegisterModuleType("producer", ModuleFactoryAdaptor(newProducerModule))
+			ctx.Register()
+			ctx.MockFileSystem(map[string][]byte{
+				"Blueprints": []byte(`
+					source {
+						name: "foo",
+						srcs: ` + test.srcs + `,
+					}
+
+					producer {
+						name: "producer",
+					}
+
+					source {
+						name: "plain",
+					}
+				`),
+			})
+
+			_, errs := ctx.ParseBlueprintsFiles("Blueprints")
+			fail(t, errs)
+			_, errs = ctx.PrepareBuildActions(config)
+
+			if test.err != "" {
+				for _, err := range errs {
+					if strings.Contains(err.Error(), test.err) {
+						return
+					}
+				}
+				t.Fatalf("missing expected error %q, errors are %q", test.err, errs)
+			}
+			fail(t, errs)
+
+			foo := ctx.ModuleForTests("foo", "")
+			if g, w := foo.Module().(*srcsModule).srcs.Strings(), test.paths; !reflect.DeepEqual(g, w) {
+				t.Errorf("expected srcs %q, got %q", w, g)
+			}
+
+			deps := 0
+			ctx.VisitDirectDeps(foo.Module(), func(blueprint.Module) {
+				deps++
+			})
+			if deps != test.deps {
+				t.Errorf("expected %d dependencies, got %d", test.deps, deps)
+			}
+		})
+	}
+}
+
+type srcsModule struct {
+	ModuleBase
+	properties struct {
+		Srcs []string
+	}
+	srcs Paths
+}
+
+func newSrcsModule() Module {
+	m := &srcsModule{}
+	m.AddProperties(&m.properties)
+	InitAndroidModule(m)
+	return m
+}
+
+func (m *srcsModule) DepsMutator(ctx BottomUpMutatorContext) {
+	ExtractSourcesDeps(ctx, m.properties.Srcs)
+}
+
+func (m *srcsModule) GenerateAndroidBuildActions(ctx ModuleContext) {
+	m.srcs = ctx.ExpandSources(m.properties.Srcs, nil)
+}
+
+type producerModule struct {
+	ModuleBase
+}
+
+func newProducerModule() Module {
+	m := &producerModule{}
+	InitAndroidModule(m)
+	return m
+}
+
+func (m *producerModule) DepsMutator(ctx BottomUpMutatorContext) {
+}
+
+func (m *producerModule) GenerateAndroidBuildActions(ctx ModuleContext) {
+}
+
+func (m *producerModule) Srcs() Paths {
+	return PathsForTesting([]string{"producer/a", "producer/b"})
+}
+
+func (m *producerModule) OutputFiles(tag string) (Paths, error) {
+	if tag != ".zip" {
+		return nil, fmt.Errorf("unsupported tag %q", tag)
+	}
+	return PathsForTesting([]string{"producer.zip"}), nil
+}
+
+var _ SourceFileProducer = (*producerModule)(nil)
+var _ OutputFileProducer = (*producerModule)(nil)
@@ -805,6 +805,17 @@ func PathForModuleInstall(ctx ModuleInstallPathContext, pathComponents ...string
 	return PathForOutput(ctx, outPaths...)
 }
 
+// PathsForTestSuites returns the testcases directories of the compatibility test suites, which are
+// in the host output directory of the build machine whatever the target of the test is.
+func PathsForTestSuites(ctx PathContext, suites []string) []OutputPath {
+	var paths []OutputPath
+	for _, suite := range suites {
+		paths = append(paths, PathForOutput(ctx, "host", pathConfig(ctx).PrebuiltOS(), suite,
+			"android-"+suite, "testcases"))
+	}
+	return paths
+}
+
 // validateSafePath validates a path that we trust (may contain ninja variables).
 // Ensures that each path component does not attempt to leave its component.
 func validateSafePath(ctx PathContext, pathComponents ...string) string {
@@ -340,3 +340,28 @@ func TestPathForModuleInstall(t *testing.T) {
 		})
 	}
 }
+
+func TestPathsForTestSuites(t *testing.T) {
+	ctx := &moduleInstallPathContextImpl{
+		androidBaseContextImpl: androidBaseContextImpl{
+			target: Target{Os: Android},
+			config: TestConfig("", nil),
+		},
+	}
+
+	// The suites are installed in the host output directory of the build machine, even for
+	// device tests.
+	hostOut := ctx.config.PrebuiltOS()
+	expected := []string{
+		"host/" + hostOut + "/cts/android-cts/testcases",
+		"host/" + hostOut + "/vts/android-vts/testcases",
+	}
+
+	var out []string
+	for _, path := range PathsForTestSuites(ctx, []string{"cts", "vts"}) {
+		out = append(out, path.basePath.path)
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("unexpected paths:\n got: %q\nwant: %q\n", out, expected)
+	}
+}
@@ -27,6 +27,7 @@ import (
 // A FixRequest doesn't specify whether to do a dry run or where to write the results; that's in cmd/bpfix.go
 type FixRequest struct {
 	simplifyKnownRedundantVariables bool
+	rewriteDexPreoptEnabled         bool
 }
 
 func NewFixRequest() FixRequest {
@@ -36,6 +37,7 @@ func NewFixRequest() FixRequest {
 func (r FixRequest) AddAll() (result FixRequest) {
 	result = r
 	result.simplifyKnownRedundantVariables = true
+	result.rewriteDexPreoptEnabled = true
 	return result
 }
 
@@ -88,9 +90,43 @@ func fixTreeOnce(tree *parser.File, config FixRequest) (fixed *parser.File, err
 			return nil, err
 		}
 	}
+	if config.rewriteDexPreoptEnabled {
+		tree, err = rewriteDexPreoptEnabled(tree)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return tree, err
 }
 
+// rewriteDexPreoptEnabled moves the value of the dex_preopt property, which used to be a bool, to
+// dex_preopt.enabled.
+func rewriteDexPreoptEnabled(tree *parser.File) (fixed *parser.File, err error) {
+	for _, def := range tree.Defs {
+		mod, ok := def.(*parser.Module)
+		if !ok {
+			continue
+		}
+		prop, ok := mod.GetProperty("dex_preopt")
+		if !ok {
+			continue
+		}
+		if _, ok := prop.Value.(*parser.Map); ok {
+			continue
+		}
+		prop.Value = &parser.Map{
+			Properties: []*parser.Property{
+				{
+					Name:    "enabled",
+					NamePos: prop.NamePos,
+					Value:   prop.Value,
+				},
+			},
+		}
+	}
+	return tree, nil
+}
+
 func simplifyKnownPropertiesDuplicatingEachOther(tree *parser.File) (fixed *parser.File, err error) {
 	// remove from local_include_dirs anything in export_include_dirs
 	fixed, err = removeMatchingModuleListProperties(tree, "export_include_dirs", "local_include_dirs")
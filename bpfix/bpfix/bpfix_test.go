@@ -112,3 +112,63 @@ func TestSimplifyKnownVariablesDuplicatingEachOther(t *testing.T) {
 	implFilterListTest(t, []string{}, []string{"include"}, []string{})
 	implFilterListTest(t, []string{}, []string{}, []string{})
 }
+
+func mapProperty(m *parser.Map, name string) *parser.Property {
+	for _, prop := range m.Properties {
+		if prop.Name == name {
+			return prop
+		}
+	}
+	return nil
+}
+
+func TestRewriteDexPreoptEnabled(t *testing.T) {
+	input := `
+		java_library {
+			name: "foo",
+			dex_preopt: false,
+		}
+
+		java_library {
+			name: "bar",
+			dex_preopt: {
+				enabled: true,
+				profile: "profile",
+			},
+		}
+	`
+	tree, errs := parser.Parse("", strings.NewReader(input), parser.NewScope(nil))
+	if len(errs) > 0 {
+		t.Fatalf("failed to parse: %v", errs)
+	}
+
+	tree, err := rewriteDexPreoptEnabled(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{false, true} {
+		mod := tree.Defs[i].(*parser.Module)
+		prop, ok := mod.GetProperty("dex_preopt")
+		if !ok {
+			t.Fatalf("module %d: dex_preopt not found", i)
+		}
+		dexPreopt, ok := prop.Value.(*parser.Map)
+		if !ok {
+			t.Fatalf("module %d: dex_preopt is not a map: %v", i, prop.Value)
+		}
+		enabled := mapProperty(dexPreopt, "enabled")
+		if enabled == nil {
+			t.Fatalf("module %d: dex_preopt.enabled not found", i)
+		}
+		if value, ok := enabled.Value.(*parser.Bool); !ok || value.Value != expected {
+			t.Errorf("module %d: dex_preopt.enabled %v != %v", i, enabled.Value, expected)
+		}
+	}
+
+	bar := tree.Defs[1].(*parser.Module)
+	prop, _ := bar.GetProperty("dex_preopt")
+	if mapProperty(prop.Value.(*parser.Map), "profile") == nil {
+		t.Errorf("bar dex_preopt.profile was removed")
+	}
+}
@@ -288,6 +288,15 @@ var (
 	ndkLateStubDepTag     = dependencyTag{name: "ndk late stub", library: true}
 )
 
+// IsSharedDepTag returns true if the dependency tag links a shared library into the module.
+func IsSharedDepTag(depTag blueprint.DependencyTag) bool {
+	switch depTag {
+	case sharedDepTag, sharedExportDepTag, lateSharedDepTag:
+		return true
+	}
+	return false
+}
+
 // Module contains the properties and members used by all C/C++ module types, and implements
 // the blueprint.Module interface.  It delegates to compiler, linker, and installer interfaces
 // to construct the output file.  Behavior can be customized with a Customizer interface
@@ -1054,6 +1063,14 @@ func (c *Module) depsToPaths(ctx android.ModuleContext) PathDeps {
 			case android.DefaultsDepTag, android.SourceDepTag:
 				// Nothing to do
 			case genSourceDepTag:
+				if genRule, ok := dep.(*genrule.Module); ok && genRule.OutDir() {
+					// The files in the tree are only known after the build of the genrule, but
+					// every source of a cc module needs its own build statement.
+					ctx.PropertyErrorf("generated_sources", "module %q sets out_dir, compiling "+
+						"the files in its tree is not supported, use it in generated_headers "+
+						"instead", depName)
+					return
+				}
 				if genRule, ok := dep.(genrule.SourceFileGenerator); ok {
 					depPaths.GeneratedSources = append(depPaths.GeneratedSources,
 						genRule.GeneratedSourceFiles()...)
@@ -2,6 +2,7 @@ package cc
 
 import (
 	"android/soong/android"
+	"android/soong/genrule"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -38,94 +39,60 @@ func TestMain(m *testing.M) {
 	os.Exit(run())
 }
 
-func testCc(t *testing.T, bp string) *android.TestContext {
+func testCcContext(bp string) (*android.TestContext, []error) {
 	config := android.TestArchConfig(buildDir, nil)
 	config.ProductVariables.DeviceVndkVersion = proptools.StringPtr("current")
 
 	ctx := android.NewTestArchContext()
-	ctx.RegisterModuleType("cc_library", android.ModuleFactoryAdaptor(libraryFactory))
-	ctx.RegisterModuleType("toolchain_library", android.ModuleFactoryAdaptor(toolchainLibraryFactory))
-	ctx.RegisterModuleType("llndk_library", android.ModuleFactoryAdaptor(llndkLibraryFactory))
-	ctx.RegisterModuleType("cc_object", android.ModuleFactoryAdaptor(objectFactory))
-	ctx.PreDepsMutators(func(ctx android.RegisterMutatorsContext) {
-		ctx.BottomUp("image", vendorMutator).Parallel()
-		ctx.BottomUp("link", linkageMutator).Parallel()
-		ctx.BottomUp("vndk", vndkMutator).Parallel()
-	})
+	RegisterRequiredBuildComponentsForTest(ctx)
+	ctx.RegisterModuleType("cc_genrule", android.ModuleFactoryAdaptor(genRuleFactory))
+	ctx.RegisterModuleType("genrule", android.ModuleFactoryAdaptor(genrule.GenRuleFactory))
+	ctx.RegisterModuleType("genrule_defaults", android.ModuleFactoryAdaptor(func() android.Module {
+		return genrule.DefaultsFactory()
+	}))
+	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
 	ctx.Register()
 
 	// add some modules that are required by the compiler and/or linker
-	bp = bp + `
-		toolchain_library {
-			name: "libatomic",
-			vendor_available: true,
-		}
-
-		toolchain_library {
-			name: "libcompiler_rt-extras",
-			vendor_available: true,
-		}
-
-		toolchain_library {
-			name: "libgcc",
-			vendor_available: true,
-		}
-
-		cc_library {
-			name: "libc",
-			no_libgcc : true,
-			nocrt : true,
-			system_shared_libs: [],
-		}
-		llndk_library {
-			name: "libc",
-			symbol_file: "",
-		}
-		cc_library {
-			name: "libm",
-			no_libgcc : true,
-			nocrt : true,
-			system_shared_libs: [],
-		}
-		llndk_library {
-			name: "libm",
-			symbol_file: "",
-		}
-		cc_library {
-			name: "libdl",
-			no_libgcc : true,
-			nocrt : true,
-			system_shared_libs: [],
-		}
-		llndk_library {
-			name: "libdl",
-			symbol_file: "",
-		}
-
-		cc_object {
-			name: "crtbegin_so",
-		}
-
-		cc_object {
-			name: "crtend_so",
-		}
-
-`
+	bp = bp + GatherRequiredDepsForTest()
 
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(bp),
 		"foo.c":      nil,
 		"bar.c":      nil,
+		"tool":       nil,
+		"dir/a.txt":  nil,
+		"dir/b.txt":  nil,
 	})
 
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp")
-	failIfErrored(t, errs)
+	if len(errs) > 0 {
+		return ctx, errs
+	}
 	_, errs = ctx.PrepareBuildActions(config)
-	failIfErrored(t, errs)
+	return ctx, errs
+}
 
+func testCc(t *testing.T, bp string) *android.TestContext {
+	ctx, errs := testCcContext(bp)
+	failIfErrored(t, errs)
 	return ctx
 }
 
+// testCcError runs the test context and checks that one of the errors contains pattern.
+func testCcError(t *testing.T, pattern string, bp string) {
+	_, errs := testCcContext(bp)
+	if len(errs) == 0 {
+		t.Fatalf("missing expected error %q (0 errors are returned)", pattern)
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), pattern) {
+			return
+		}
+	}
+	t.Errorf("missing expected error %q, errors are %q", pattern, errs)
+}
+
 func TestVendorSrc(t *testing.T) {
 	ctx := testCc(t, `
 		cc_library {
@@ -156,6 +123,80 @@ func TestVendorSrc(t *testing.T) {
 	}
 }
 
+func TestGeneratedOutDir(t *testing.T) {
+	bp := `
+		genrule {
+			name: "gen",
+			tool_files: ["tool"],
+			cmd: "$(location) $(out_dir)",
+			out_dir: true,
+			out: ["gen.zip"],
+		}
+
+		cc_library_shared {
+			name: "libfoo",
+			srcs: ["foo.c"],
+			generated_headers: ["gen"],
+			no_libgcc : true,
+			nocrt : true,
+			system_shared_libs : [],
+		}
+	`
+
+	ctx := testCc(t, bp)
+
+	gen := ctx.ModuleForTests("gen", "")
+	stamp := gen.Output("unzipped/gen.zip.stamp")
+	cc := ctx.ModuleForTests("libfoo", "android_arm64_armv8-a_core_shared").Output("obj/foo.o")
+	if !strings.Contains(cc.Args["cFlags"], "-I"+stamp.Args["outDir"]) {
+		t.Errorf("libfoo cflags %q do not include %q", cc.Args["cFlags"], stamp.Args["outDir"])
+	}
+	if !inList(stamp.Output.String(), cc.OrderOnly.Strings()) {
+		t.Errorf("libfoo does not depend on the unpacked tree %q", stamp.Output)
+	}
+
+	testCcError(t, `module "gen" sets out_dir`, strings.Replace(bp, "generated_headers",
+		"generated_sources", 1))
+}
+
+func TestGenruleUndeclaredPaths(t *testing.T) {
+	bp := `
+		cc_genrule {
+			name: "gen",
+			tool_files: ["tool"],
+			srcs: ["dir/a.txt"],
+			cmd: "$(location) $(in) dir/b.txt > $(out)",
+			out: ["gen.h"],
+		}
+	`
+
+	testCcError(t, `"dir/b.txt" is not declared in srcs, tools or tool_files`, bp)
+
+	testCc(t, strings.Replace(bp, `out: ["gen.h"],`,
+		`out: ["gen.h"], allowed_undeclared_paths: ["dir/b.txt"],`, 1))
+}
+
+func TestGenruleDefaults(t *testing.T) {
+	ctx := testCc(t, `
+		genrule_defaults {
+			name: "gen_defaults",
+			tool_files: ["tool"],
+			cmd: "$(location) > $(out)",
+			out: ["gen.h"],
+			vendor_available: true,
+		}
+
+		cc_genrule {
+			name: "gen",
+			defaults: ["gen_defaults"],
+		}
+	`)
+
+	for _, variant := range []string{"android_arm64_armv8-a_core", "android_arm64_armv8-a_vendor"} {
+		ctx.ModuleForTests("gen", variant).Output("gen.h")
+	}
+}
+
 var firstUniqueElementsTestCases = []struct {
 	in  []string
 	out []string
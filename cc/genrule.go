@@ -21,6 +21,10 @@ import (
 
 func init() {
 	android.RegisterModuleType("cc_genrule", genRuleFactory)
+
+	genrule.RegisterDefaultsProperties(func() interface{} {
+		return &VendorProperties{}
+	})
 }
 
 // cc_genrule is a genrule that can depend on other cc_* objects.
@@ -33,6 +37,7 @@ func genRuleFactory() android.Module {
 	module.AddProperties(module.Extra)
 
 	android.InitAndroidArchModule(module, android.HostAndDeviceSupported, android.MultilibBoth)
+	android.InitDefaultableModule(module)
 
 	return module
 }
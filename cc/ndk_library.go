@@ -63,6 +63,12 @@ var (
 	ndkMigratedLibsLock sync.Mutex // protects ndkMigratedLibs writes during parallel beginMutator
 )
 
+// IsNdkLibrary returns true if name is one of the shared libraries that the platform provides to
+// apps through the NDK.
+func IsNdkLibrary(name string) bool {
+	return inList(name, ndkPrebuiltSharedLibraries)
+}
+
 // Creates a stub shared library based on the provided version file.
 //
 // Example:
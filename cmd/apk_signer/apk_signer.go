@@ -0,0 +1,875 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// apk_signer aligns the entries of an APK and signs it with JAR (v1) signatures and the APK
+// Signature Scheme v2, and v3 if it is signed with a single key.  Stored entries are aligned to 4
+// bytes so that they can be mmapped, and stored shared libraries are optionally aligned to pages
+// so that they can be loaded directly from the APK.  The JAR signatures use SHA-256 digests, so
+// devices older than SDK version 18 can't install the APKs.  Signing is deterministic: ECDSA
+// signatures use the nonces from RFC 6979.
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"android/soong/jar"
+	"android/soong/third_party/zip"
+)
+
+type fileList []string
+
+func (f *fileList) String() string {
+	return `""`
+}
+
+func (f *fileList) Set(name string) error {
+	*f = append(*f, name)
+	return nil
+}
+
+var (
+	output      = flag.String("o", "", "output apk file")
+	pageAlign   = flag.Bool("p", false, "page align stored shared libraries")
+	verifyOnly  = flag.Bool("verify", false, "verify the alignment and signatures of the input apk")
+	noV1        = flag.Bool("no_v1", false, "don't write JAR signatures")
+	noV3        = flag.Bool("no_v3", false, "don't write an APK Signature Scheme v3 block")
+	certs, keys fileList
+)
+
+func init() {
+	flag.Var(&certs, "cert", "PEM encoded X.509 certificate, may be repeated")
+	flag.Var(&keys, "key", "DER encoded PKCS#8 private key for the preceding -cert, may be repeated")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: apk_signer [-p] [-no_v1] [-no_v3] -o out.apk -cert cert.x509.pem -key key.pk8 [-cert ... -key ...] in.apk")
+	fmt.Fprintln(os.Stderr, "       apk_signer -verify [-p] [-no_v1] in.apk")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		usage()
+	}
+	input := flag.Arg(0)
+
+	if *verifyOnly {
+		apk, err := ioutil.ReadFile(input)
+		if err != nil {
+			fatal(err)
+		}
+		signers, err := verify(apk, *pageAlign, !*noV1)
+		if err != nil {
+			fatal(fmt.Errorf("%s: %s", input, err))
+		}
+		for _, s := range signers {
+			fmt.Println(s.Subject.String())
+		}
+		return
+	}
+
+	if *output == "" || len(certs) == 0 || len(certs) != len(keys) {
+		usage()
+	}
+
+	var signers []*signer
+	for i := range certs {
+		s, err := loadSigner(certs[i], keys[i])
+		if err != nil {
+			fatal(err)
+		}
+		signers = append(signers, s)
+	}
+
+	reader, err := zip.OpenReader(input)
+	if err != nil {
+		fatal(err)
+	}
+	defer reader.Close()
+
+	v3 := !*noV3 && len(signers) == 1
+
+	var jarSigners []*signer
+	if !*noV1 {
+		jarSigners = signers
+	}
+
+	aligned := &bytes.Buffer{}
+	if err := align(&reader.Reader, aligned, *pageAlign, jarSigners, v3); err != nil {
+		fatal(err)
+	}
+
+	signed, err := sign(aligned.Bytes(), signers, v3)
+	if err != nil {
+		fatal(fmt.Errorf("%s: %s", input, err))
+	}
+
+	if err := ioutil.WriteFile(*output, signed, 0666); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "apk_signer:", err)
+	os.Exit(1)
+}
+
+const (
+	defaultAlignment = 4
+	pageAlignment    = 4096
+)
+
+// alignment returns the alignment of the data of an entry in the APK, or 0 if the entry is
+// compressed.
+func alignment(f *zip.File, pageAlignSharedLibs bool) uint16 {
+	if f.Method != zip.Store {
+		return 0
+	}
+	if pageAlignSharedLibs && strings.HasSuffix(f.Name, ".so") {
+		return pageAlignment
+	}
+	return defaultAlignment
+}
+
+// align copies the entries of an APK into a new zip file, aligning the data of stored entries.
+// If jarSigners is not empty the existing JAR signature files are replaced by the JAR signatures
+// of jarSigners, which record that the APK will also be signed with the APK Signature Scheme v2,
+// and v3 if v3 is set.
+func align(r *zip.Reader, w io.Writer, pageAlignSharedLibs bool, jarSigners []*signer,
+	v3 bool) error {
+
+	var entries []*zip.File
+	for _, f := range r.File {
+		if len(jarSigners) == 0 || !isJarSignatureFile(f.Name) {
+			entries = append(entries, f)
+		}
+	}
+
+	zw := zip.NewWriter(w)
+	for _, f := range entries {
+		if err := zw.CopyFromAligned(f, f.Name, alignment(f, pageAlignSharedLibs)); err != nil {
+			return err
+		}
+	}
+
+	if len(jarSigners) > 0 {
+		apkSchemes := []int{2}
+		if v3 {
+			apkSchemes = append(apkSchemes, 3)
+		}
+		names, contents, err := jarSignatureFiles(entries, jarSigners, apkSchemes)
+		if err != nil {
+			return err
+		}
+		for i := range names {
+			fh := &zip.FileHeader{Name: names[i], Method: zip.Deflate}
+			fh.SetModTime(jar.DefaultTime)
+			fw, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(contents[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+func checkAlignment(r *zip.Reader, pageAlignSharedLibs bool) error {
+	for _, f := range r.File {
+		align := alignment(f, pageAlignSharedLibs)
+		if align == 0 {
+			continue
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			return err
+		}
+		if offset%int64(align) != 0 {
+			return fmt.Errorf("%s is not aligned to %d bytes", f.Name, align)
+		}
+	}
+	return nil
+}
+
+type signer struct {
+	key  crypto.Signer
+	cert *x509.Certificate
+}
+
+func loadSigner(certFile, keyFile string) (*signer, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no PEM encoded certificate", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", certFile, err)
+	}
+
+	keyDER, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+
+	s := &signer{cert: cert}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.key = k
+	case *ecdsa.PrivateKey:
+		s.key = k
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", keyFile, key)
+	}
+
+	return s, nil
+}
+
+// Signature algorithm IDs from the APK Signature Scheme v2.  Both use the CHUNKED_SHA256
+// content digest.
+const (
+	sigRSAPKCS1v15SHA256 = 0x0103
+	sigECDSASHA256       = 0x0201
+)
+
+func (s *signer) algorithm() uint32 {
+	if _, ok := s.key.(*ecdsa.PrivateKey); ok {
+		return sigECDSASHA256
+	}
+	return sigRSAPKCS1v15SHA256
+}
+
+// sign signs the data with the key of the signer.  RSA PKCS #1 v1.5 signatures are
+// deterministic, ECDSA signatures are made deterministic with the nonces from RFC 6979.
+func (s *signer) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	if k, ok := s.key.(*ecdsa.PrivateKey); ok {
+		r, sig := signECDSADeterministic(k, digest[:])
+		return asn1.Marshal(struct{ R, S *big.Int }{r, sig})
+	}
+	return s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// bits2int converts a hash to an integer modulo n as specified in RFC 6979 section 2.3.2 and
+// by ECDSA, keeping the leftmost bits of the hash.
+func bits2int(b []byte, n *big.Int) *big.Int {
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8 - n.BitLen(); excess > 0 {
+		v.Rsh(v, uint(excess))
+	}
+	return v
+}
+
+// int2octets converts an integer to a big endian byte string of the length of n.
+func int2octets(v, n *big.Int) []byte {
+	out := make([]byte, (n.BitLen()+7)/8)
+	b := v.Bytes()
+	copy(out[len(out)-len(b):], b)
+	return out
+}
+
+// signECDSADeterministic signs a SHA-256 digest with an ECDSA key, using the nonce derived from
+// the key and the digest with HMAC-SHA256 as specified in RFC 6979 section 3.2.
+func signECDSADeterministic(priv *ecdsa.PrivateKey, digest []byte) (r, s *big.Int) {
+	n := priv.Curve.Params().N
+
+	e := bits2int(digest, n)
+	h1 := int2octets(new(big.Int).Mod(e, n), n)
+	x := int2octets(priv.D, n)
+
+	hmacSHA256 := func(key []byte, data ...[]byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		for _, d := range data {
+			mac.Write(d)
+		}
+		return mac.Sum(nil)
+	}
+
+	v := bytes.Repeat([]byte{0x01}, sha256.Size)
+	k := make([]byte, sha256.Size)
+	k = hmacSHA256(k, v, []byte{0x00}, x, h1)
+	v = hmacSHA256(k, v)
+	k = hmacSHA256(k, v, []byte{0x01}, x, h1)
+	v = hmacSHA256(k, v)
+
+	for {
+		var t []byte
+		for len(t)*8 < n.BitLen() {
+			v = hmacSHA256(k, v)
+			t = append(t, v...)
+		}
+		nonce := bits2int(t, n)
+
+		if nonce.Sign() > 0 && nonce.Cmp(n) < 0 {
+			rx, _ := priv.Curve.ScalarBaseMult(int2octets(nonce, n))
+			r = new(big.Int).Mod(rx, n)
+			if r.Sign() != 0 {
+				s = new(big.Int).Mul(priv.D, r)
+				s.Add(s, e)
+				s.Mul(s, new(big.Int).ModInverse(nonce, n))
+				s.Mod(s, n)
+				if s.Sign() != 0 {
+					return r, s
+				}
+			}
+		}
+
+		k = hmacSHA256(k, v, []byte{0x00})
+		v = hmacSHA256(k, v)
+	}
+}
+
+func verifySignature(algorithm uint32, pub interface{}, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch algorithm {
+	case sigRSAPKCS1v15SHA256:
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signature algorithm %#x does not match %T", algorithm, pub)
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case sigECDSASHA256:
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("signature algorithm %#x does not match %T", algorithm, pub)
+		}
+		var ecdsaSig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &ecdsaSig); err != nil || len(rest) > 0 {
+			return errors.New("malformed ECDSA signature")
+		}
+		if !ecdsa.Verify(k, digest[:], ecdsaSig.R, ecdsaSig.S) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported signature algorithm %#x", algorithm)
+	}
+}
+
+// The APK Signing Block is inserted between the zip entries and the central directory.  It
+// contains ID-value pairs, including the blocks for each signature scheme.
+const (
+	apkSigBlockMagic = "APK Sig Block 42"
+
+	v2BlockID = 0x7109871a
+	v3BlockID = 0xf05368c0
+
+	// Added to the v2 signed data when the APK also has a v3 signature, so that a v2 verifier
+	// rejects an APK that has been stripped of its v3 signature.
+	strippingProtectionAttrID = 0xbeeff00d
+
+	// v3 signatures are only verified on P (SDK version 28) and later.
+	v3MinSdkVersion = 28
+	v3MaxSdkVersion = 0x7fffffff
+
+	chunkSize = 1024 * 1024
+)
+
+// zipSections finds the offsets of the central directory and the end of central directory
+// record in a zip file.
+func zipSections(apk []byte) (cdOffset, eocdOffset int, err error) {
+	const eocdLen = 22
+	const eocdSignature = 0x06054b50
+
+	// The end of central directory record may be followed by a comment of up to 65535 bytes.
+	eocdOffset = -1
+	for i := len(apk) - eocdLen; i >= 0 && len(apk)-eocdLen-i <= 0xffff; i-- {
+		if binary.LittleEndian.Uint32(apk[i:]) == eocdSignature &&
+			int(binary.LittleEndian.Uint16(apk[i+20:])) == len(apk)-i-eocdLen {
+			eocdOffset = i
+			break
+		}
+	}
+	if eocdOffset < 0 {
+		return 0, 0, errors.New("end of central directory record not found")
+	}
+
+	cdOffset = int(binary.LittleEndian.Uint32(apk[eocdOffset+16:]))
+	if cdOffset == 0xffffffff {
+		return 0, 0, errors.New("zip64 is not supported")
+	}
+	if cdOffset > eocdOffset {
+		return 0, 0, errors.New("central directory offset out of range")
+	}
+	return cdOffset, eocdOffset, nil
+}
+
+// contentDigest computes the CHUNKED_SHA256 digest of the contents of an APK: the zip entries,
+// the central directory, and the end of central directory record with the offset of the
+// central directory replaced by the offset of the APK Signing Block.
+func contentDigest(entries, cd, eocd []byte, sigBlockOffset int) []byte {
+	eocd = append([]byte(nil), eocd...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(sigBlockOffset))
+
+	var chunkDigests []byte
+	var count uint32
+	for _, section := range [][]byte{entries, cd, eocd} {
+		for len(section) > 0 {
+			n := len(section)
+			if n > chunkSize {
+				n = chunkSize
+			}
+			h := sha256.New()
+			h.Write([]byte{0xa5})
+			binary.Write(h, binary.LittleEndian, uint32(n))
+			h.Write(section[:n])
+			chunkDigests = h.Sum(chunkDigests)
+			section = section[n:]
+			count++
+		}
+	}
+
+	h := sha256.New()
+	h.Write([]byte{0x5a})
+	binary.Write(h, binary.LittleEndian, count)
+	h.Write(chunkDigests)
+	return h.Sum(nil)
+}
+
+// lengthPrefixed concatenates its arguments, prefixed with their total length as a 32-bit
+// little endian integer.
+func lengthPrefixed(data ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, d := range data {
+		buf.Write(d)
+	}
+	return append(uint32Bytes(uint32(buf.Len())), buf.Bytes()...)
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+// signerBlock returns a length-prefixed v2 or v3 signer for the content digest.
+func signerBlock(s *signer, digest []byte, version int, attrs []byte) ([]byte, error) {
+	algorithm := s.algorithm()
+
+	var signedData []byte
+	digests := lengthPrefixed(lengthPrefixed(uint32Bytes(algorithm), lengthPrefixed(digest)))
+	certificates := lengthPrefixed(lengthPrefixed(s.cert.Raw))
+	if version == 3 {
+		signedData = lengthPrefixed(digests, certificates,
+			uint32Bytes(v3MinSdkVersion), uint32Bytes(v3MaxSdkVersion), lengthPrefixed(attrs))
+	} else {
+		signedData = lengthPrefixed(digests, certificates, lengthPrefixed(attrs))
+	}
+
+	sig, err := s.sign(signedData[4:])
+	if err != nil {
+		return nil, err
+	}
+	signatures := lengthPrefixed(lengthPrefixed(uint32Bytes(algorithm), lengthPrefixed(sig)))
+
+	publicKey, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	if version == 3 {
+		return lengthPrefixed(signedData, uint32Bytes(v3MinSdkVersion), uint32Bytes(v3MaxSdkVersion),
+			signatures, lengthPrefixed(publicKey)), nil
+	}
+	return lengthPrefixed(signedData, signatures, lengthPrefixed(publicKey)), nil
+}
+
+// sign inserts an APK Signing Block into an aligned APK.  The v3 signature scheme only supports
+// a single signer per platform version range, so a v3 block is only written if there is a single
+// signer.
+func sign(apk []byte, signers []*signer, v3 bool) ([]byte, error) {
+	cdOffset, eocdOffset, err := zipSections(apk)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := contentDigest(apk[:cdOffset], apk[cdOffset:eocdOffset], apk[eocdOffset:], cdOffset)
+
+	v3 = v3 && len(signers) == 1
+
+	var v2Attrs []byte
+	if v3 {
+		v2Attrs = lengthPrefixed(uint32Bytes(strippingProtectionAttrID), uint32Bytes(3))
+	}
+
+	var v2Signers [][]byte
+	for _, s := range signers {
+		b, err := signerBlock(s, digest, 2, v2Attrs)
+		if err != nil {
+			return nil, err
+		}
+		v2Signers = append(v2Signers, b)
+	}
+
+	pairs := [][]byte{idValuePair(v2BlockID, lengthPrefixed(v2Signers...))}
+
+	if v3 {
+		b, err := signerBlock(signers[0], digest, 3, nil)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, idValuePair(v3BlockID, lengthPrefixed(b)))
+	}
+
+	return insertSigBlock(apk, cdOffset, eocdOffset, pairs...), nil
+}
+
+// insertSigBlock inserts an APK Signing Block containing the ID-value pairs before the central
+// directory, and updates the offset of the central directory in the end of central directory
+// record.
+func insertSigBlock(apk []byte, cdOffset, eocdOffset int, pairs ...[]byte) []byte {
+	var pairsLen int
+	for _, p := range pairs {
+		pairsLen += len(p)
+	}
+	blockSize := uint64Bytes(uint64(pairsLen + 8 + len(apkSigBlockMagic)))
+
+	var out bytes.Buffer
+	out.Write(apk[:cdOffset])
+	out.Write(blockSize)
+	for _, p := range pairs {
+		out.Write(p)
+	}
+	out.Write(blockSize)
+	out.WriteString(apkSigBlockMagic)
+	newCDOffset := out.Len()
+	out.Write(apk[cdOffset:eocdOffset])
+	eocd := append([]byte(nil), apk[eocdOffset:]...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(newCDOffset))
+	out.Write(eocd)
+
+	return out.Bytes()
+}
+
+func idValuePair(id uint32, value []byte) []byte {
+	return append(append(uint64Bytes(uint64(4+len(value))), uint32Bytes(id)...), value...)
+}
+
+// readBuf reads length-prefixed values from an APK Signing Block.
+type readBuf []byte
+
+var errTruncated = errors.New("truncated APK Signing Block")
+
+func (b *readBuf) uint32() (uint32, error) {
+	if len(*b) < 4 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(*b)
+	*b = (*b)[4:]
+	return v, nil
+}
+
+func (b *readBuf) lengthPrefixed() (readBuf, error) {
+	n, err := b.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(*b)) < n {
+		return nil, errTruncated
+	}
+	v := (*b)[:n]
+	*b = (*b)[n:]
+	return v, nil
+}
+
+// sigBlockPairs finds the APK Signing Block preceding the central directory and returns its
+// ID-value pairs and offset.
+func sigBlockPairs(apk []byte, cdOffset int) (map[uint32][]byte, int, error) {
+	if cdOffset < 32 || string(apk[cdOffset-16:cdOffset]) != apkSigBlockMagic {
+		return nil, 0, errors.New("no APK Signing Block")
+	}
+	size := binary.LittleEndian.Uint64(apk[cdOffset-24:])
+	if size < 24 || size > uint64(cdOffset-8) {
+		return nil, 0, errors.New("invalid APK Signing Block size")
+	}
+	offset := cdOffset - int(size) - 8
+	if binary.LittleEndian.Uint64(apk[offset:]) != size {
+		return nil, 0, errors.New("APK Signing Block sizes do not match")
+	}
+
+	pairs := make(map[uint32][]byte)
+	b := apk[offset+8 : cdOffset-24]
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, 0, errTruncated
+		}
+		n := binary.LittleEndian.Uint64(b)
+		if n < 4 || n > uint64(len(b)-8) {
+			return nil, 0, errTruncated
+		}
+		id := binary.LittleEndian.Uint32(b[8:])
+		pairs[id] = b[12 : 8+n]
+		b = b[8+n:]
+	}
+
+	return pairs, offset, nil
+}
+
+// verifySigner verifies a v2 or v3 signer against the content digest and returns its
+// certificate.
+func verifySigner(b readBuf, version int, digest []byte) (*x509.Certificate, readBuf, error) {
+	signedData, err := b.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == 3 {
+		// minimum and maximum SDK versions
+		if _, err := b.uint32(); err != nil {
+			return nil, nil, err
+		}
+		if _, err := b.uint32(); err != nil {
+			return nil, nil, err
+		}
+	}
+	signatures, err := b.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKeyDER, err := b.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var algorithm uint32
+	for len(signatures) > 0 {
+		s, err := signatures.lengthPrefixed()
+		if err != nil {
+			return nil, nil, err
+		}
+		if algorithm, err = s.uint32(); err != nil {
+			return nil, nil, err
+		}
+		sig, err := s.lengthPrefixed()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := verifySignature(algorithm, publicKey, signedData, sig); err != nil {
+			return nil, nil, err
+		}
+	}
+	if algorithm == 0 {
+		return nil, nil, errors.New("signer has no signatures")
+	}
+
+	digests, err := signedData.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	var foundDigest bool
+	for len(digests) > 0 {
+		d, err := digests.lengthPrefixed()
+		if err != nil {
+			return nil, nil, err
+		}
+		digestAlgorithm, err := d.uint32()
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := d.lengthPrefixed()
+		if err != nil {
+			return nil, nil, err
+		}
+		if digestAlgorithm == algorithm {
+			if !bytes.Equal(value, digest) {
+				return nil, nil, errors.New("content digest mismatch")
+			}
+			foundDigest = true
+		}
+	}
+	if !foundDigest {
+		return nil, nil, errors.New("no content digest for signature algorithm")
+	}
+
+	certificates, err := signedData.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	certDER, err := certificates.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPublicKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(certPublicKey, publicKeyDER) {
+		return nil, nil, errors.New("public key does not match certificate")
+	}
+
+	if version == 3 {
+		// minimum and maximum SDK versions in the signed data
+		if _, err := signedData.uint32(); err != nil {
+			return nil, nil, err
+		}
+		if _, err := signedData.uint32(); err != nil {
+			return nil, nil, err
+		}
+	}
+	attrs, err := signedData.lengthPrefixed()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, attrs, nil
+}
+
+// verify checks the alignment of the entries of an APK and verifies its v2 and v3 signatures,
+// and its JAR signatures if v1 is set.  It returns the certificates of the v2 signers.
+func verify(apk []byte, pageAlignSharedLibs, v1 bool) ([]*x509.Certificate, error) {
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAlignment(r, pageAlignSharedLibs); err != nil {
+		return nil, err
+	}
+
+	var jarAPKSchemes []string
+	if v1 {
+		if jarAPKSchemes, err = verifyJarSignature(r); err != nil {
+			return nil, fmt.Errorf("JAR signature: %s", err)
+		}
+	}
+
+	cdOffset, eocdOffset, err := zipSections(apk)
+	if err != nil {
+		return nil, err
+	}
+	pairs, sigBlockOffset, err := sigBlockPairs(apk, cdOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := contentDigest(apk[:sigBlockOffset], apk[cdOffset:eocdOffset], apk[eocdOffset:],
+		sigBlockOffset)
+
+	if _, ok := pairs[v2BlockID]; !ok {
+		return nil, errors.New("no APK Signature Scheme v2 block")
+	}
+	v2Block := readBuf(pairs[v2BlockID])
+	_, hasV3 := pairs[v3BlockID]
+
+	var certs []*x509.Certificate
+	v2Signers, err := v2Block.lengthPrefixed()
+	if err != nil {
+		return nil, err
+	}
+	for len(v2Signers) > 0 {
+		s, err := v2Signers.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		cert, attrs, err := verifySigner(s, 2, digest)
+		if err != nil {
+			return nil, fmt.Errorf("v2 signature: %s", err)
+		}
+		if !hasV3 {
+			for len(attrs) > 0 {
+				attr, err := attrs.lengthPrefixed()
+				if err != nil {
+					return nil, err
+				}
+				if id, err := attr.uint32(); err != nil {
+					return nil, err
+				} else if id == strippingProtectionAttrID {
+					return nil, errors.New("v2 signer requires a v3 signature that was stripped")
+				}
+			}
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no v2 signers")
+	}
+
+	if v1 && hasV3 != inList("3", jarAPKSchemes) {
+		return nil, errors.New("JAR signature does not match the APK Signature Scheme v3 block")
+	}
+
+	if hasV3 {
+		v3Block := readBuf(pairs[v3BlockID])
+		v3Signers, err := v3Block.lengthPrefixed()
+		if err != nil {
+			return nil, err
+		}
+		for len(v3Signers) > 0 {
+			s, err := v3Signers.lengthPrefixed()
+			if err != nil {
+				return nil, err
+			}
+			if _, _, err := verifySigner(s, 3, digest); err != nil {
+				return nil, fmt.Errorf("v3 signature: %s", err)
+			}
+		}
+	}
+
+	return certs, nil
+}
+
+func inList(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,392 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+func testSigner(t *testing.T, name string, key crypto.Signer) *signer {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2048, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{key: key, cert: cert}
+}
+
+func rsaSigner(t *testing.T, name string) *signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner(t, name, key)
+}
+
+func ecdsaSigner(t *testing.T, name string) *signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner(t, name, key)
+}
+
+// testAPK returns an unaligned zip file with stored and compressed entries.
+func testAPK(t *testing.T) *zip.Reader {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, f := range []struct {
+		name   string
+		method uint16
+	}{
+		{"AndroidManifest.xml", zip.Deflate},
+		{"classes.dex", zip.Deflate},
+		{"resources.arsc", zip.Store},
+		{"lib/arm64-v8a/libfoo.so", zip.Store},
+		{"res/raw/a", zip.Store},
+		{"lib/arm64-v8a/libbar.so", zip.Deflate},
+		// Longer than a manifest line, the name is wrapped in the JAR signature files.
+		{"res/raw/" + strings.Repeat("long_file_name_", 6), zip.Deflate},
+	} {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte(f.name), 100))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func signTestAPK(t *testing.T, signers []*signer, v3 bool) []byte {
+	v3 = v3 && len(signers) == 1
+	aligned := &bytes.Buffer{}
+	if err := align(testAPK(t), aligned, true, signers, v3); err != nil {
+		t.Fatal(err)
+	}
+	apk, err := sign(aligned.Bytes(), signers, v3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apk
+}
+
+func TestSignVerify(t *testing.T) {
+	testCases := []struct {
+		name    string
+		signers func(t *testing.T) []*signer
+		v3      bool
+		wantV3  bool
+	}{
+		{
+			name:    "rsa",
+			signers: func(t *testing.T) []*signer { return []*signer{rsaSigner(t, "a")} },
+			v3:      true,
+			wantV3:  true,
+		},
+		{
+			name:    "ecdsa",
+			signers: func(t *testing.T) []*signer { return []*signer{ecdsaSigner(t, "a")} },
+			v3:      true,
+			wantV3:  true,
+		},
+		{
+			name:    "v2 only",
+			signers: func(t *testing.T) []*signer { return []*signer{rsaSigner(t, "a")} },
+			v3:      false,
+			wantV3:  false,
+		},
+		{
+			name: "multiple signers",
+			signers: func(t *testing.T) []*signer {
+				return []*signer{rsaSigner(t, "a"), ecdsaSigner(t, "b")}
+			},
+			v3:     true,
+			wantV3: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			signers := testCase.signers(t)
+			apk := signTestAPK(t, signers, testCase.v3)
+
+			certs, err := verify(apk, true, true)
+			if err != nil {
+				t.Fatalf("verify failed: %s", err)
+			}
+			if len(certs) != len(signers) {
+				t.Fatalf("expected %d signers, got %d", len(signers), len(certs))
+			}
+			for i := range certs {
+				if !certs[i].Equal(signers[i].cert) {
+					t.Errorf("signer %d: expected %q, got %q", i,
+						signers[i].cert.Subject.CommonName, certs[i].Subject.CommonName)
+				}
+			}
+
+			cdOffset, _, err := zipSections(apk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pairs, _, err := sigBlockPairs(apk, cdOffset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, hasV3 := pairs[v3BlockID]; hasV3 != testCase.wantV3 {
+				t.Errorf("expected v3 block %v, got %v", testCase.wantV3, hasV3)
+			}
+		})
+	}
+}
+
+func TestSignDeterministic(t *testing.T) {
+	for _, s := range []*signer{rsaSigner(t, "a"), ecdsaSigner(t, "b")} {
+		a := signTestAPK(t, []*signer{s}, true)
+		b := signTestAPK(t, []*signer{s}, true)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%T: signing the same input twice produced different outputs", s.key)
+		}
+	}
+}
+
+func TestECDSADeterministicRFC6979(t *testing.T) {
+	// The P-256 and SHA-256 test vector for the message "sample" from RFC 6979 appendix A.2.5.
+	hexInt := func(s string) *big.Int {
+		v, ok := new(big.Int).SetString(s, 16)
+		if !ok {
+			t.Fatalf("invalid hex %q", s)
+		}
+		return v
+	}
+
+	priv := &ecdsa.PrivateKey{}
+	priv.D = hexInt("C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")
+	priv.Curve = elliptic.P256()
+	priv.X, priv.Y = priv.Curve.ScalarBaseMult(priv.D.Bytes())
+
+	digest := sha256.Sum256([]byte("sample"))
+	r, s := signECDSADeterministic(priv, digest[:])
+
+	wantR := hexInt("EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716")
+	wantS := hexInt("F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8")
+	if r.Cmp(wantR) != 0 || s.Cmp(wantS) != 0 {
+		t.Errorf("expected signature (%X, %X), got (%X, %X)", wantR, wantS, r, s)
+	}
+	if !ecdsa.Verify(&priv.PublicKey, digest[:], r, s) {
+		t.Errorf("signature does not verify")
+	}
+}
+
+func TestJarSignature(t *testing.T) {
+	apk := signTestAPK(t, []*signer{rsaSigner(t, "a")}, true)
+
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	for _, name := range []string{"META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/CERT.RSA"} {
+		if !inList(name, names) {
+			t.Errorf("signed APK entries %q do not contain %q", names, name)
+		}
+	}
+
+	schemes, err := verifyJarSignature(r)
+	if err != nil {
+		t.Fatalf("verify failed: %s", err)
+	}
+	if strings.Join(schemes, ", ") != "2, 3" {
+		t.Errorf("expected X-Android-APK-Signed %q, got %q", "2, 3", schemes)
+	}
+
+	// Signing again replaces the JAR signature files instead of adding more.
+	resigned := &bytes.Buffer{}
+	if err := align(r, resigned, true, []*signer{ecdsaSigner(t, "b")}, false); err != nil {
+		t.Fatal(err)
+	}
+	r, err = zip.NewReader(bytes.NewReader(resigned.Bytes()), int64(resigned.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sigFiles []string
+	for _, f := range r.File {
+		if isJarSignatureFile(f.Name) {
+			sigFiles = append(sigFiles, f.Name)
+		}
+	}
+	expected := []string{"META-INF/MANIFEST.MF", "META-INF/CERT.SF", "META-INF/CERT.EC"}
+	if strings.Join(sigFiles, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected JAR signature files %q, got %q", expected, sigFiles)
+	}
+	if _, err := verifyJarSignature(r); err != nil {
+		t.Errorf("verify of the ECDSA JAR signature failed: %s", err)
+	}
+
+	// The v1 signature records the v3 signature, removing the v3 block must be detected.
+	aligned := &bytes.Buffer{}
+	signers := []*signer{rsaSigner(t, "a")}
+	if err := align(testAPK(t), aligned, true, signers, true); err != nil {
+		t.Fatal(err)
+	}
+	v2Only, err := sign(aligned.Bytes(), signers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(v2Only, true, true); err == nil {
+		t.Errorf("verify succeeded on an APK with a stripped v3 signature")
+	}
+}
+
+func TestJarSignatureTampered(t *testing.T) {
+	aligned := &bytes.Buffer{}
+	if err := align(testAPK(t), aligned, true, []*signer{rsaSigner(t, "a")}, true); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(aligned.Bytes()), int64(aligned.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the contents of an entry, keeping the JAR signature files.
+	tampered := &bytes.Buffer{}
+	w := zip.NewWriter(tampered)
+	for _, f := range r.File {
+		if f.Name == "res/raw/a" {
+			fw, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Store})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("modified"))
+		} else if err := w.CopyFrom(f, f.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = zip.NewReader(bytes.NewReader(tampered.Bytes()), int64(tampered.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyJarSignature(r); err == nil {
+		t.Errorf("verify succeeded on a modified entry")
+	} else if !strings.Contains(err.Error(), "res/raw/a: digest mismatch") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	apk := signTestAPK(t, []*signer{rsaSigner(t, "a")}, true)
+
+	r, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offset int64
+	for _, f := range r.File {
+		if f.Name == "res/raw/a" {
+			offset, err = f.DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tampered := append([]byte(nil), apk...)
+	tampered[offset] ^= 0xff
+	if _, err := verify(tampered, true, true); err == nil {
+		t.Errorf("verify succeeded on a modified entry")
+	}
+
+	// Removing the v3 block must be detected by the stripping protection attribute of the v2
+	// signer.
+	signers := []*signer{rsaSigner(t, "a")}
+	aligned := &bytes.Buffer{}
+	if err := align(testAPK(t), aligned, true, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	cdOffset, eocdOffset, err := zipSections(aligned.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := contentDigest(aligned.Bytes()[:cdOffset], aligned.Bytes()[cdOffset:eocdOffset],
+		aligned.Bytes()[eocdOffset:], cdOffset)
+	v2Signer, err := signerBlock(signers[0], digest, 2,
+		lengthPrefixed(uint32Bytes(strippingProtectionAttrID), uint32Bytes(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped := insertSigBlock(aligned.Bytes(), cdOffset, eocdOffset,
+		idValuePair(v2BlockID, lengthPrefixed(v2Signer)))
+	if _, err := verify(stripped, true, false); err == nil {
+		t.Errorf("verify succeeded on an APK with a stripped v3 signature")
+	}
+}
+
+func TestVerifyUnaligned(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, f := range testAPK(t).File {
+		if err := w.CopyFrom(f, f.Name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	apk, err := sign(buf.Bytes(), []*signer{rsaSigner(t, "a")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(apk, true, false); err == nil {
+		t.Errorf("verify succeeded on an unaligned APK")
+	}
+}
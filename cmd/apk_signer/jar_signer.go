@@ -0,0 +1,422 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// This file contains the JAR (v1) signing of APKs.  The digests are SHA-256, which devices
+// support since SDK version 18.
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"android/soong/jar"
+	"android/soong/third_party/zip"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECPublicKey   = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+	asn1Null = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+// The PKCS #7 SignedData structures of a JAR signature block file, without authenticated
+// attributes.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	Certificates     asn1.RawValue
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// isJarSignatureFile returns true for the files in META-INF that are replaced when an APK is
+// signed.
+func isJarSignatureFile(name string) bool {
+	if name == jar.ManifestFile {
+		return true
+	}
+	if !strings.HasPrefix(name, jar.MetaDir) || strings.Contains(name[len(jar.MetaDir):], "/") {
+		return false
+	}
+	for _, ext := range []string{".SF", ".RSA", ".DSA", ".EC"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeManifestAttr writes a "name: value" line of a manifest or signature file, wrapped at 72
+// bytes with continuation lines starting with a space.
+func writeManifestAttr(w *bytes.Buffer, name, value string) {
+	line := name + ": " + value
+	const maxLen = 72
+	for first := true; first || len(line) > 0; first = false {
+		n := maxLen
+		if !first {
+			w.WriteByte(' ')
+			n--
+		}
+		if n > len(line) {
+			n = len(line)
+		}
+		w.WriteString(line[:n])
+		w.WriteString("\r\n")
+		line = line[n:]
+	}
+}
+
+func base64SHA256(data []byte) string {
+	digest := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// entryDigest returns the base64 encoded SHA-256 digest of the uncompressed contents of a zip
+// entry.
+func entryDigest(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", fmt.Errorf("%s: %s", f.Name, err)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// jarSignatureFiles returns the manifest and, for each signer, the signature file and the
+// signature block file of a JAR signature over the entries.  apkSchemes lists the versions of the
+// APK Signature Schemes that the APK will also be signed with, which the signature files record
+// so that verifiers that support them reject an APK whose APK Signing Block was stripped.
+func jarSignatureFiles(entries []*zip.File, signers []*signer,
+	apkSchemes []int) (names []string, contents [][]byte, err error) {
+
+	manifest := &bytes.Buffer{}
+	writeManifestAttr(manifest, "Manifest-Version", "1.0")
+	writeManifestAttr(manifest, "Created-By", "1.0 (Android)")
+	manifest.WriteString("\r\n")
+
+	sfEntries := &bytes.Buffer{}
+	for _, f := range entries {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		digest, err := entryDigest(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		section := &bytes.Buffer{}
+		writeManifestAttr(section, "Name", f.Name)
+		writeManifestAttr(section, "SHA-256-Digest", digest)
+		section.WriteString("\r\n")
+		manifest.Write(section.Bytes())
+
+		writeManifestAttr(sfEntries, "Name", f.Name)
+		writeManifestAttr(sfEntries, "SHA-256-Digest", base64SHA256(section.Bytes()))
+		sfEntries.WriteString("\r\n")
+	}
+
+	var schemes []string
+	for _, v := range apkSchemes {
+		schemes = append(schemes, strconv.Itoa(v))
+	}
+
+	sf := &bytes.Buffer{}
+	writeManifestAttr(sf, "Signature-Version", "1.0")
+	writeManifestAttr(sf, "Created-By", "1.0 (Android)")
+	writeManifestAttr(sf, "SHA-256-Digest-Manifest", base64SHA256(manifest.Bytes()))
+	if len(schemes) > 0 {
+		writeManifestAttr(sf, "X-Android-APK-Signed", strings.Join(schemes, ", "))
+	}
+	sf.WriteString("\r\n")
+	sf.Write(sfEntries.Bytes())
+
+	names = append(names, jar.ManifestFile)
+	contents = append(contents, manifest.Bytes())
+
+	for i, s := range signers {
+		name := jar.MetaDir + "CERT"
+		if i > 0 {
+			name += strconv.Itoa(i + 1)
+		}
+
+		block, ext, err := signatureBlock(s, sf.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, name+".SF", name+ext)
+		contents = append(contents, sf.Bytes(), block)
+	}
+
+	return names, contents, nil
+}
+
+// signatureBlock returns the PKCS #7 signature block file of a signer over a signature file and
+// its extension.
+func signatureBlock(s *signer, sf []byte) ([]byte, string, error) {
+	sig, err := s.sign(sf)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encryptionAlgorithm := pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1Null}
+	ext := ".RSA"
+	if _, ok := s.key.(*ecdsa.PrivateKey); ok {
+		encryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey}
+		ext = ".EC"
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1Null}
+
+	signedData := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      s.cert.Raw,
+		},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: s.cert.RawIssuer},
+				SerialNumber: s.cert.SerialNumber,
+			},
+			DigestAlgorithm:           sha256Algorithm,
+			DigestEncryptionAlgorithm: encryptionAlgorithm,
+			EncryptedDigest:           sig,
+		}},
+	}
+	signedData.ContentInfo.ContentType = oidData
+
+	signedDataDER, err := asn1.Marshal(signedData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	block, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedDataDER,
+		},
+	})
+	return block, ext, err
+}
+
+// readManifestSections parses a manifest or signature file into its sections, each a map of the
+// attributes in the section.  The first section is the main section.
+func readManifestSections(data []byte) ([]map[string]string, error) {
+	var sections []map[string]string
+
+	for len(data) > 0 {
+		end := bytes.Index(data, []byte("\r\n\r\n"))
+		if end < 0 {
+			return nil, errors.New("manifest section is not terminated by an empty line")
+		}
+		end += 4
+		section := data[:end]
+		data = data[end:]
+
+		attrs := make(map[string]string)
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(section), "\r\n\r\n"), "\r\n") {
+			if strings.HasPrefix(line, " ") && len(lines) > 0 {
+				lines[len(lines)-1] += line[1:]
+			} else {
+				lines = append(lines, line)
+			}
+		}
+		for _, line := range lines {
+			i := strings.Index(line, ": ")
+			if i < 0 {
+				return nil, fmt.Errorf("malformed manifest line %q", line)
+			}
+			attrs[line[:i]] = line[i+2:]
+		}
+		sections = append(sections, attrs)
+	}
+
+	if len(sections) == 0 {
+		return nil, errors.New("empty manifest")
+	}
+	return sections, nil
+}
+
+// verifyJarSignature verifies the JAR signatures of an APK: the digests of the entries in the
+// manifest, the digest of the manifest in each signature file, and the signature of each
+// signature file.  It returns the versions of the APK Signature Schemes recorded in the
+// signature files.
+func verifyJarSignature(r *zip.Reader) ([]string, error) {
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	readFile := func(name string) ([]byte, error) {
+		f := files[name]
+		if f == nil {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	manifest, err := readFile(jar.ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := readManifestSections(manifest)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for _, section := range sections[1:] {
+		digests[section["Name"]] = section["SHA-256-Digest"]
+	}
+	for _, f := range r.File {
+		if isJarSignatureFile(f.Name) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		digest, err := entryDigest(f)
+		if err != nil {
+			return nil, err
+		}
+		if want, ok := digests[f.Name]; !ok {
+			return nil, fmt.Errorf("%s is not in the manifest", f.Name)
+		} else if digest != want {
+			return nil, fmt.Errorf("%s: digest mismatch", f.Name)
+		}
+	}
+
+	var apkSigned []string
+	var signers int
+	for _, f := range r.File {
+		if !isJarSignatureFile(f.Name) || !strings.HasSuffix(f.Name, ".SF") {
+			continue
+		}
+		base := strings.TrimSuffix(f.Name, ".SF")
+		sf, err := readFile(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		sfSections, err := readManifestSections(sf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name, err)
+		}
+		if sfSections[0]["SHA-256-Digest-Manifest"] != base64SHA256(manifest) {
+			return nil, fmt.Errorf("%s: manifest digest mismatch", f.Name)
+		}
+
+		var block []byte
+		for _, ext := range []string{".RSA", ".EC"} {
+			if files[base+ext] != nil {
+				if block, err = readFile(base + ext); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if block == nil {
+			return nil, fmt.Errorf("%s: missing signature block file", f.Name)
+		}
+		if err := verifySignatureBlock(block, sf); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name, err)
+		}
+
+		apkSigned = strings.Split(sfSections[0]["X-Android-APK-Signed"], ", ")
+		signers++
+	}
+	if signers == 0 {
+		return nil, errors.New("no JAR signature files")
+	}
+
+	return apkSigned, nil
+}
+
+// verifySignatureBlock verifies the signature of a PKCS #7 signature block file over a signature
+// file with the certificate in the block.
+func verifySignatureBlock(block, sf []byte) error {
+	var contentInfo pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(block, &contentInfo); err != nil {
+		return err
+	} else if len(rest) > 0 {
+		return errors.New("trailing data after signature block")
+	}
+	if !contentInfo.ContentType.Equal(oidSignedData) {
+		return errors.New("signature block is not PKCS #7 SignedData")
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(signedData.Certificates.Bytes)
+	if err != nil {
+		return err
+	}
+	if len(signedData.SignerInfos) != 1 {
+		return errors.New("signature block does not have exactly one signer")
+	}
+	signerInfo := signedData.SignerInfos[0]
+
+	algorithm := uint32(sigRSAPKCS1v15SHA256)
+	if signerInfo.DigestEncryptionAlgorithm.Algorithm.Equal(oidECPublicKey) {
+		algorithm = sigECDSASHA256
+	}
+	return verifySignature(algorithm, cert.PublicKey, sf, signerInfo.EncryptedDigest)
+}
@@ -0,0 +1,202 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// check_duplicate_classes fails if the same class is in more than one of the jars that are merged
+// into a jar, or is in one of the merged jars and in a jar on the runtime classpath.  Duplicate
+// classes that match an allowed pattern only print a warning.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"android/soong/third_party/zip"
+)
+
+// jarList is a list of jars passed as <module>=<path>.
+type jarList []jar
+
+type jar struct {
+	module, path string
+}
+
+func (l *jarList) String() string {
+	return `""`
+}
+
+func (l *jarList) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i == -1 {
+		return fmt.Errorf("expected <module>=<path>, got %q", s)
+	}
+	*l = append(*l, jar{module: s[:i], path: s[i+1:]})
+	return nil
+}
+
+type patternList []string
+
+func (l *patternList) String() string {
+	return `""`
+}
+
+func (l *patternList) Set(s string) error {
+	if _, err := filepath.Match(s, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %s", s, err)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	output    = flag.String("o", "", "stamp file to write if there are no disallowed duplicate classes")
+	jars      jarList
+	classpath jarList
+	allowed   patternList
+)
+
+func init() {
+	flag.Var(&jars, "jar", "a jar that is merged, as <module>=<path>")
+	flag.Var(&classpath, "classpath", "a jar on the runtime classpath, as <module>=<path>")
+	flag.Var(&allowed, "allow", "a pattern of fully qualified class names that may be duplicated")
+}
+
+// duplicate is a class that is in more than one jar.
+type duplicate struct {
+	class string
+	jars  []jar
+}
+
+func (d duplicate) String() string {
+	s := "duplicate class " + d.class + " in:"
+	for _, j := range d.jars {
+		s += fmt.Sprintf("\n    %s (from %s)", j.path, j.module)
+	}
+	return s
+}
+
+// className returns the fully qualified name of the class in the jar entry name, or "" if the
+// entry is not a class.
+func className(name string) string {
+	if !strings.HasSuffix(name, ".class") || strings.HasPrefix(name, "META-INF/") ||
+		filepath.Base(name) == "module-info.class" {
+		return ""
+	}
+	return strings.Replace(strings.TrimSuffix(name, ".class"), "/", ".", -1)
+}
+
+func listClasses(path string) ([]string, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var classes []string
+	for _, f := range r.File {
+		if class := className(f.Name); class != "" {
+			classes = append(classes, class)
+		}
+	}
+	return classes, nil
+}
+
+// findDuplicates returns the classes that are in more than one of the merged jars, or in a merged
+// jar and a classpath jar, sorted by class name.
+func findDuplicates(jars, classpath jarList) ([]duplicate, error) {
+	merged := make(map[string][]jar)
+	for _, j := range jars {
+		classes, err := listClasses(j.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range classes {
+			merged[class] = append(merged[class], j)
+		}
+	}
+
+	for _, j := range classpath {
+		classes, err := listClasses(j.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range classes {
+			if _, ok := merged[class]; ok {
+				merged[class] = append(merged[class], j)
+			}
+		}
+	}
+
+	var duplicates []duplicate
+	for class, jars := range merged {
+		if len(jars) > 1 {
+			duplicates = append(duplicates, duplicate{class, jars})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].class < duplicates[j].class })
+
+	return duplicates, nil
+}
+
+func isAllowed(class string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if match, _ := filepath.Match(pattern, class); match {
+			return true
+		}
+	}
+	return false
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: check_duplicate_classes -o stamp [-allow pattern] "+
+			"-jar module=path [-jar module=path] [-classpath module=path]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *output == "" || flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	duplicates, err := findDuplicates(jars, classpath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, d := range duplicates {
+		if isAllowed(d.class, allowed) {
+			fmt.Fprintln(os.Stderr, "warning:", d)
+		} else {
+			fmt.Fprintln(os.Stderr, "error:", d)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(*output, nil, 0666); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
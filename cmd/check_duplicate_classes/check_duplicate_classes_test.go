@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+func writeJar(t *testing.T, dir, name string, entries ...string) string {
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for _, entry := range entries {
+		if _, err := w.Create(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClassName(t *testing.T) {
+	testCases := []struct {
+		name, class string
+	}{
+		{"com/foo/Bar.class", "com.foo.Bar"},
+		{"com/foo/Bar$Inner.class", "com.foo.Bar$Inner"},
+		{"com/foo/bar.txt", ""},
+		{"com/foo/", ""},
+		{"META-INF/versions/9/com/foo/Bar.class", ""},
+		{"module-info.class", ""},
+	}
+
+	for _, testCase := range testCases {
+		if class := className(testCase.name); class != testCase.class {
+			t.Errorf("className(%q) = %q, expected %q", testCase.name, class, testCase.class)
+		}
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check_duplicate_classes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := jar{"foo", writeJar(t, dir, "a.jar", "com/foo/A.class", "com/foo/B.class", "res.txt")}
+	b := jar{"bar", writeJar(t, dir, "b.jar", "com/foo/B.class", "com/bar/C.class", "res.txt")}
+	c := jar{"baz", writeJar(t, dir, "c.jar", "com/bar/C.class", "com/baz/D.class")}
+	d := jar{"qux", writeJar(t, dir, "d.jar", "com/baz/D.class", "com/qux/E.class")}
+
+	duplicates, err := findDuplicates(jarList{a, b}, jarList{c, d})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// com.baz.D is only in classpath jars, which are not checked against each other.
+	expected := []duplicate{
+		{"com.bar.C", []jar{b, c}},
+		{"com.foo.B", []jar{a, b}},
+	}
+	if !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("expected duplicates %v, got %v", expected, duplicates)
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	allowed := []string{"com.foo.*", "com.bar.Baz"}
+
+	testCases := []struct {
+		class   string
+		allowed bool
+	}{
+		{"com.foo.A", true},
+		{"com.foo.sub.A", true},
+		{"com.bar.Baz", true},
+		{"com.bar.Baz$Inner", false},
+		{"com.bar.Qux", false},
+	}
+
+	for _, testCase := range testCases {
+		if allowed := isAllowed(testCase.class, allowed); allowed != testCase.allowed {
+			t.Errorf("isAllowed(%q) = %v, expected %v", testCase.class, allowed, testCase.allowed)
+		}
+	}
+}
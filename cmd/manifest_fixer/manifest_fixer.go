@@ -0,0 +1,363 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// manifest_fixer adds what the build system knows about an app to its AndroidManifest.xml: the
+// minimum and target SDK versions if the manifest does not set them, and a <uses-library> element
+// for each shared library the app is compiled against.  It also checks that the manifest declares
+// the expected package.  The rest of the manifest, including its formatting, is left unchanged.
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const androidNs = "http://schemas.android.com/apk/res/android"
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return `""`
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var (
+	minSdkVersion = flag.String("minSdkVersion", "",
+		"minSdkVersion to set if the manifest does not set one")
+	targetSdkVersion = flag.String("targetSdkVersion", "",
+		"targetSdkVersion to set if the manifest does not set one")
+	packageName   = flag.String("package", "", "package that the manifest must declare")
+	usesLibraries stringList
+)
+
+func init() {
+	flag.Var(&usesLibraries, "uses-library", "a shared library to add a <uses-library> element for")
+}
+
+// fixes are the changes to make to a manifest.
+type fixes struct {
+	minSdkVersion, targetSdkVersion string
+	packageName                     string
+	usesLibraries                   []string
+}
+
+// element is an element of the manifest along with its children, which are either *elements or
+// the other tokens returned by xml.Decoder.RawToken.  Names keep the prefixes that are used in the
+// manifest, so that the manifest can be written back out without rewriting its namespaces.
+type element struct {
+	xml.StartElement
+	children []interface{}
+}
+
+func (e *element) attr(space, local string) (string, bool) {
+	for _, a := range e.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (e *element) setAttr(space, local, value string) {
+	e.Attr = append(e.Attr, xml.Attr{Name: xml.Name{Space: space, Local: local}, Value: value})
+}
+
+// childElements returns the children of the element with the given name.
+func (e *element) childElements(name string) []*element {
+	var ret []*element
+	for _, c := range e.children {
+		if child, ok := c.(*element); ok && child.Name.Space == "" && child.Name.Local == name {
+			ret = append(ret, child)
+		}
+	}
+	return ret
+}
+
+// insertChild inserts a child element before the child at index i, on a new line indented by
+// indent.  parentIndent is the indentation of the element's end tag, used if the element had no
+// children.
+func (e *element) insertChild(i int, child *element, indent, parentIndent string) {
+	if len(e.children) == 0 {
+		e.children = []interface{}{xml.CharData("\n" + indent), child,
+			xml.CharData("\n" + parentIndent)}
+		return
+	}
+
+	children := append([]interface{}(nil), e.children[:i]...)
+	children = append(children, xml.CharData("\n"+indent), child)
+	e.children = append(children, e.children[i:]...)
+}
+
+// appendChild adds a child element after the existing children of the element, before any
+// whitespace that precedes its end tag.
+func (e *element) appendChild(child *element, indent, parentIndent string) {
+	i := len(e.children)
+	if i > 0 {
+		if text, ok := e.children[i-1].(xml.CharData); ok && len(bytes.TrimSpace(text)) == 0 {
+			i--
+		}
+	}
+	e.insertChild(i, child, indent, parentIndent)
+}
+
+// parse returns the top level tokens of a manifest, with each element and its children collected
+// into an *element.
+func parse(r io.Reader) ([]interface{}, error) {
+	d := xml.NewDecoder(r)
+
+	var top []interface{}
+	var stack []*element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tok = xml.CopyToken(tok)
+
+		var node interface{} = tok
+		switch t := tok.(type) {
+		case xml.StartElement:
+			node = &element{StartElement: t}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected end element </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, node)
+		} else {
+			top = append(top, node)
+		}
+
+		if e, ok := node.(*element); ok {
+			stack = append(stack, e)
+		}
+	}
+
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("unexpected end of file in <%s>", stack[len(stack)-1].Name.Local)
+	}
+
+	return top, nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// write writes tokens returned by parse back out as XML.  Elements with no children are written
+// as empty-element tags.
+func write(w *bytes.Buffer, nodes []interface{}) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *element:
+			w.WriteString("<" + qualifiedName(n.Name))
+			for _, a := range n.Attr {
+				w.WriteString(" " + qualifiedName(a.Name) + `="` + attrEscaper.Replace(a.Value) + `"`)
+			}
+			if len(n.children) == 0 {
+				w.WriteString(" />")
+			} else {
+				w.WriteString(">")
+				write(w, n.children)
+				w.WriteString("</" + qualifiedName(n.Name) + ">")
+			}
+		case xml.CharData:
+			w.WriteString(textEscaper.Replace(string(n)))
+		case xml.Comment:
+			w.WriteString("<!--" + string(n) + "-->")
+		case xml.ProcInst:
+			w.WriteString("<?" + n.Target)
+			if len(n.Inst) > 0 {
+				w.WriteString(" " + string(n.Inst))
+			}
+			w.WriteString("?>")
+		case xml.Directive:
+			w.WriteString("<!" + string(n) + ">")
+		}
+	}
+}
+
+// indentOf returns the indentation of the children of an element, taken from the whitespace
+// before its first child element, or def if it has none.
+func indentOf(e *element, def string) string {
+	for i, c := range e.children {
+		if _, ok := c.(*element); ok {
+			if i > 0 {
+				if text, ok := e.children[i-1].(xml.CharData); ok {
+					s := string(text)
+					if j := strings.LastIndex(s, "\n"); j != -1 && strings.TrimSpace(s) == "" {
+						return s[j+1:]
+					}
+				}
+			}
+			break
+		}
+	}
+	return def
+}
+
+// fixManifest applies fixes to the contents of a manifest and returns the fixed manifest.
+func fixManifest(in []byte, f fixes) ([]byte, error) {
+	nodes, err := parse(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest *element
+	for _, node := range nodes {
+		if e, ok := node.(*element); ok {
+			manifest = e
+			break
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("no root element")
+	} else if manifest.Name.Space != "" || manifest.Name.Local != "manifest" {
+		return nil, fmt.Errorf("root element is <%s>, expected <manifest>",
+			qualifiedName(manifest.Name))
+	}
+
+	if f.packageName != "" {
+		if pkg, _ := manifest.attr("", "package"); pkg != f.packageName {
+			return nil, fmt.Errorf("manifest declares package %q, expected %q", pkg, f.packageName)
+		}
+	}
+
+	// Use the prefix that the manifest already uses for the android namespace, and only declare
+	// the namespace if it is missing and an android attribute is added.
+	android := ""
+	for _, a := range manifest.Attr {
+		if a.Name.Space == "xmlns" && a.Value == androidNs {
+			android = a.Name.Local
+			break
+		}
+	}
+	if android == "" {
+		android = "android"
+		if _, ok := manifest.attr("xmlns", android); ok {
+			return nil, fmt.Errorf("xmlns:%s is not the android namespace", android)
+		}
+		if f.minSdkVersion != "" || f.targetSdkVersion != "" || len(f.usesLibraries) > 0 {
+			manifest.setAttr("xmlns", android, androidNs)
+		}
+	}
+
+	indent := indentOf(manifest, "    ")
+
+	if f.minSdkVersion != "" || f.targetSdkVersion != "" {
+		var usesSdk *element
+		if elements := manifest.childElements("uses-sdk"); len(elements) > 0 {
+			usesSdk = elements[0]
+		} else {
+			usesSdk = &element{StartElement: xml.StartElement{Name: xml.Name{Local: "uses-sdk"}}}
+			manifest.insertChild(0, usesSdk, indent, "")
+		}
+
+		if _, ok := usesSdk.attr(android, "minSdkVersion"); !ok && f.minSdkVersion != "" {
+			usesSdk.setAttr(android, "minSdkVersion", f.minSdkVersion)
+		}
+		if _, ok := usesSdk.attr(android, "targetSdkVersion"); !ok && f.targetSdkVersion != "" {
+			usesSdk.setAttr(android, "targetSdkVersion", f.targetSdkVersion)
+		}
+	}
+
+	if len(f.usesLibraries) > 0 {
+		var application *element
+		if elements := manifest.childElements("application"); len(elements) > 0 {
+			application = elements[0]
+		} else {
+			application = &element{StartElement: xml.StartElement{Name: xml.Name{Local: "application"}}}
+			manifest.appendChild(application, indent, "")
+		}
+
+		existing := make(map[string]bool)
+		for _, usesLibrary := range application.childElements("uses-library") {
+			name, _ := usesLibrary.attr(android, "name")
+			existing[name] = true
+		}
+
+		for _, lib := range f.usesLibraries {
+			if existing[lib] {
+				continue
+			}
+			existing[lib] = true
+			usesLibrary := &element{StartElement: xml.StartElement{Name: xml.Name{Local: "uses-library"}}}
+			usesLibrary.setAttr(android, "name", lib)
+			application.appendChild(usesLibrary, indentOf(application, indent+indent), indent)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	write(buf, nodes)
+	return buf.Bytes(), nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: manifest_fixer [-minSdkVersion version] "+
+			"[-targetSdkVersion version] [-package package] [-uses-library library] <input> <output>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	in, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	out, err := fixManifest(in, fixes{
+		minSdkVersion:    *minSdkVersion,
+		targetSdkVersion: *targetSdkVersion,
+		packageName:      *packageName,
+		usesLibraries:    usesLibraries,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(flag.Arg(1), out, 0666); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const header = `<?xml version="1.0" encoding="utf-8"?>
+`
+
+func TestFixManifest(t *testing.T) {
+	testCases := []struct {
+		name  string
+		in    string
+		fixes fixes
+		out   string
+	}{
+		{
+			name: "unchanged",
+			in: header + `<!-- comment -->
+<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <application android:label="a &amp; b" />
+</manifest>
+`,
+		},
+		{
+			name: "insert uses-sdk",
+			in: header + `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <application />
+</manifest>
+`,
+			fixes: fixes{minSdkVersion: "21", targetSdkVersion: "27"},
+			out: header + `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <uses-sdk android:minSdkVersion="21" android:targetSdkVersion="27" />
+    <application />
+</manifest>
+`,
+		},
+		{
+			name: "keep existing sdk versions",
+			in: header + `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+  <uses-sdk android:minSdkVersion="14" />
+</manifest>
+`,
+			fixes: fixes{minSdkVersion: "21", targetSdkVersion: "27"},
+			out: header + `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+  <uses-sdk android:minSdkVersion="14" android:targetSdkVersion="27" />
+</manifest>
+`,
+		},
+		{
+			name: "other android prefix",
+			in: `<manifest xmlns:a="http://schemas.android.com/apk/res/android" package="com.android.foo">
+</manifest>`,
+			fixes: fixes{minSdkVersion: "21"},
+			out: `<manifest xmlns:a="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <uses-sdk a:minSdkVersion="21" />
+</manifest>`,
+		},
+		{
+			name:  "no android namespace",
+			in:    `<manifest package="com.android.foo" />`,
+			fixes: fixes{minSdkVersion: "21"},
+			out: `<manifest package="com.android.foo" xmlns:android="http://schemas.android.com/apk/res/android">
+    <uses-sdk android:minSdkVersion="21" />
+</manifest>`,
+		},
+		{
+			name: "uses-library",
+			in: `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <application android:label="foo">
+        <uses-library android:name="android.test.runner" />
+        <activity android:name=".Foo" />
+    </application>
+</manifest>`,
+			fixes: fixes{usesLibraries: []string{"android.test.runner", "org.apache.http.legacy"}},
+			out: `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+    <application android:label="foo">
+        <uses-library android:name="android.test.runner" />
+        <activity android:name=".Foo" />
+        <uses-library android:name="org.apache.http.legacy" />
+    </application>
+</manifest>`,
+		},
+		{
+			name: "uses-library without application",
+			in: `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+  <uses-permission android:name="android.permission.INTERNET" />
+</manifest>`,
+			fixes: fixes{usesLibraries: []string{"org.apache.http.legacy"}},
+			out: `<manifest xmlns:android="http://schemas.android.com/apk/res/android" package="com.android.foo">
+  <uses-permission android:name="android.permission.INTERNET" />
+  <application>
+    <uses-library android:name="org.apache.http.legacy" />
+  </application>
+</manifest>`,
+		},
+		{
+			name:  "matching package",
+			in:    `<manifest package="com.android.foo" />`,
+			fixes: fixes{packageName: "com.android.foo"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			out, err := fixManifest([]byte(testCase.in), testCase.fixes)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			expected := testCase.out
+			if expected == "" {
+				expected = testCase.in
+			}
+			if string(out) != expected {
+				t.Errorf("incorrect output:\n%s\nexpected:\n%s", out, expected)
+			}
+		})
+	}
+}
+
+func TestFixManifestErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		in    string
+		fixes fixes
+		err   string
+	}{
+		{
+			name:  "mismatched package",
+			in:    `<manifest package="com.android.foo" />`,
+			fixes: fixes{packageName: "com.android.bar"},
+			err:   `manifest declares package "com.android.foo", expected "com.android.bar"`,
+		},
+		{
+			name: "wrong root element",
+			in:   `<application />`,
+			err:  "root element is <application>, expected <manifest>",
+		},
+		{
+			name: "no root element",
+			in:   `<!-- comment -->`,
+			err:  "no root element",
+		},
+		{
+			name: "unterminated element",
+			in:   `<manifest package="com.android.foo">`,
+			err:  "unexpected end of file in <manifest>",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := fixManifest([]byte(testCase.in), testCase.fixes)
+			if err == nil {
+				t.Fatalf("expected error %q", testCase.err)
+			}
+			if !strings.Contains(err.Error(), testCase.err) {
+				t.Errorf("expected error %q, got %q", testCase.err, err)
+			}
+		})
+	}
+}
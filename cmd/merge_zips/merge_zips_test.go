@@ -0,0 +1,148 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+var testCases = []struct {
+	name string
+
+	inputZips   [][]string
+	sortEntries bool
+
+	outputFiles []string
+	err         string
+}{
+	{
+		name: "input order",
+
+		inputZips: [][]string{
+			{"b/b.py", "a.py"},
+			{"b/a.pyc", "a.pyc"},
+		},
+
+		outputFiles: []string{"b/b.py", "a.py", "b/a.pyc", "a.pyc"},
+	},
+	{
+		name: "sort entries",
+
+		inputZips: [][]string{
+			{"b/b.py", "a.py"},
+			{"b/a.pyc", "a.pyc"},
+		},
+		sortEntries: true,
+
+		outputFiles: []string{"a.py", "a.pyc", "b/a.pyc", "b/b.py"},
+	},
+	{
+		name: "duplicate",
+
+		inputZips: [][]string{
+			{"a.py"},
+			{"a.py"},
+		},
+		sortEntries: true,
+
+		err: "Duplicate path a.py",
+	},
+}
+
+func TestMergeZips(t *testing.T) {
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "merge_zips_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var readers []namedZipReader
+			for i, files := range testCase.inputZips {
+				path := filepath.Join(dir, fmt.Sprintf("in%d.zip", i))
+				reader, err := writeTestZip(path, files)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer reader.Close()
+				readers = append(readers, namedZipReader{path: path, reader: reader})
+			}
+
+			outputBuf := &bytes.Buffer{}
+			outputWriter := zip.NewWriter(outputBuf)
+			err = mergeZips(readers, outputWriter, "", testCase.sortEntries, false, false)
+			if testCase.err != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.err) {
+					t.Fatalf("Unexpected error:\n got: %v\nwant: %q", err, testCase.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			outputWriter.Close()
+			outputBytes := outputBuf.Bytes()
+			outputReader, err := zip.NewReader(bytes.NewReader(outputBytes), int64(len(outputBytes)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var outputFiles []string
+			for _, file := range outputReader.File {
+				outputFiles = append(outputFiles, file.Name)
+			}
+
+			if !reflect.DeepEqual(testCase.outputFiles, outputFiles) {
+				t.Fatalf("Output file list does not match:\n got: %v\nwant: %v", outputFiles, testCase.outputFiles)
+			}
+		})
+	}
+}
+
+func writeTestZip(path string, files []string) (*zip.ReadCloser, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := writer.Create(file)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		fmt.Fprintln(w, "test")
+	}
+	if err := writer.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	return zip.OpenReader(path)
+}
@@ -15,16 +15,32 @@
 package genrule
 
 import (
-	"android/soong/android"
+	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"text/template"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
 )
 
 func init() {
 	android.RegisterModuleType("filegroup", FileGroupFactory)
 }
 
+// The arguments are passed to soong_zip in an rspfile, as filegroups of test data can have more
+// files than fit on a command line.
+var zipFileGroup = pctx.AndroidStaticRule("zipFileGroup",
+	blueprint.RuleParams{
+		Command:        `$soongZipCmd -o $out @$out.rsp`,
+		CommandDeps:    []string{"$soongZipCmd"},
+		Rspfile:        "$out.rsp",
+		RspfileContent: "$args",
+	},
+	"args")
+
 type fileGroupProperties struct {
 	// srcs lists files that will be included in this filegroup
 	Srcs []string
@@ -40,19 +56,28 @@ type fileGroupProperties struct {
 	// Create a make variable with the specified name that contains the list of files in the
 	// filegroup, relative to the root of the source tree.
 	Export_to_make_var string
+
+	// Create a make variable with the specified name that contains the files in the filegroup
+	// as <dir>:<path> pairs, where <path> is the path of the file relative to the base path,
+	// which is where it is installed when the filegroup is used as data.  This is the format of
+	// LOCAL_TEST_DATA.
+	Export_relative_paths_to_make_var string
 }
 
 type fileGroup struct {
 	android.ModuleBase
 	properties fileGroupProperties
 	srcs       android.Paths
+	zip        android.Path
 }
 
 var _ android.SourceFileProducer = (*fileGroup)(nil)
+var _ android.OutputFileProducer = (*fileGroup)(nil)
 
 // filegroup modules contain a list of files, and can be used to export files across package
 // boundaries.  filegroups (and genrules) can be referenced from srcs properties of other modules
-// using the syntax ":module".
+// using the syntax ":module", and ":module{.zip}" references a zip of the files with their paths
+// relative to the base path.
 func FileGroupFactory() android.Module {
 	module := &fileGroup{}
 	module.AddProperties(&module.properties)
@@ -66,12 +91,61 @@ func (fg *fileGroup) DepsMutator(ctx android.BottomUpMutatorContext) {
 
 func (fg *fileGroup) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	fg.srcs = ctx.ExpandSourcesSubDir(fg.properties.Srcs, fg.properties.Exclude_srcs, fg.properties.Path)
+
+	// Whether another module uses the zip is not known yet, but ninja only builds it if one does.
+	zip := android.PathForModuleOut(ctx, ctx.ModuleName()+".zip")
+	var args []string
+	root := ""
+	for _, src := range fg.sortedSrcs() {
+		if r := relativeRoot(src); r != root {
+			root = r
+			args = append(args, "-C "+root)
+		}
+		args = append(args, "-f "+src.String())
+	}
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        zipFileGroup,
+		Description: "zip " + ctx.ModuleName(),
+		Output:      zip,
+		Implicits:   fg.srcs,
+		Args: map[string]string{
+			"args": strings.Join(args, " "),
+		},
+	})
+	fg.zip = zip
+}
+
+// sortedSrcs returns the files of the filegroup sorted by their path relative to the base path,
+// the order in which they are zipped.
+func (fg *fileGroup) sortedSrcs() android.Paths {
+	srcs := append(android.Paths(nil), fg.srcs...)
+	sort.SliceStable(srcs, func(i, j int) bool { return srcs[i].Rel() < srcs[j].Rel() })
+	return srcs
+}
+
+// relativeRoot returns the directory that the relative path of a file is relative to.  Files from
+// this module are relative to the base path, and files from other filegroups and genrules keep the
+// relative paths they have in those modules.
+func relativeRoot(p android.Path) string {
+	if rel := p.Rel(); rel != p.String() && strings.HasSuffix(p.String(), "/"+rel) {
+		return strings.TrimSuffix(p.String(), "/"+rel)
+	}
+	return "."
 }
 
 func (fg *fileGroup) Srcs() android.Paths {
 	return fg.srcs
 }
 
+func (fg *fileGroup) OutputFiles(tag string) (android.Paths, error) {
+	switch tag {
+	case ".zip":
+		return android.Paths{fg.zip}, nil
+	default:
+		return nil, fmt.Errorf("unsupported tag %q, filegroups support {.zip}", tag)
+	}
+}
+
 var androidMkTemplate = template.Must(template.New("filegroup").Parse(`
 ifdef {{.makeVar}}
   $(error variable {{.makeVar}} set by soong module is already set in make)
@@ -89,6 +163,17 @@ func (fg *fileGroup) AndroidMk() android.AndroidMkData {
 					"value":   strings.Join(fg.srcs.Strings(), " "),
 				})
 			}
+			if makeVar := fg.properties.Export_relative_paths_to_make_var; makeVar != "" {
+				var pairs []string
+				for _, src := range fg.sortedSrcs() {
+					pairs = append(pairs, relativeRoot(src)+":"+strings.TrimPrefix(
+						src.String(), relativeRoot(src)+"/"))
+				}
+				androidMkTemplate.Execute(w, map[string]string{
+					"makeVar": makeVar,
+					"value":   strings.Join(pairs, " "),
+				})
+			}
 		},
 	}
 }
@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genrule
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+)
+
+const fileGroupBp = `
+	filegroup {
+		name: "fg_path",
+		srcs: ["dir/in3", "dir/sub/in4"],
+		path: "dir",
+	}
+
+	genrule {
+		name: "gen_hdr",
+		tool_files: ["tool_file1"],
+		cmd: "$(location) > $(out)",
+		out: ["sub/gen.h"],
+	}
+
+	filegroup {
+		name: "fg_nested",
+		srcs: ["in1", ":fg_path", ":gen_hdr"],
+		export_relative_paths_to_make_var: "FG_NESTED_FILES",
+	}
+
+	genrule {
+		name: "gen",
+		tool_files: ["tool_file1"],
+		srcs: [":fg_nested{.zip}"],
+		cmd: "$(location) $(location :fg_nested{.zip}) > $(out)",
+		out: ["out"],
+	}
+`
+
+func TestFileGroupZip(t *testing.T) {
+	ctx := testGenrule(t, fileGroupBp)
+
+	fg := ctx.ModuleForTests("fg_nested", "")
+	zip := fg.Output("fg_nested.zip")
+
+	genDir := filepath.Join(buildDir, ".intermediates/gen_hdr/gen")
+	expectedArgs := "-C . -f in1 -C dir -f dir/in3 -C " + genDir + " -f " + genDir + "/sub/gen.h " +
+		"-C dir -f dir/sub/in4"
+	if zip.Args["args"] != expectedArgs {
+		t.Errorf("expected zip args %q, got %q", expectedArgs, zip.Args["args"])
+	}
+	// files with the same relative root share its -C argument.
+	pathZip := ctx.ModuleForTests("fg_path", "").Output("fg_path.zip")
+	if expected := "-C dir -f dir/in3 -f dir/sub/in4"; pathZip.Args["args"] != expected {
+		t.Errorf("expected zip args %q, got %q", expected, pathZip.Args["args"])
+	}
+
+	if len(zip.Implicits) != 4 {
+		t.Errorf("expected the zip to depend on the 4 files of the filegroup, got %q",
+			zip.Implicits)
+	}
+
+	gen := ctx.ModuleForTests("gen", "")
+	expectedCmd := "tool_file1 " + zip.Output.String() + " > __SBOX_OUT_FILES__"
+	if rawCommand := gen.Module().(*Module).rawCommand; rawCommand != expectedCmd {
+		t.Errorf("want %q, got %q", expectedCmd, rawCommand)
+	}
+	inputs := gen.Output("out").Inputs
+	if len(inputs) != 1 || inputs[0].String() != zip.Output.String() {
+		t.Errorf("gen inputs %q are not the zip of fg_nested %q", inputs, zip.Output)
+	}
+}
+
+func TestFileGroupZipTagError(t *testing.T) {
+	testGenruleError(t, `unsupported tag ".tar", filegroups support {.zip}`, `
+		genrule {
+			name: "gen",
+			tool_files: ["tool_file1"],
+			srcs: [":fg{.tar}"],
+			cmd: "$(location) $(in) > $(out)",
+			out: ["out"],
+		}
+	`)
+}
+
+func TestFileGroupAndroidMk(t *testing.T) {
+	ctx := testGenrule(t, fileGroupBp)
+
+	fg := ctx.ModuleForTests("fg_nested", "").Module().(*fileGroup)
+	buf := &bytes.Buffer{}
+	fg.AndroidMk().Custom(buf, "fg_nested", "", "", android.AndroidMkData{})
+
+	genDir := filepath.Join(buildDir, ".intermediates/gen_hdr/gen")
+	expected := "FG_NESTED_FILES := .:in1 dir:in3 " + genDir + ":sub/gen.h dir:sub/in4\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected Android.mk to contain %q, got:\n%s", expected, buf.String())
+	}
+}
@@ -17,10 +17,13 @@ package genrule
 import (
 	"fmt"
 	"path"
+	"sort"
 	"strings"
+	"unicode"
 
 	"github.com/google/blueprint"
 	"github.com/google/blueprint/bootstrap"
+	"github.com/google/blueprint/proptools"
 
 	"android/soong/android"
 	"android/soong/shared"
@@ -28,16 +31,27 @@ import (
 )
 
 func init() {
+	android.RegisterModuleType("genrule_defaults", defaultsFactory)
+
 	android.RegisterModuleType("gensrcs", GenSrcsFactory)
 	android.RegisterModuleType("genrule", GenRuleFactory)
 }
 
 var (
 	pctx = android.NewPackageContext("android/soong/genrule")
+
+	// Unpacks the tree zipped by an out_dir genrule.  -DD gives the files the current time, so
+	// that modules that include them are rebuilt when they change.
+	unzipDir = pctx.AndroidStaticRule("unzipDir",
+		blueprint.RuleParams{
+			Command: `rm -rf $outDir && mkdir -p $outDir && unzip -qDD $in -d $outDir && touch $out`,
+		},
+		"outDir")
 )
 
 func init() {
 	pctx.HostBinToolVariable("sboxCmd", "sbox")
+	pctx.HostBinToolVariable("soongZipCmd", "soong_zip")
 }
 
 type SourceFileGenerator interface {
@@ -49,12 +63,13 @@ type HostToolProvider interface {
 	HostToolPath() android.OptionalPath
 }
 
+// hostToolDependencyTag is the tag of the dependency on a tool, label is the entry in tools that
+// the dependency was added for.
 type hostToolDependencyTag struct {
 	blueprint.BaseDependencyTag
+	label string
 }
 
-var hostToolDepTag hostToolDependencyTag
-
 type generatorProperties struct {
 	// The command to run on one or more input files. Cmd supports substitution of a few variables
 	// (the actual substitution is implemented in GenerateAndroidBuildActions below)
@@ -62,11 +77,20 @@ type generatorProperties struct {
 	// Available variables for substitution:
 	//
 	//  $(location): the path to the first entry in tools or tool_files
-	//  $(location <label>): the path to the tool or tool_file with name <label>
+	//  $(location <label>): the path to the tool, tool_file or srcs entry with name <label>.  Tools
+	//      can be named with or without a leading ':', except tools with a host architecture,
+	//      which are named like srcs entries as they are written, for example $(location :module),
+	//      $(location tool:x86) or $(location file.txt).  The label must refer to a single file.
+	//  $(locations <label>): the paths to all the files of the tool, tool_file or srcs entry with
+	//      name <label>, for example all the outputs of a :module in srcs
 	//  $(in): one or more input files
-	//  $(out): a single output file
+	//  $(out): one or more output files
+	//  $(out <name>): the output file with name <name>, as it is listed in out
+	//  $(dir <variable>): the directory of the file that $(location), $(location <label>) or
+	//      $(out <name>) expands to, for example $(dir location :module)
 	//  $(depfile): a file to which dependencies will be written, if the depfile property is set to true
 	//  $(genDir): the sandbox directory for this tool; contains $(out)
+	//  $(out_dir): the directory that the command writes its outputs to if out_dir is set
 	//  $$: a literal $
 	//
 	// All files used must be declared as inputs (to ensure proper up-to-date checks).
@@ -76,8 +100,20 @@ type generatorProperties struct {
 	// Enable reading a file containing dependencies in gcc format after the command completes
 	Depfile bool
 
+	// If true, the command writes an arbitrary tree of files into $(out_dir) instead of writing
+	// the files listed in out, and the tree is packaged with soong_zip into the single output
+	// file, for example a .srcjar that can be used in the srcs of a java_library.  cc modules can
+	// list the module in generated_headers to add the unpacked tree to their include path.  Listing
+	// it in the generated_sources of a cc module is not supported and is an error: cc modules
+	// compile each of their sources with its own build statement, so they must know the files
+	// before the build, and the files in the tree are only known once the command has run.
+	Out_dir bool
+
 	// name of the modules (if any) that produces the host executable.   Leave empty for
-	// prebuilts or scripts that do not need a module to build them.
+	// prebuilts or scripts that do not need a module to build them.  A tool is built for the
+	// primary host architecture, unless its name is followed by ':' and a host architecture, for
+	// example "tool:x86" for a tool that is only built for 32-bit hosts.  The entry is used as
+	// the label of the tool in $(location <label>), and cmd must reference every tool.
 	Tools []string
 
 	// Local file that is used as the tool
@@ -88,10 +124,17 @@ type generatorProperties struct {
 
 	// list of input files
 	Srcs []string
+
+	// paths in the source tree that cmd uses without declaring them in srcs, tools or
+	// tool_files.  Each entry is a path or a directory containing the paths.  This is an escape
+	// hatch for commands that cannot be fixed yet, the build does not rerun the command when the
+	// files change.
+	Allowed_undeclared_paths []string
 }
 
 type Module struct {
 	android.ModuleBase
+	android.DefaultableModuleBase
 
 	// For other packages to make their own genrules with extra
 	// properties
@@ -104,9 +147,18 @@ type Module struct {
 	deps android.Paths
 	rule blueprint.Rule
 
+	// the rule for the actions of gensrcs shards that run the command for each of their files
+	shardRule blueprint.Rule
+
 	exportedIncludeDirs android.Paths
 
 	outputFiles android.Paths
+
+	// the command after the substitution of its variables, for tests
+	rawCommand string
+
+	// stamps of the unpacked trees of an out_dir genrule
+	unzippedStamps android.Paths
 }
 
 type taskFunc func(ctx android.ModuleContext, srcFiles android.Paths) []generateTask
@@ -114,12 +166,31 @@ type taskFunc func(ctx android.ModuleContext, srcFiles android.Paths) []generate
 type generateTask struct {
 	in  android.Paths
 	out android.WritablePaths
+
+	// if true, the command is run once for each input file, with $(in) and $(out) set to the
+	// input and the output at the same index, instead of once for all of them
+	perFile bool
+
+	// the command to run for a perFile task with more than one input, expanded for each file
+	cmd string
 }
 
+// GeneratedSourceFiles returns the files generated by the module.  The files in the tree of an
+// out_dir genrule are not known before the build, so it returns the stamps of the unpacked trees
+// instead, which modules depend on to use the trees through GeneratedHeaderDirs.
 func (g *Module) GeneratedSourceFiles() android.Paths {
+	if g.properties.Out_dir {
+		return g.unzippedStamps
+	}
 	return g.outputFiles
 }
 
+// OutDir returns true if the module generates a tree of files with out_dir, whose files cannot be
+// compiled by other modules as they are not known before the build.
+func (g *Module) OutDir() bool {
+	return g.properties.Out_dir
+}
+
 func (g *Module) Srcs() android.Paths {
 	return g.outputFiles
 }
@@ -131,12 +202,32 @@ func (g *Module) GeneratedHeaderDirs() android.Paths {
 func (g *Module) DepsMutator(ctx android.BottomUpMutatorContext) {
 	android.ExtractSourcesDeps(ctx, g.properties.Srcs)
 	if g, ok := ctx.Module().(*Module); ok {
-		if len(g.properties.Tools) > 0 {
+		for _, tool := range g.properties.Tools {
+			name, variant := tool, ctx.AConfig().BuildOsVariant
+			if i := strings.Index(tool, ":"); i != -1 {
+				name, variant = tool[:i], hostToolVariant(ctx, tool[i+1:])
+				if variant == "" {
+					ctx.PropertyErrorf("tools", "%q: no %s host architecture for %q",
+						tool, tool[i+1:], name)
+					continue
+				}
+			}
 			ctx.AddFarVariationDependencies([]blueprint.Variation{
-				{"arch", ctx.AConfig().BuildOsVariant},
-			}, hostToolDepTag, g.properties.Tools...)
+				{"arch", variant},
+			}, hostToolDependencyTag{label: tool}, name)
+		}
+	}
+}
+
+// hostToolVariant returns the arch variant of the host target of the build OS with the given
+// architecture, or "" if there is none.
+func hostToolVariant(ctx android.BaseContext, arch string) string {
+	for _, target := range ctx.AConfig().Targets[android.Host] {
+		if target.Os == android.BuildOs && target.Arch.ArchType.String() == arch {
+			return target.String()
 		}
 	}
+	return ""
 }
 
 func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
@@ -145,7 +236,9 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 		return
 	}
 
-	if len(g.properties.Export_include_dirs) > 0 {
+	if g.properties.Out_dir {
+		// The include directories are the unpacked trees, added in generateSourceFile.
+	} else if len(g.properties.Export_include_dirs) > 0 {
 		for _, dir := range g.properties.Export_include_dirs {
 			g.exportedIncludeDirs = append(g.exportedIncludeDirs,
 				android.PathForModuleGen(ctx, ctx.ModuleDir(), dir))
@@ -158,11 +251,9 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 
 	if len(g.properties.Tools) > 0 {
 		ctx.VisitDirectDeps(func(module blueprint.Module) {
-			switch ctx.OtherModuleDependencyTag(module) {
-			case android.SourceDepTag:
-				// Nothing to do
-			case hostToolDepTag:
-				tool := ctx.OtherModuleName(module)
+			switch t := ctx.OtherModuleDependencyTag(module).(type) {
+			case hostToolDependencyTag:
+				tool := t.label
 				var path android.OptionalPath
 
 				if t, ok := module.(HostToolProvider); ok {
@@ -190,7 +281,9 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 					ctx.ModuleErrorf("host tool %q missing output file", tool)
 				}
 			default:
-				ctx.ModuleErrorf("unknown dependency on %q", ctx.OtherModuleName(module))
+				if t != android.SourceDepTag && t != android.DefaultsDepTag {
+					ctx.ModuleErrorf("unknown dependency on %q", ctx.OtherModuleName(module))
+				}
 			}
 		})
 	}
@@ -209,14 +302,56 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 		}
 	}
 
-	rawCommand, err := android.Expand(g.properties.Cmd, func(name string) (string, error) {
+	// Tools can be referenced by their name with or without a leading ':', tool files and srcs by
+	// the entry in their property.
+	labels := make(map[string]*locationLabel)
+	addLabel := func(label, property string, paths android.Paths) {
+		if l, exists := labels[label]; exists {
+			if strings.Join(l.paths.Strings(), " ") != strings.Join(paths.Strings(), " ") {
+				l.properties = append(l.properties, property)
+			}
+		} else {
+			labels[label] = &locationLabel{paths: paths, properties: []string{property}}
+		}
+	}
+	for _, tool := range g.properties.Tools {
+		if path, ok := tools[tool]; ok {
+			addLabel(tool, "tools", android.Paths{path})
+			if !strings.Contains(tool, ":") {
+				addLabel(":"+tool, "tools", android.Paths{path})
+			}
+		}
+	}
+	for _, tool := range g.properties.Tool_files {
+		addLabel(tool, "tool_files", android.Paths{tools[tool]})
+	}
+
+	var srcFiles android.Paths
+	for _, src := range g.properties.Srcs {
+		paths := ctx.ExpandSources([]string{src}, nil)
+		srcFiles = append(srcFiles, paths...)
+		addLabel(src, "srcs", paths)
+	}
+
+	tasks := g.tasks(ctx, srcFiles)
+
+	var defaultLabel string
+	if len(g.properties.Tools) > 0 {
+		defaultLabel = g.properties.Tools[0]
+	} else {
+		defaultLabel = g.properties.Tool_files[0]
+	}
+
+	// The tools that cmd references, the entries in tools must all be used as they are host
+	// binaries that can only be run through their location.
+	usedTools := make(map[string]bool)
+
+	var expand func(name string) (string, error)
+	expand = func(name string) (string, error) {
 		switch name {
 		case "location":
-			if len(g.properties.Tools) > 0 {
-				return tools[g.properties.Tools[0]].String(), nil
-			} else {
-				return tools[g.properties.Tool_files[0]].String(), nil
-			}
+			usedTools[defaultLabel] = true
+			return tools[defaultLabel].String(), nil
 		case "in":
 			return "${in}", nil
 		case "out":
@@ -226,33 +361,95 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 				return "", fmt.Errorf("$(depfile) used without depfile property")
 			}
 			return "${depfile}", nil
-		case "genDir":
-			genPath := android.PathForModuleGen(ctx, "").String()
-			var relativePath string
-			var err error
-			outputPath := android.PathForOutput(ctx).String()
-			relativePath, err = filepath.Rel(outputPath, genPath)
-			if err != nil {
-				panic(err)
+		case "out_dir":
+			if !g.properties.Out_dir {
+				return "", fmt.Errorf("$(out_dir) used without out_dir property")
 			}
-			return path.Join("__SBOX_OUT_DIR__", relativePath), nil
+			return "${outDir}", nil
+		case "genDir":
+			return sandboxOutPath(ctx, android.PathForModuleGen(ctx, "")), nil
 		default:
 			if strings.HasPrefix(name, "location ") {
 				label := strings.TrimSpace(strings.TrimPrefix(name, "location "))
-				if tool, ok := tools[label]; ok {
-					return tool.String(), nil
-				} else {
-					return "", fmt.Errorf("unknown location label %q", label)
+				paths, err := expandLabel(labels, label)
+				if err != nil {
+					return "", err
+				}
+				usedTools[strings.TrimPrefix(label, ":")] = true
+				if len(paths) > 1 {
+					return "", fmt.Errorf("label %q has %d files, use $(locations %s) to reference "+
+						"all of them", label, len(paths), label)
+				}
+				return paths[0].String(), nil
+			} else if strings.HasPrefix(name, "locations ") {
+				label := strings.TrimSpace(strings.TrimPrefix(name, "locations "))
+				paths, err := expandLabel(labels, label)
+				if err != nil {
+					return "", err
 				}
+				usedTools[strings.TrimPrefix(label, ":")] = true
+				return strings.Join(paths.Strings(), " "), nil
+			} else if strings.HasPrefix(name, "out ") {
+				out := strings.TrimSpace(strings.TrimPrefix(name, "out "))
+				if len(tasks) != 1 {
+					return "", fmt.Errorf("$(out %s) cannot be used when the command runs once "+
+						"for each source file", out)
+				}
+				for _, outputFile := range tasks[0].out {
+					if outputFile.Rel() == out {
+						return sandboxOutPath(ctx, outputFile), nil
+					}
+				}
+				var outs []string
+				for _, outputFile := range tasks[0].out {
+					outs = append(outs, outputFile.Rel())
+				}
+				return "", fmt.Errorf("unknown output %q in $(out %s), expected one of %q",
+					out, out, outs)
+			} else if strings.HasPrefix(name, "dir ") {
+				v := strings.TrimSpace(strings.TrimPrefix(name, "dir "))
+				if v != "location" && !strings.HasPrefix(v, "location ") &&
+					!strings.HasPrefix(v, "out ") {
+					return "", fmt.Errorf("$(dir %s) is not supported, $(dir) can only be used "+
+						"with $(location), $(location <label>) and $(out <name>)", v)
+				}
+				file, err := expand(v)
+				if err != nil {
+					return "", err
+				}
+				return path.Dir(file), nil
 			}
 			return "", fmt.Errorf("unknown variable '$(%s)'", name)
 		}
-	})
+	}
 
+	rawCommand, err := android.Expand(g.properties.Cmd, expand)
 	if err != nil {
 		ctx.PropertyErrorf("cmd", "%s", err.Error())
 		return
 	}
+	g.rawCommand = rawCommand
+
+	for _, tool := range g.properties.Tools {
+		if !usedTools[tool] {
+			ctx.PropertyErrorf("tools", "%q is not used in cmd, reference it with $(location %s)",
+				tool, tool)
+		}
+	}
+
+	declared := append(android.Paths(nil), srcFiles...)
+	for _, tool := range tools {
+		declared = append(declared, tool)
+	}
+	g.checkUndeclaredPaths(ctx, declared)
+
+	if g.properties.Out_dir {
+		// Zip the tree the command wrote inside the sandbox, so that sbox moves the zip out of it
+		// like any other output.  soong_zip walks the tree in order and uses a fixed timestamp, so
+		// the zip only changes when the tree does.
+		rawCommand = "rm -rf ${outDir} && mkdir -p ${outDir} && " + rawCommand + " && " +
+			"$soongZipCmd -o __SBOX_OUT_FILES__ -C ${outDir} -D ${outDir}"
+	}
 
 	// tell the sbox command which directory to use as its sandbox root
 	buildDir := android.PathForOutput(ctx).String()
@@ -267,18 +464,163 @@ func (g *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 		CommandDeps: []string{"$sboxCmd"},
 	}
 	args := []string{"allouts"}
+	if g.properties.Out_dir {
+		ruleParams.CommandDeps = append(ruleParams.CommandDeps, "$soongZipCmd")
+		args = append(args, "outDir")
+	}
 	if g.properties.Depfile {
 		ruleParams.Deps = blueprint.DepsGCC
 		args = append(args, "depfile")
 	}
 	g.rule = ctx.Rule(pctx, "generator", ruleParams, args...)
 
-	srcFiles := ctx.ExpandSources(g.properties.Srcs, nil)
-	for _, task := range g.tasks(ctx, srcFiles) {
+	for _, task := range tasks {
+		if task.perFile && len(task.in) > 1 {
+			if g.properties.Depfile {
+				ctx.PropertyErrorf("depfile", "cannot be used when a shard runs the command for "+
+					"each of its files, set batch to write a single depfile for each shard")
+				return
+			}
+
+			// Run the command for each file of the task in a single action.
+			var cmds []string
+			for i := range task.in {
+				in, out := task.in[i], task.out[i]
+				cmd, err := android.Expand(g.properties.Cmd, func(name string) (string, error) {
+					switch name {
+					case "in":
+						return in.String(), nil
+					case "out":
+						return sandboxOutPath(ctx, out), nil
+					default:
+						return expand(name)
+					}
+				})
+				if err != nil {
+					ctx.PropertyErrorf("cmd", "%s", err.Error())
+					return
+				}
+				cmds = append(cmds, cmd)
+			}
+			task.cmd = proptools.ShellEscape([]string{strings.Join(cmds, " && ")})[0]
+
+			if g.shardRule == nil {
+				g.shardRule = ctx.Rule(pctx, "generatorShard", blueprint.RuleParams{
+					Command: fmt.Sprintf("$sboxCmd --sandbox-path %s --output-root %s -c $cmd $allouts",
+						sandboxPath, buildDir),
+					CommandDeps: []string{"$sboxCmd"},
+				}, "allouts", "cmd")
+			}
+		}
 		g.generateSourceFile(ctx, task)
 	}
 }
 
+// checkUndeclaredPaths reports the paths in the source tree that the literal text of cmd refers to,
+// as those files are not dependencies of the command and changing them does not rerun it.
+// Variables are left out before the command is split into words, so files referenced with
+// $(location) or $(in) are never reported.  Words that look like paths in the source tree but are
+// not, like parts of sed expressions, are only reported if a file exists at that path, and
+// allowed_undeclared_paths lists the ones that must not be reported.
+func (g *Module) checkUndeclaredPaths(ctx android.ModuleContext, declared android.Paths) {
+	text, err := android.Expand(g.properties.Cmd, func(string) (string, error) {
+		return " ", nil
+	})
+	if err != nil {
+		return
+	}
+
+	declaredPaths := make(map[string]bool)
+	for _, p := range declared {
+		declaredPaths[p.String()] = true
+	}
+
+	buildDir, err := filepath.Abs(android.PathForOutput(ctx).String())
+	if err != nil {
+		return
+	}
+
+	isAllowed := func(word string) bool {
+		for _, allowed := range g.properties.Allowed_undeclared_paths {
+			allowed = filepath.Clean(allowed)
+			if word == allowed || strings.HasPrefix(word, allowed+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	reported := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(text, isCmdSeparator) {
+		// Only relative paths with a directory can be paths in the source tree, and words with
+		// shell expansions, globs or parent directories cannot be checked.
+		if !strings.Contains(word, "/") || strings.HasPrefix(word, "/") ||
+			strings.HasPrefix(word, "-") || strings.ContainsAny(word, "$~*?[]{}\\") ||
+			strings.Contains(word, "..") {
+			continue
+		}
+		word = filepath.Clean(word)
+		if declaredPaths[word] || reported[word] || isAllowed(word) {
+			continue
+		}
+		if abs, err := filepath.Abs(word); err != nil || strings.HasPrefix(abs+"/", buildDir+"/") {
+			continue
+		}
+
+		if android.ExistentPathForSource(ctx, "genrule", word).Valid() {
+			reported[word] = true
+			ctx.PropertyErrorf("cmd", "%q is not declared in srcs, tools or tool_files, "+
+				"reference it with $(location) or add it to allowed_undeclared_paths", word)
+		}
+	}
+}
+
+// isCmdSeparator returns true for the characters that separate the words of a shell command that
+// could be paths, including the = of --flag=path.
+func isCmdSeparator(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(";|&<>()'\"`=,:", r)
+}
+
+// locationLabel is a label that can be used in $(location <label>) and $(locations <label>),
+// along with the files it refers to and the properties it is listed in.  A label that is listed in
+// more than one property with different files is ambiguous.
+type locationLabel struct {
+	paths      android.Paths
+	properties []string
+}
+
+// expandLabel returns the files that a label in $(location <label>) or $(locations <label>)
+// refers to.
+func expandLabel(labels map[string]*locationLabel, label string) (android.Paths, error) {
+	l, ok := labels[label]
+	if !ok {
+		var known []string
+		for k := range labels {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown location label %q, it must be listed in tools, tool_files "+
+			"or srcs, known labels are %q", label, known)
+	}
+	if len(l.properties) > 1 {
+		return nil, fmt.Errorf("label %q is ambiguous, it refers to different files in %s",
+			label, strings.Join(l.properties, " and "))
+	}
+	if len(l.paths) == 0 {
+		return nil, fmt.Errorf("label %q has no files", label)
+	}
+	return l.paths, nil
+}
+
+// sandboxOutPath returns the path that an output file is written to inside the sbox sandbox.
+func sandboxOutPath(ctx android.ModuleContext, p android.WritablePath) string {
+	relativePath, err := filepath.Rel(android.PathForOutput(ctx).String(), p.String())
+	if err != nil {
+		panic(err)
+	}
+	return path.Join("__SBOX_OUT_DIR__", relativePath)
+}
+
 func (g *Module) generateSourceFile(ctx android.ModuleContext, task generateTask) {
 	desc := "generate"
 	if len(task.out) == 0 {
@@ -288,6 +630,11 @@ func (g *Module) generateSourceFile(ctx android.ModuleContext, task generateTask
 	if len(task.out) == 1 {
 		desc += " " + task.out[0].Base()
 	}
+	if g.properties.Out_dir && len(task.out) != 1 {
+		ctx.ModuleErrorf("out_dir requires exactly one output file for the packaged tree, found %d",
+			len(task.out))
+		return
+	}
 
 	params := android.ModuleBuildParams{
 		Rule:            g.rule,
@@ -300,15 +647,48 @@ func (g *Module) generateSourceFile(ctx android.ModuleContext, task generateTask
 			"allouts": strings.Join(task.out.Strings(), " "),
 		},
 	}
+	if task.cmd != "" {
+		params.Rule = g.shardRule
+		params.Args["cmd"] = task.cmd
+	}
 	if g.properties.Depfile {
 		depfile := android.GenPathWithExt(ctx, "", task.out[0], task.out[0].Ext()+".d")
 		params.Depfile = depfile
 	}
+	if g.properties.Out_dir {
+		params.Args["outDir"] = sandboxOutPath(ctx,
+			android.PathForModuleGen(ctx, "out_dir", task.out[0].Rel()))
+	}
 	ctx.ModuleBuild(pctx, params)
 
 	for _, outputFile := range task.out {
 		g.outputFiles = append(g.outputFiles, outputFile)
 	}
+
+	if g.properties.Out_dir {
+		g.unzipOutDir(ctx, task.out[0])
+	}
+}
+
+// unzipOutDir unpacks the zip of the tree written by an out_dir command, so that cc modules can
+// use the tree as an include directory.  The files are only unpacked when a module depends on the
+// stamp returned by GeneratedSourceFiles.
+func (g *Module) unzipOutDir(ctx android.ModuleContext, zip android.WritablePath) {
+	dir := android.PathForModuleGen(ctx, "unzipped", zip.Rel())
+	stamp := android.PathForModuleGen(ctx, "unzipped", zip.Rel()+".stamp")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        unzipDir,
+		Description: "unzip " + zip.Base(),
+		Output:      stamp,
+		Input:       zip,
+		Args: map[string]string{
+			"outDir": dir.String(),
+		},
+	})
+
+	g.exportedIncludeDirs = append(g.exportedIncludeDirs, dir)
+	g.unzippedStamps = append(g.unzippedStamps, stamp)
 }
 
 func generatorFactory(tasks taskFunc, props ...interface{}) *Module {
@@ -326,12 +706,33 @@ func NewGenSrcs() *Module {
 	properties := &genSrcsProperties{}
 
 	tasks := func(ctx android.ModuleContext, srcFiles android.Paths) []generateTask {
-		tasks := make([]generateTask, 0, len(srcFiles))
-		for _, in := range srcFiles {
-			tasks = append(tasks, generateTask{
-				in:  android.Paths{in},
-				out: android.WritablePaths{android.GenPathWithExt(ctx, "", in, properties.Output_extension)},
-			})
+		batch := proptools.Bool(properties.Batch)
+
+		shardSize := 1
+		if properties.Shard_size != nil {
+			shardSize = *properties.Shard_size
+			if shardSize < 1 {
+				ctx.PropertyErrorf("shard_size", "must be at least 1, found %d", shardSize)
+				return nil
+			}
+		} else if batch {
+			shardSize = len(srcFiles)
+		}
+
+		var tasks []generateTask
+		for start := 0; start < len(srcFiles); start += shardSize {
+			end := start + shardSize
+			if end > len(srcFiles) {
+				end = len(srcFiles)
+			}
+
+			task := generateTask{perFile: !batch}
+			for _, in := range srcFiles[start:end] {
+				task.in = append(task.in, in)
+				task.out = append(task.out,
+					android.GenPathWithExt(ctx, "", in, properties.Output_extension))
+			}
+			tasks = append(tasks, task)
 		}
 		return tasks
 	}
@@ -342,12 +743,23 @@ func NewGenSrcs() *Module {
 func GenSrcsFactory() android.Module {
 	m := NewGenSrcs()
 	android.InitAndroidModule(m)
+	android.InitDefaultableModule(m)
 	return m
 }
 
 type genSrcsProperties struct {
 	// extension that will be substituted for each output file
 	Output_extension string
+
+	// maximum number of source files to process in each action.  The sources are split into
+	// shards of this size, so that changing a source only regenerates its own shard.  Each action
+	// runs the command once for each of its files, unless batch is set.  Defaults to 1.
+	Shard_size *int
+
+	// if true, run the command once for each shard, with $(in) set to all the files of the shard
+	// and $(out) to all their outputs, for tools that are faster when they process many files in a
+	// single invocation.  If shard_size is not set, all the sources are processed by one action.
+	Batch *bool
 }
 
 func NewGenRule() *Module {
@@ -372,6 +784,7 @@ func NewGenRule() *Module {
 func GenRuleFactory() android.Module {
 	m := NewGenRule()
 	android.InitAndroidModule(m)
+	android.InitDefaultableModule(m)
 	return m
 }
 
@@ -379,3 +792,48 @@ type genRuleProperties struct {
 	// names of the output files that will be generated
 	Out []string
 }
+
+// Defaults is a genrule_defaults module, which holds properties that genrule, gensrcs and
+// cc_genrule modules can use through their defaults property.
+type Defaults struct {
+	android.ModuleBase
+	android.DefaultsModuleBase
+}
+
+func (*Defaults) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+}
+
+func (d *Defaults) DepsMutator(ctx android.BottomUpMutatorContext) {
+}
+
+// extraDefaultsProperties create the Extra property structs of the genrules of other packages,
+// which genrule_defaults modules also hold.
+var extraDefaultsProperties []func() interface{}
+
+// RegisterDefaultsProperties adds the property struct returned by props to genrule_defaults
+// modules, for the packages that make their own genrules with Extra properties.
+func RegisterDefaultsProperties(props func() interface{}) {
+	extraDefaultsProperties = append(extraDefaultsProperties, props)
+}
+
+func defaultsFactory() android.Module {
+	return DefaultsFactory()
+}
+
+func DefaultsFactory(props ...interface{}) android.Module {
+	module := &Defaults{}
+
+	module.AddProperties(props...)
+	module.AddProperties(
+		&generatorProperties{},
+		&genRuleProperties{},
+		&genSrcsProperties{},
+	)
+	for _, extra := range extraDefaultsProperties {
+		module.AddProperties(extra())
+	}
+
+	android.InitDefaultsModule(module)
+
+	return module
+}
@@ -0,0 +1,714 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package genrule
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+)
+
+var buildDir string
+
+func setUp() {
+	var err error
+	buildDir, err = ioutil.TempDir("", "soong_genrule_test")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func tearDown() {
+	os.RemoveAll(buildDir)
+}
+
+func TestMain(m *testing.M) {
+	run := func() int {
+		setUp()
+		defer tearDown()
+
+		return m.Run()
+	}
+
+	os.Exit(run())
+}
+
+func testContext(config android.Config, bp string) (*android.TestContext, []error) {
+	ctx := android.NewTestArchContext()
+	ctx.RegisterModuleType("filegroup", android.ModuleFactoryAdaptor(FileGroupFactory))
+	ctx.RegisterModuleType("genrule", android.ModuleFactoryAdaptor(GenRuleFactory))
+	ctx.RegisterModuleType("gensrcs", android.ModuleFactoryAdaptor(GenSrcsFactory))
+	ctx.RegisterModuleType("genrule_defaults", android.ModuleFactoryAdaptor(defaultsFactory))
+	ctx.RegisterModuleType("tool", android.ModuleFactoryAdaptor(toolFactory))
+	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
+	ctx.Register()
+
+	bp += `
+		tool {
+			name: "tool",
+		}
+
+		filegroup {
+			name: "fg",
+			srcs: ["in1", "in2"],
+		}
+
+		filegroup {
+			name: "fg1",
+			srcs: ["dir/in3"],
+		}
+	`
+
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp":          []byte(bp),
+		"tool":                nil,
+		"tool_file1":          nil,
+		"tool_file2":          nil,
+		"in1":                 nil,
+		"in2":                 nil,
+		"dir/in3":             nil,
+		"dir/sub/in4":         nil,
+		"dir/undeclared":      nil,
+		"other/file":          nil,
+		"external/foo/bar.py": nil,
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp")
+	if len(errs) > 0 {
+		return ctx, errs
+	}
+	_, errs = ctx.PrepareBuildActions(config)
+	return ctx, errs
+}
+
+func testGenrule(t *testing.T, bp string) *android.TestContext {
+	ctx, errs := testContext(android.TestArchConfig(buildDir, nil), bp)
+	fail(t, errs)
+	return ctx
+}
+
+// testGenruleError runs the test context and checks that one of the errors contains expected.
+func testGenruleError(t *testing.T, expected string, bp string) {
+	_, errs := testContext(android.TestArchConfig(buildDir, nil), bp)
+	if len(errs) == 0 {
+		t.Fatalf("missing expected error %q (0 errors are returned)", expected)
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), expected) {
+			return
+		}
+	}
+	t.Errorf("missing expected error %q, errors are %q", expected, errs)
+}
+
+func fail(t *testing.T, errs []error) {
+	if len(errs) > 0 {
+		for _, err := range errs {
+			t.Error(err)
+		}
+		t.FailNow()
+	}
+}
+
+func TestGenruleCmd(t *testing.T) {
+	testcases := []struct {
+		name   string
+		prop   string
+		expect string
+		err    string
+	}{
+		{
+			name: "location",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location) > $(out)",
+			`,
+			expect: "out/x86_64/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "location tool",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location tool) > $(out)",
+			`,
+			expect: "out/x86_64/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "location :tool",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location :tool) > $(out)",
+			`,
+			expect: "out/x86_64/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "location tool_file",
+			prop: `
+				tool_files: ["tool_file1", "tool_file2"],
+				out: ["out"],
+				cmd: "$(location tool_file2) > $(out)",
+			`,
+			expect: "tool_file2 > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "location src",
+			prop: `
+				tools: ["tool"],
+				srcs: ["in1"],
+				out: ["out"],
+				cmd: "$(location) $(location in1) > $(out)",
+			`,
+			expect: "out/x86_64/tool in1 > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "location src module",
+			prop: `
+				tools: ["tool"],
+				srcs: [":fg1"],
+				out: ["out"],
+				cmd: "$(location) $(location :fg1) > $(out)",
+			`,
+			expect: "out/x86_64/tool dir/in3 > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "locations",
+			prop: `
+				tools: ["tool"],
+				srcs: [":fg"],
+				out: ["out"],
+				cmd: "$(location) $(locations :fg) > $(out)",
+			`,
+			expect: "out/x86_64/tool in1 in2 > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "in",
+			prop: `
+				tools: ["tool"],
+				srcs: [":fg"],
+				out: ["out"],
+				cmd: "$(location) $(in) > $(out)",
+			`,
+			expect: "out/x86_64/tool ${in} > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "out name",
+			prop: `
+				tools: ["tool"],
+				out: ["out1", "out2"],
+				cmd: "$(location) -o $(out out2)",
+			`,
+			expect: "out/x86_64/tool -o __SBOX_OUT_DIR__/.intermediates/gen/gen/out2",
+		},
+		{
+			name: "dir location",
+			prop: `
+				tools: ["tool"],
+				srcs: [":fg1"],
+				out: ["out"],
+				cmd: "$(location) -I $(dir location :fg1) > $(out)",
+			`,
+			expect: "out/x86_64/tool -I dir > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "dir out",
+			prop: `
+				tools: ["tool"],
+				out: ["out1", "out2"],
+				cmd: "$(location) -d $(dir out out2)",
+			`,
+			expect: "out/x86_64/tool -d __SBOX_OUT_DIR__/.intermediates/gen/gen",
+		},
+		{
+			name: "location multiple files",
+			prop: `
+				tools: ["tool"],
+				srcs: [":fg"],
+				out: ["out"],
+				cmd: "$(location) $(location :fg) > $(out)",
+			`,
+			err: `label ":fg" has 2 files, use $(locations :fg) to reference all of them`,
+		},
+		{
+			name: "unknown out name",
+			prop: `
+				tools: ["tool"],
+				out: ["out1"],
+				cmd: "$(location) -o $(out out2)",
+			`,
+			err: `unknown output "out2" in $(out out2), expected one of ["out1"]`,
+		},
+		{
+			name: "dir unsupported",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location) -d $(dir in) > $(out)",
+			`,
+			err: "$(dir in) is not supported",
+		},
+		{
+			name: "unknown label",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location) $(location :fg1) > $(out)",
+			`,
+			err: `unknown location label ":fg1", it must be listed in tools, tool_files or srcs, ` +
+				`known labels are [":tool" "tool"]`,
+		},
+		{
+			name: "ambiguous label",
+			prop: `
+				tools: ["tool"],
+				srcs: ["tool"],
+				out: ["out"],
+				cmd: "$(location tool) > $(out)",
+			`,
+			err: `label "tool" is ambiguous, it refers to different files in tools and srcs`,
+		},
+		{
+			name: "unused tool",
+			prop: `
+				tools: ["tool"],
+				tool_files: ["tool_file1"],
+				out: ["out"],
+				cmd: "$(location tool_file1) > $(out)",
+			`,
+			err: `"tool" is not used in cmd, reference it with $(location tool)`,
+		},
+		{
+			name: "unknown variable",
+			prop: `
+				tools: ["tool"],
+				out: ["out"],
+				cmd: "$(location) $(foo) > $(out)",
+			`,
+			err: "unknown variable '$(foo)'",
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			bp := "genrule {\n"
+			bp += "name: \"gen\",\n"
+			bp += test.prop
+			bp += "}\n"
+
+			if test.err != "" {
+				testGenruleError(t, test.err, bp)
+				return
+			}
+
+			ctx := testGenrule(t, bp)
+			gen := ctx.ModuleForTests("gen", "").Module().(*Module)
+			if gen.rawCommand != test.expect {
+				t.Errorf("want %q, got %q", test.expect, gen.rawCommand)
+			}
+		})
+	}
+}
+
+func TestGenSrcsOutName(t *testing.T) {
+	testGenruleError(t, "$(out in1.h) cannot be used when the command runs once for each "+
+		"source file", `
+		gensrcs {
+			name: "gen",
+			tools: ["tool"],
+			srcs: ["in1", "in2"],
+			output_extension: "h",
+			cmd: "$(location) $(in) > $(out in1.h)",
+		}
+	`)
+}
+
+func TestGenSrcsShards(t *testing.T) {
+	ctx := testGenrule(t, `
+		gensrcs {
+			name: "gen",
+			tools: ["tool"],
+			srcs: ["in1", "in2", "dir/in3"],
+			output_extension: "h",
+			shard_size: 2,
+			cmd: "$(location) $(in) > $(out)",
+		}
+	`)
+
+	gen := ctx.ModuleForTests("gen", "")
+	module := gen.Module().(*Module)
+
+	shard1 := gen.Output("in1.h")
+	if shard1.Rule != module.shardRule {
+		t.Errorf("the first shard does not run the command for each of its files")
+	}
+	if g, w := shard1.Inputs.Strings(), []string{"in1", "in2"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("the inputs of the first shard are %q, expected %q", g, w)
+	}
+	if g, w := shard1.ImplicitOutputs.Strings(), []string{filepath.Join(buildDir,
+		".intermediates/gen/gen/in2.h")}; !reflect.DeepEqual(g, w) {
+		t.Errorf("the implicit outputs of the first shard are %q, expected %q", g, w)
+	}
+	expectedCmd := "'out/x86_64/tool in1 > __SBOX_OUT_DIR__/.intermediates/gen/gen/in1.h && " +
+		"out/x86_64/tool in2 > __SBOX_OUT_DIR__/.intermediates/gen/gen/in2.h'"
+	if shard1.Args["cmd"] != expectedCmd {
+		t.Errorf("the command of the first shard is %q, expected %q", shard1.Args["cmd"],
+			expectedCmd)
+	}
+
+	// A shard with a single file runs the command with $(in) and $(out) directly.
+	shard2 := gen.Output("dir/in3.h")
+	if shard2.Rule == module.shardRule || shard2.Args["cmd"] != "" {
+		t.Errorf("the second shard runs the command for each of its files")
+	}
+	if g, w := shard2.Inputs.Strings(), []string{"dir/in3"}; !reflect.DeepEqual(g, w) {
+		t.Errorf("the inputs of the second shard are %q, expected %q", g, w)
+	}
+}
+
+func TestGenSrcsShellEscape(t *testing.T) {
+	ctx := testGenrule(t, `
+		gensrcs {
+			name: "gen",
+			tool_files: ["tool_file1"],
+			srcs: ["in1", "in2"],
+			output_extension: "h",
+			shard_size: 2,
+			cmd: "echo '$$HOME' $(in) > $(out)",
+		}
+	`)
+
+	shard := ctx.ModuleForTests("gen", "").Output("in1.h")
+	// $$ stays escaped for ninja, which passes a single $ to the shell inside the single quotes.
+	expectedCmd := `'echo '\''$$HOME'\'' in1 > __SBOX_OUT_DIR__/.intermediates/gen/gen/in1.h && ` +
+		`echo '\''$$HOME'\'' in2 > __SBOX_OUT_DIR__/.intermediates/gen/gen/in2.h'`
+	if shard.Args["cmd"] != expectedCmd {
+		t.Errorf("the command of the shard is %q, expected %q", shard.Args["cmd"], expectedCmd)
+	}
+}
+
+func TestGenSrcsBatch(t *testing.T) {
+	testcases := []struct {
+		name      string
+		shardSize string
+		inputs    [][]string
+	}{
+		{
+			name:   "single batch",
+			inputs: [][]string{{"in1", "in2", "dir/in3"}},
+		},
+		{
+			name:      "sharded batches",
+			shardSize: "shard_size: 2,",
+			inputs:    [][]string{{"in1", "in2"}, {"dir/in3"}},
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testGenrule(t, `
+				gensrcs {
+					name: "gen",
+					tools: ["tool"],
+					srcs: ["in1", "in2", "dir/in3"],
+					output_extension: "h",
+					batch: true,
+					`+test.shardSize+`
+					cmd: "$(location) $(in) -o $(genDir)",
+				}
+			`)
+
+			gen := ctx.ModuleForTests("gen", "")
+			module := gen.Module().(*Module)
+			if module.shardRule != nil {
+				t.Errorf("batches must run the command once for all of their files")
+			}
+
+			var inputs [][]string
+			for _, p := range module.BuildParamsForTests() {
+				if p.Rule == module.rule {
+					inputs = append(inputs, p.Inputs.Strings())
+				}
+			}
+			if !reflect.DeepEqual(inputs, test.inputs) {
+				t.Errorf("the inputs of the batches are %q, expected %q", inputs, test.inputs)
+			}
+
+			expectedCmd := "out/x86_64/tool ${in} -o __SBOX_OUT_DIR__/.intermediates/gen/gen"
+			if module.rawCommand != expectedCmd {
+				t.Errorf("want %q, got %q", expectedCmd, module.rawCommand)
+			}
+		})
+	}
+}
+
+func TestGenSrcsShardErrors(t *testing.T) {
+	testGenruleError(t, "cannot be used when a shard runs the command for each of its files", `
+		gensrcs {
+			name: "gen",
+			tools: ["tool"],
+			srcs: ["in1", "in2"],
+			output_extension: "h",
+			shard_size: 2,
+			depfile: true,
+			cmd: "$(location) $(in) -d $(depfile) > $(out)",
+		}
+	`)
+
+	testGenruleError(t, "must be at least 1, found 0", `
+		gensrcs {
+			name: "gen",
+			tools: ["tool"],
+			srcs: ["in1", "in2"],
+			output_extension: "h",
+			shard_size: 0,
+			cmd: "$(location) $(in) > $(out)",
+		}
+	`)
+}
+
+func TestGenruleUndeclaredPaths(t *testing.T) {
+	testcases := []struct {
+		name string
+		prop string
+		err  string
+	}{
+		{
+			name: "undeclared",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "$(location) $(in) dir/undeclared > $(out)",
+			`,
+			err: `"dir/undeclared" is not declared in srcs, tools or tool_files`,
+		},
+		{
+			name: "undeclared flag",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "$(location) --extra=dir/undeclared $(in) > $(out)",
+			`,
+			err: `"dir/undeclared" is not declared in srcs, tools or tool_files`,
+		},
+		{
+			name: "declared",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "$(location) dir/in3 > $(out)",
+			`,
+		},
+		{
+			name: "allowed",
+			prop: `
+				srcs: [":fg1"],
+				allowed_undeclared_paths: ["dir"],
+				cmd: "$(location) $(in) dir/undeclared > $(out)",
+			`,
+		},
+		{
+			name: "allowed file",
+			prop: `
+				srcs: [":fg1"],
+				allowed_undeclared_paths: ["dir/undeclared"],
+				cmd: "$(location) $(in) dir/undeclared > $(out)",
+			`,
+		},
+		{
+			name: "other top-level directory",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "$(location) $(in) other/file > $(out)",
+			`,
+			err: `"other/file" is not declared in srcs, tools or tool_files`,
+		},
+		{
+			name: "external",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "python external/foo/bar.py $(in) > $(out)",
+			`,
+			err: `"external/foo/bar.py" is not declared in srcs, tools or tool_files`,
+		},
+		{
+			name: "allowed external",
+			prop: `
+				srcs: [":fg1"],
+				allowed_undeclared_paths: ["external/foo"],
+				cmd: "python external/foo/bar.py $(in) > $(out)",
+			`,
+		},
+		{
+			name: "sed expression",
+			prop: `
+				srcs: [":fg1"],
+				cmd: "sed -e 's/dir/undeclared/g' $(in) > $(out)",
+			`,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			bp := "genrule {\n"
+			bp += "name: \"gen\",\n"
+			bp += "tool_files: [\"tool_file1\"],\n"
+			bp += "out: [\"out\"],\n"
+			bp += test.prop
+			bp += "}\n"
+
+			if test.err != "" {
+				testGenruleError(t, test.err, bp)
+			} else {
+				testGenrule(t, bp)
+			}
+		})
+	}
+}
+
+func TestGenruleToolArch(t *testing.T) {
+	testcases := []struct {
+		name   string
+		prop   string
+		expect string
+		err    string
+	}{
+		{
+			name: "primary",
+			prop: `
+				tools: ["tool"],
+				cmd: "$(location) > $(out)",
+			`,
+			expect: "out/x86_64/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "x86",
+			prop: `
+				tools: ["tool:x86"],
+				cmd: "$(location) > $(out)",
+			`,
+			expect: "out/x86/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "both",
+			prop: `
+				tools: ["tool", "tool:x86"],
+				cmd: "$(location :tool) $(location tool:x86) > $(out)",
+			`,
+			expect: "out/x86_64/tool out/x86/tool > __SBOX_OUT_FILES__",
+		},
+		{
+			name: "no alias with a colon",
+			prop: `
+				tools: ["tool:x86"],
+				cmd: "$(location :tool:x86) > $(out)",
+			`,
+			err: `unknown location label ":tool:x86"`,
+		},
+		{
+			name: "unknown arch",
+			prop: `
+				tools: ["tool:arm"],
+				cmd: "$(location) > $(out)",
+			`,
+			err: `"tool:arm": no arm host architecture for "tool"`,
+		},
+	}
+
+	for _, test := range testcases {
+		t.Run(test.name, func(t *testing.T) {
+			bp := "genrule {\n"
+			bp += "name: \"gen\",\n"
+			bp += "out: [\"out\"],\n"
+			bp += test.prop
+			bp += "}\n"
+
+			if test.err != "" {
+				testGenruleError(t, test.err, bp)
+				return
+			}
+
+			ctx := testGenrule(t, bp)
+			gen := ctx.ModuleForTests("gen", "").Module().(*Module)
+			if gen.rawCommand != test.expect {
+				t.Errorf("want %q, got %q", test.expect, gen.rawCommand)
+			}
+		})
+	}
+}
+
+func TestGenruleDefaults(t *testing.T) {
+	ctx := testGenrule(t, `
+		genrule_defaults {
+			name: "gen_defaults",
+			tools: ["tool"],
+			cmd: "$(location) $(in) > $(out)",
+			out: ["out"],
+			output_extension: "h",
+			shard_size: 2,
+		}
+
+		genrule {
+			name: "gen",
+			defaults: ["gen_defaults"],
+			srcs: ["in1"],
+		}
+
+		gensrcs {
+			name: "gensrcs",
+			defaults: ["gen_defaults"],
+			srcs: ["in1", "in2"],
+		}
+	`)
+
+	gen := ctx.ModuleForTests("gen", "")
+	expectedCmd := "out/x86_64/tool ${in} > __SBOX_OUT_FILES__"
+	if rawCommand := gen.Module().(*Module).rawCommand; rawCommand != expectedCmd {
+		t.Errorf("want %q, got %q", expectedCmd, rawCommand)
+	}
+	gen.Output("out")
+
+	gensrcs := ctx.ModuleForTests("gensrcs", "")
+	shard := gensrcs.Output("in1.h")
+	if shard.Rule != gensrcs.Module().(*Module).shardRule {
+		t.Errorf("gensrcs does not use shard_size from its defaults")
+	}
+}
+
+type testTool struct {
+	android.ModuleBase
+	outputFile android.Path
+}
+
+func toolFactory() android.Module {
+	module := &testTool{}
+	android.InitAndroidArchModule(module, android.HostSupported, android.MultilibBoth)
+	return module
+}
+
+func (t *testTool) DepsMutator(ctx android.BottomUpMutatorContext) {}
+
+func (t *testTool) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	t.outputFile = android.PathForTesting("out", ctx.Arch().ArchType.String(), ctx.ModuleName())
+}
+
+func (t *testTool) HostToolPath() android.OptionalPath {
+	return android.OptionalPathForPath(t.outputFile)
+}
+
+var _ HostToolProvider = (*testTool)(nil)
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the rules for processing resources with aapt2.  Each resource directory is
+// compiled separately into an archive of flat files, so that a change to a resource only requires
+// recompiling its own directory before the single aapt2 link step of the module.
+
+import (
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+var (
+	aapt2CompileRule = pctx.AndroidStaticRule("aapt2Compile",
+		blueprint.RuleParams{
+			Command:     `$aapt2Cmd compile --legacy -o $out --dir $resDir`,
+			CommandDeps: []string{"$aapt2Cmd"},
+		},
+		"resDir")
+
+	aapt2LinkRule = pctx.AndroidStaticRule("aapt2Link",
+		blueprint.RuleParams{
+			Command: `rm -rf "$genDir" && mkdir -p "$genDir" && ` +
+				`$aapt2Cmd link -o $out $flags $extraPackages --java $genDir --proguard $proguardOptions ` +
+				`--output-text-symbols $rTxt && ` +
+				`${config.SoongZipCmd} -jar -o $genJar -C $genDir -D $genDir`,
+			CommandDeps: []string{"$aapt2Cmd", "${config.SoongZipCmd}"},
+		},
+		"flags", "extraPackages", "genDir", "genJar", "proguardOptions", "rTxt")
+
+	mergeAppPackage = pctx.AndroidStaticRule("mergeAppPackage",
+		blueprint.RuleParams{
+			Command:     `${config.MergeZipsCmd} $out $in`,
+			CommandDeps: []string{"${config.MergeZipsCmd}"},
+		})
+)
+
+func init() {
+	pctx.HostBinToolVariable("aapt2Cmd", "aapt2")
+}
+
+// Aapt2Compile compiles all the resources in a resource directory into an archive of flat files.
+// deps is the list of files in the directory, the archive is recompiled when any of them change.
+func Aapt2Compile(ctx android.ModuleContext, outputFile android.WritablePath, dir android.Path,
+	deps android.Paths) {
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        aapt2CompileRule,
+		Description: "aapt2 compile " + dir.String(),
+		Output:      outputFile,
+		Implicits:   deps,
+		Args: map[string]string{
+			"resDir": dir.String(),
+		},
+	})
+}
+
+// aapt2ResourceFlags returns the flags to pass the compiled resources to aapt2 link.  compiledRes
+// is in decreasing order of priority, while aapt2 link lets each overlay passed with -R override
+// the resources passed before it, so the list is passed in reverse.
+func aapt2ResourceFlags(compiledRes android.Paths) []string {
+	var flags []string
+	for i := len(compiledRes) - 1; i >= 0; i-- {
+		if i == len(compiledRes)-1 {
+			flags = append(flags, compiledRes[i].String())
+		} else {
+			flags = append(flags, "-R "+compiledRes[i].String())
+		}
+	}
+
+	if len(compiledRes) > 1 {
+		// Overlays may add resources that are not in the lowest priority resources.
+		flags = append(flags, "--auto-add-overlay")
+	}
+
+	return flags
+}
+
+// Aapt2Link runs aapt2 link to create a resource package containing the compiled resources and
+// manifest, along with a srcjar containing R.java, the proguard options file and R.txt.
+// extraPackages is a list of files, each containing the package name of a static Android library
+// whose R.java should also be generated with this module's resource IDs.
+func Aapt2Link(ctx android.ModuleContext, flags []string, extraPackages android.Paths,
+	deps android.Paths) (packageRes, rJar, proguardOptionsFile, rTxt android.Path) {
+
+	resourceApk := android.PathForModuleOut(ctx, "package-res.apk")
+	genDir := android.PathForModuleGen(ctx, "aapt2", "R")
+	srcJar := android.PathForModuleGen(ctx, "R.jar")
+	proguardOptions := android.PathForModuleOut(ctx, "proguard.options")
+	symbols := android.PathForModuleOut(ctx, "R.txt")
+
+	var extraPackagesFlag string
+	if len(extraPackages) > 0 {
+		extraPackagesFlag = "--extra-packages $$(cat " + strings.Join(extraPackages.Strings(), " ") +
+			" | paste -sd: -)"
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:            aapt2LinkRule,
+		Description:     "aapt2 link",
+		Output:          resourceApk,
+		ImplicitOutputs: android.WritablePaths{srcJar, proguardOptions, symbols},
+		Implicits:       append(append(android.Paths(nil), deps...), extraPackages...),
+		Args: map[string]string{
+			"flags":           strings.Join(flags, " "),
+			"extraPackages":   extraPackagesFlag,
+			"genDir":          genDir.String(),
+			"genJar":          srcJar.String(),
+			"proguardOptions": proguardOptions.String(),
+			"rTxt":            symbols.String(),
+		},
+	})
+
+	return resourceApk, srcJar, proguardOptions, symbols
+}
+
+// CreateAapt2AppPackage combines the resource package created by aapt2 link with the dex jar of
+// the app and the zip of its native libraries, if any, and signs the result.
+func CreateAapt2AppPackage(ctx android.ModuleContext, packageRes android.Path, jarFile android.Path,
+	jniJarFile android.OptionalPath, certificates []string) android.Path {
+
+	unsignedApk := android.PathForModuleOut(ctx, "resources.apk")
+
+	inputs := android.Paths{packageRes, jarFile}
+	if jniJarFile.Valid() {
+		inputs = append(inputs, jniJarFile.Path())
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        mergeAppPackage,
+		Description: "merge app package",
+		Output:      unsignedApk,
+		Inputs:      inputs,
+	})
+
+	return signAppPackage(ctx, unsignedApk, certificates)
+}
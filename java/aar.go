@@ -0,0 +1,515 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the module types for Android libraries that carry resources, either built
+// from source (android_library) or imported from a prebuilt .aar file (android_library_import),
+// and the resource handling that they share with android_app.
+
+import (
+	"path/filepath"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
+
+	"android/soong/android"
+)
+
+type AndroidLibraryDependency interface {
+	Dependency
+	ExportPackage() android.Path
+	ExportedResourceDirs() android.Paths
+	ExportedResourceDeps() android.Paths
+	ExportedCompiledResources() android.Paths
+	ExportedManifests() android.Paths
+	ExportedExtraPackages() android.Paths
+}
+
+type aaptProperties struct {
+	// flags passed to aapt when creating the apk
+	Aaptflags []string
+
+	// list of directories relative to the Blueprints file containing assets.
+	// Defaults to "assets"
+	Asset_dirs []string
+
+	// list of directories relative to the Blueprints file containing
+	// Android resources
+	Resource_dirs []string
+
+	// if true, compile and link resources with aapt2 instead of aapt.  Defaults to true if the
+	// USE_AAPT2 environment variable is set to true.
+	Use_aapt2 *bool
+}
+
+type aapt struct {
+	aaptProperties aaptProperties
+
+	exportPackage android.Path
+	rTxt          android.Path
+	aaptSrcJar    android.Path
+	manifestPath  android.Path
+
+	// the resource files of this module, without those of its static Android libraries
+	resourceFiles android.Paths
+
+	// manifests of the static Android libraries, to be merged into the manifest of an app
+	staticLibManifests android.Paths
+
+	// package name files of the static Android libraries, passed to aapt --extra-packages
+	extraAaptPackages android.Paths
+
+	// resources, manifests and package names of this module and its static Android libraries,
+	// in decreasing order of priority
+	exportedResourceDirs  android.Paths
+	exportedResourceDeps  android.Paths
+	exportedManifests     android.Paths
+	exportedExtraPackages android.Paths
+
+	// resources of this module and its static Android libraries compiled by aapt2, in decreasing
+	// order of priority
+	exportedCompiledResources android.Paths
+}
+
+func (a *aapt) ExportPackage() android.Path {
+	return a.exportPackage
+}
+
+func (a *aapt) ExportedResourceDirs() android.Paths {
+	return a.exportedResourceDirs
+}
+
+func (a *aapt) ExportedResourceDeps() android.Paths {
+	return a.exportedResourceDeps
+}
+
+func (a *aapt) ExportedCompiledResources() android.Paths {
+	return a.exportedCompiledResources
+}
+
+func (a *aapt) ExportedManifests() android.Paths {
+	return a.exportedManifests
+}
+
+func (a *aapt) ExportedExtraPackages() android.Paths {
+	return a.exportedExtraPackages
+}
+
+func (a *aapt) useAapt2(ctx android.BaseContext) bool {
+	if a.aaptProperties.Use_aapt2 != nil {
+		return *a.aaptProperties.Use_aapt2
+	}
+	return ctx.AConfig().IsEnvTrue("USE_AAPT2")
+}
+
+func (a *aapt) deps(ctx android.BottomUpMutatorContext, noStandardLibs bool, sdkVersion string) {
+	if !noStandardLibs {
+		switch sdkVersion { // TODO: Res_sdk_version?
+		case "current", "system_current", "":
+			ctx.AddDependency(ctx.Module(), frameworkResTag, "framework-res")
+		default:
+			// We'll already have a dependency on an sdk prebuilt android.jar
+		}
+	}
+}
+
+var aaptIgnoreFilenames = []string{
+	".svn",
+	".git",
+	".ds_store",
+	"*.scc",
+	".*",
+	"CVS",
+	"thumbs.db",
+	"picasa.ini",
+	"*~",
+}
+
+// aaptFlags returns the flags to pass to aapt for the module's resources, assets and manifest,
+// followed by the resources of any static Android libraries.  Resources are passed in decreasing
+// order of priority: resource overlays, the module's own resources, and then the resources of
+// each static library in the order they are listed.  If mergeManifests is set the manifests of the
+// static libraries are merged into the module's manifest, and if manifestFixerFlags is not nil the
+// merged manifest is then passed through manifest_fixer with those flags.  If the module uses aapt2
+// the returned flags are for aapt2 link, and the resources are passed as compiled resource
+// archives.
+func (a *aapt) aaptFlags(ctx android.ModuleContext, sdkVersion string, manifest *string,
+	mergeManifests bool, manifestFixerFlags []string) ([]string, android.Paths, bool) {
+
+	useAapt2 := a.useAapt2(ctx)
+
+	aaptFlags := append([]string(nil), a.aaptProperties.Aaptflags...)
+
+	if true /* is not a test */ && !useAapt2 {
+		aaptFlags = append(aaptFlags, "-z")
+	}
+
+	assetDirs := android.PathsWithOptionalDefaultForModuleSrc(ctx, a.aaptProperties.Asset_dirs, "assets")
+	resourceDirs := android.PathsWithOptionalDefaultForModuleSrc(ctx, a.aaptProperties.Resource_dirs, "res")
+
+	var overlayResourceDirs android.Paths
+	// For every resource directory, check if there is an overlay directory with the same path.
+	// If found, it will be prepended to the list of resource directories.
+	for _, overlayDir := range ctx.AConfig().ResourceOverlays() {
+		for _, resourceDir := range resourceDirs {
+			overlay := overlayDir.OverlayPath(ctx, resourceDir)
+			if overlay.Valid() {
+				overlayResourceDirs = append(overlayResourceDirs, overlay.Path())
+			}
+		}
+	}
+
+	if len(overlayResourceDirs) > 0 {
+		resourceDirs = append(overlayResourceDirs, resourceDirs...)
+	}
+
+	// aapt needs to rerun if any files are added or modified in the assets or resource directories,
+	// use glob to create a filelist.
+	var aaptDeps, resourceDeps android.Paths
+	var hasResources bool
+	for _, d := range resourceDirs {
+		newDeps := ctx.Glob(filepath.Join(d.String(), "**/*"), aaptIgnoreFilenames)
+		resourceDeps = append(resourceDeps, newDeps...)
+		if len(newDeps) > 0 {
+			hasResources = true
+			a.exportedResourceDirs = append(a.exportedResourceDirs, d)
+			a.resourceFiles = append(a.resourceFiles, newDeps...)
+			a.exportedResourceDeps = append(a.exportedResourceDeps, newDeps...)
+
+			// The compiled resources are only built if this module or a module that depends on
+			// it uses aapt2.
+			compiledRes := android.PathForModuleOut(ctx, "aapt2", d.String()+".flata")
+			Aapt2Compile(ctx, compiledRes, d, newDeps)
+			a.exportedCompiledResources = append(a.exportedCompiledResources, compiledRes)
+		}
+	}
+	for _, d := range assetDirs {
+		newDeps := ctx.Glob(filepath.Join(d.String(), "**/*"), aaptIgnoreFilenames)
+		aaptDeps = append(aaptDeps, newDeps...)
+	}
+
+	var manifestFile string
+	if manifest == nil {
+		manifestFile = "AndroidManifest.xml"
+	} else {
+		manifestFile = *manifest
+	}
+
+	var manifestPath android.Path = android.PathForModuleSrc(ctx, manifestFile)
+
+	var libResourceDirs, libCompiledResources android.Paths
+
+	ctx.VisitDirectDeps(func(module blueprint.Module) {
+		var depFiles android.Paths
+		switch ctx.OtherModuleDependencyTag(module) {
+		case frameworkResTag:
+			if app, ok := module.(*AndroidApp); ok && app.exportPackage != nil {
+				depFiles = android.Paths{app.exportPackage}
+			}
+		case staticLibTag:
+			if lib, ok := module.(AndroidLibraryDependency); ok {
+				libResourceDirs = append(libResourceDirs, lib.ExportedResourceDirs()...)
+				libCompiledResources = append(libCompiledResources, lib.ExportedCompiledResources()...)
+				resourceDeps = append(resourceDeps, lib.ExportedResourceDeps()...)
+				a.exportedResourceDeps = append(a.exportedResourceDeps, lib.ExportedResourceDeps()...)
+				a.staticLibManifests = append(a.staticLibManifests, lib.ExportedManifests()...)
+				a.extraAaptPackages = append(a.extraAaptPackages, lib.ExportedExtraPackages()...)
+			}
+		}
+
+		for _, dep := range depFiles {
+			aaptFlags = append(aaptFlags, "-I "+dep.String())
+		}
+		aaptDeps = append(aaptDeps, depFiles...)
+	})
+
+	// A library listed more than once in the transitive static libraries keeps the priority of
+	// its first occurrence.
+	libResourceDirs = android.FirstUniquePaths(libResourceDirs)
+	a.exportedResourceDirs = android.FirstUniquePaths(append(a.exportedResourceDirs, libResourceDirs...))
+	libCompiledResources = android.FirstUniquePaths(libCompiledResources)
+	a.exportedCompiledResources = android.FirstUniquePaths(
+		append(a.exportedCompiledResources, libCompiledResources...))
+	a.exportedResourceDeps = android.FirstUniquePaths(a.exportedResourceDeps)
+	a.staticLibManifests = android.FirstUniquePaths(a.staticLibManifests)
+	a.exportedManifests = append(android.Paths{manifestPath}, a.staticLibManifests...)
+
+	if mergeManifests && len(a.staticLibManifests) > 0 {
+		manifestPath = MergeManifests(ctx, manifestPath, a.staticLibManifests)
+	}
+	if manifestFixerFlags != nil {
+		manifestPath = FixManifest(ctx, manifestPath, manifestFixerFlags)
+	}
+	a.manifestPath = manifestPath
+	a.extraAaptPackages = android.FirstUniquePaths(a.extraAaptPackages)
+
+	if len(libResourceDirs) > 0 {
+		resourceDirs = append(resourceDirs, libResourceDirs...)
+		hasResources = true
+		if !useAapt2 {
+			// Resources from static libraries that are not overridden by this module are added
+			// to the package instead of being reported as missing from the base package.
+			aaptFlags = append(aaptFlags, "--auto-add-overlay")
+		}
+	}
+
+	aaptDeps = append(aaptDeps, manifestPath)
+
+	if useAapt2 {
+		// aapt2 link only needs to rerun when the compiled resources change, not for every
+		// change to a resource file.
+		aaptDeps = append(aaptDeps, a.exportedCompiledResources...)
+
+		aaptFlags = append(aaptFlags, "--manifest "+manifestPath.String())
+		aaptFlags = append(aaptFlags, android.JoinWithPrefix(assetDirs.Strings(), "-A "))
+		aaptFlags = append(aaptFlags, aapt2ResourceFlags(a.exportedCompiledResources)...)
+	} else {
+		aaptDeps = append(aaptDeps, resourceDeps...)
+
+		aaptFlags = append(aaptFlags, "-M "+manifestPath.String())
+		aaptFlags = append(aaptFlags, android.JoinWithPrefix(assetDirs.Strings(), "-A "))
+		aaptFlags = append(aaptFlags, android.JoinWithPrefix(resourceDirs.Strings(), "-S "))
+	}
+
+	if sdkVersion == "" {
+		sdkVersion = ctx.AConfig().PlatformSdkVersion()
+	}
+
+	aaptFlags = append(aaptFlags, "--min-sdk-version "+sdkVersion)
+	aaptFlags = append(aaptFlags, "--target-sdk-version "+sdkVersion)
+
+	return aaptFlags, aaptDeps, hasResources
+}
+
+//
+// Android libraries (android_library)
+//
+
+type AndroidLibrary struct {
+	Library
+	aapt
+}
+
+var _ AndroidLibraryDependency = (*AndroidLibrary)(nil)
+
+func (a *AndroidLibrary) DepsMutator(ctx android.BottomUpMutatorContext) {
+	a.Module.deps(ctx)
+	a.aapt.deps(ctx, proptools.Bool(a.properties.No_standard_libs), a.deviceProperties.Sdk_version)
+}
+
+func (a *AndroidLibrary) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	aaptFlags, aaptDeps, hasResources := a.aaptFlags(ctx, a.deviceProperties.Sdk_version,
+		a.properties.Manifest, false, nil)
+
+	if hasResources && a.useAapt2(ctx) {
+		// Resource IDs are only assigned when the library is linked into an app, so the library's
+		// R.java must not contain constants that javac would inline.
+		aaptLinkFlags := append([]string{"--non-final-ids"}, aaptFlags...)
+
+		packageRes, rJar, proguardOptionsFile, rTxt :=
+			Aapt2Link(ctx, aaptLinkFlags, a.extraAaptPackages, aaptDeps)
+		a.aaptSrcJar = rJar
+		a.rTxt = rTxt
+		a.ExtraSrcJars = append(a.ExtraSrcJars, rJar)
+		a.exportPackage = packageRes
+
+		ctx.CheckbuildFile(a.exportPackage)
+		ctx.CheckbuildFile(proguardOptionsFile)
+		ctx.CheckbuildFile(rTxt)
+	} else if hasResources {
+		// Resource IDs are only assigned when the library is linked into an app, so the library's
+		// R.java must not contain constants that javac would inline.
+		aaptRJavaFlags := append([]string{"--non-constant-id"}, aaptFlags...)
+
+		rJar, publicResourcesFile, proguardOptionsFile, rTxt :=
+			CreateResourceJavaFiles(ctx, aaptRJavaFlags, a.extraAaptPackages, aaptDeps)
+		a.aaptSrcJar = rJar
+		a.rTxt = rTxt
+		a.ExtraSrcJars = append(a.ExtraSrcJars, rJar)
+
+		a.exportPackage = CreateExportPackage(ctx, aaptFlags, aaptDeps)
+
+		ctx.CheckbuildFile(a.exportPackage)
+		ctx.CheckbuildFile(publicResourcesFile)
+		ctx.CheckbuildFile(proguardOptionsFile)
+		ctx.CheckbuildFile(rTxt)
+	}
+
+	if hasResources {
+		// The R classes are only used to compile the library, the app that the library is linked
+		// into generates them again for the library's package with the final resource IDs.
+		a.Module.stripFiles = append(a.Module.stripFiles, "R.class", "R$*.class")
+	}
+
+	extraPackages := ExtractManifestPackage(ctx, a.manifestPath)
+	a.exportedExtraPackages = append(android.Paths{extraPackages}, a.extraAaptPackages...)
+
+	// library manifests are merged into the manifest of the app, don't let Module see them
+	a.properties.Manifest = nil
+
+	a.Module.lintManifest = a.manifestPath
+	a.Module.lintResources = a.resourceFiles
+	a.Module.compile(ctx)
+}
+
+func AndroidLibraryFactory() android.Module {
+	module := &AndroidLibrary{}
+
+	// Android libraries are only used as static libraries of apps and other Android libraries
+	module.properties.Installable = proptools.BoolPtr(false)
+
+	module.AddProperties(
+		&module.Module.properties,
+		&module.Module.deviceProperties,
+		&module.Module.protoProperties,
+		&module.aaptProperties)
+
+	InitJavaModule(module, android.DeviceSupported)
+	return module
+}
+
+//
+// AAR (android library) prebuilts
+//
+
+type AARImportProperties struct {
+	// the .aar file to import, exactly one must be listed
+	Aars []string
+
+	// the sdk version that the classes in the .aar were compiled against, passed to Make as
+	// LOCAL_SDK_VERSION so that it can check that modules built against an sdk only use
+	// libraries that are built against an sdk too
+	Sdk_version string
+}
+
+type AARImport struct {
+	android.ModuleBase
+	prebuilt android.Prebuilt
+
+	properties AARImportProperties
+
+	classpathFile android.WritablePath
+	manifest      android.WritablePath
+	resourceDir   android.Path
+	compiledRes   android.Path
+	extraPackages android.Path
+}
+
+func (a *AARImport) Prebuilt() *android.Prebuilt {
+	return &a.prebuilt
+}
+
+func (a *AARImport) PrebuiltSrcs() []string {
+	return a.properties.Aars
+}
+
+func (a *AARImport) Name() string {
+	return a.prebuilt.Name(a.ModuleBase.Name())
+}
+
+func (a *AARImport) DepsMutator(ctx android.BottomUpMutatorContext) {
+	// The classes and resources of an .aar are already compiled, it only has the dependencies
+	// that its users add themselves.
+}
+
+var unzipAAR = pctx.AndroidStaticRule("unzipAAR",
+	blueprint.RuleParams{
+		// An AAR may not contain any resources, always create the res directory so that it can
+		// be passed to aapt.  unzip preserves the timestamps from the archive, touch the outputs
+		// so that they are newer than the AAR.
+		Command: `rm -rf $outDir && mkdir -p $outDir/res && ` +
+			`unzip -qo -d $outDir $in && touch $out`,
+	},
+	"outDir")
+
+func (a *AARImport) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	aar := a.prebuilt.SingleSourcePath(ctx)
+	if ctx.Failed() {
+		return
+	}
+
+	extractedAARDir := android.PathForModuleOut(ctx, "aar")
+	a.classpathFile = extractedAARDir.Join(ctx, "classes.jar")
+	a.manifest = extractedAARDir.Join(ctx, "AndroidManifest.xml")
+	a.resourceDir = extractedAARDir.Join(ctx, "res")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        unzipAAR,
+		Description: "unzip AAR",
+		Input:       aar,
+		Outputs:     android.WritablePaths{a.classpathFile, a.manifest},
+		Args: map[string]string{
+			"outDir": extractedAARDir.String(),
+		},
+	})
+
+	compiledRes := android.PathForModuleOut(ctx, "aapt2", "res.flata")
+	Aapt2Compile(ctx, compiledRes, a.resourceDir, android.Paths{a.classpathFile, a.manifest})
+	a.compiledRes = compiledRes
+
+	a.extraPackages = ExtractManifestPackage(ctx, a.manifest)
+}
+
+var _ Dependency = (*AARImport)(nil)
+
+func (a *AARImport) HeaderJars() android.Paths {
+	return android.Paths{a.classpathFile}
+}
+
+func (a *AARImport) ImplementationJars() android.Paths {
+	return android.Paths{a.classpathFile}
+}
+
+func (a *AARImport) AidlIncludeDirs() android.Paths {
+	return nil
+}
+
+var _ AndroidLibraryDependency = (*AARImport)(nil)
+
+func (a *AARImport) ExportPackage() android.Path {
+	return nil
+}
+
+func (a *AARImport) ExportedResourceDirs() android.Paths {
+	return android.Paths{a.resourceDir}
+}
+
+func (a *AARImport) ExportedResourceDeps() android.Paths {
+	return android.Paths{a.classpathFile, a.manifest}
+}
+
+func (a *AARImport) ExportedCompiledResources() android.Paths {
+	return android.Paths{a.compiledRes}
+}
+
+func (a *AARImport) ExportedManifests() android.Paths {
+	return android.Paths{a.manifest}
+}
+
+func (a *AARImport) ExportedExtraPackages() android.Paths {
+	return android.Paths{a.extraPackages}
+}
+
+var _ android.PrebuiltInterface = (*AARImport)(nil)
+
+func AARImportFactory() android.Module {
+	module := &AARImport{}
+
+	module.AddProperties(&module.properties)
+
+	android.InitPrebuiltModule(module, &module.properties.Aars)
+	android.InitAndroidArchModule(module, android.DeviceSupported, android.MultilibCommon)
+	return module
+}
@@ -35,9 +35,17 @@ func (library *Library) AndroidMk() android.AndroidMkData {
 					fmt.Fprintln(w, "LOCAL_UNINSTALLABLE_MODULE := true")
 				}
 				if library.dexJarFile != nil {
-					fmt.Fprintln(w, "LOCAL_SOONG_DEX_JAR :=", library.dexJarFile.String())
-					if library.deviceProperties.Dex_preopt == nil || *library.deviceProperties.Dex_preopt == false {
-						fmt.Fprintln(w, "LOCAL_DEX_PREOPT := false")
+					dexJarFile := library.dexJarFile
+					if library.dexpreoptJarFile != nil {
+						dexJarFile = library.dexpreoptJarFile
+					}
+					fmt.Fprintln(w, "LOCAL_SOONG_DEX_JAR :=", dexJarFile.String())
+					// Soong has already dexpreopted the library if it should be, the odex and vdex
+					// files are installed by the modules below.
+					fmt.Fprintln(w, "LOCAL_DEX_PREOPT := false")
+					installs := dexpreoptMakeInstalls(library.BaseModuleName(), library.dexpreoptOutputs)
+					for _, install := range installs {
+						fmt.Fprintln(w, "LOCAL_REQUIRED_MODULES +=", install.module)
 					}
 				}
 				fmt.Fprintln(w, "LOCAL_SDK_VERSION :=", library.deviceProperties.Sdk_version)
@@ -47,6 +55,8 @@ func (library *Library) AndroidMk() android.AndroidMkData {
 		Custom: func(w io.Writer, name, prefix, moduleDir string, data android.AndroidMkData) {
 			android.WriteAndroidMkData(w, data)
 
+			writeDexpreoptMakeInstalls(w, name, library.dexpreoptOutputs)
+
 			if proptools.Bool(library.deviceProperties.Hostdex) && !library.Host() {
 				fmt.Fprintln(w, "include $(CLEAR_VARS)")
 				fmt.Fprintln(w, "LOCAL_MODULE := "+name+"-hostdex")
@@ -82,6 +92,50 @@ func (prebuilt *Import) AndroidMk() android.AndroidMkData {
 	}
 }
 
+func (prebuilt *AARImport) AndroidMk() android.AndroidMkData {
+	return android.AndroidMkData{
+		Class:      "JAVA_LIBRARIES",
+		OutputFile: android.OptionalPathForPath(prebuilt.classpathFile),
+		Include:    "$(BUILD_SYSTEM)/soong_java_prebuilt.mk",
+		Extra: []android.AndroidMkExtraFunc{
+			func(w io.Writer, outputFile android.Path) {
+				fmt.Fprintln(w, "LOCAL_UNINSTALLABLE_MODULE := true")
+				fmt.Fprintln(w, "LOCAL_SOONG_HEADER_JAR :=", prebuilt.classpathFile.String())
+				fmt.Fprintln(w, "LOCAL_SDK_VERSION :=", prebuilt.properties.Sdk_version)
+			},
+		},
+	}
+}
+
+func (prebuilt *AndroidAppImport) AndroidMk() android.AndroidMkData {
+	return android.AndroidMkData{
+		Class:      "APPS",
+		OutputFile: android.OptionalPathForPath(prebuilt.outputFile),
+		Extra: []android.AndroidMkExtraFunc{
+			func(w io.Writer, outputFile android.Path) {
+				// The apk was signed by Soong or is presigned, Make must not sign it again.
+				fmt.Fprintln(w, "LOCAL_CERTIFICATE := PRESIGNED")
+				fmt.Fprintln(w, "LOCAL_MODULE_SUFFIX := .apk")
+				// Soong has already dexpreopted the apk if it should be, the odex and vdex files
+				// are installed by the modules below.
+				fmt.Fprintln(w, "LOCAL_DEX_PREOPT := false")
+				installs := dexpreoptMakeInstalls(prebuilt.BaseModuleName(), prebuilt.dexpreoptOutputs)
+				for _, install := range installs {
+					fmt.Fprintln(w, "LOCAL_REQUIRED_MODULES +=", install.module)
+				}
+				if len(prebuilt.properties.Overrides) > 0 {
+					fmt.Fprintln(w, "LOCAL_OVERRIDES_PACKAGES :=",
+						strings.Join(prebuilt.properties.Overrides, " "))
+				}
+			},
+		},
+		Custom: func(w io.Writer, name, prefix, moduleDir string, data android.AndroidMkData) {
+			android.WriteAndroidMkData(w, data)
+			writeDexpreoptMakeInstalls(w, name, prebuilt.dexpreoptOutputs)
+		},
+	}
+}
+
 func (binary *Binary) AndroidMk() android.AndroidMkData {
 	return android.AndroidMkData{
 		Class:      "JAVA_LIBRARIES",
@@ -107,3 +161,17 @@ func (binary *Binary) AndroidMk() android.AndroidMkData {
 		},
 	}
 }
+
+// writeDexpreoptMakeInstalls writes the Make modules that install the odex and vdex files of the
+// module called name.
+func writeDexpreoptMakeInstalls(w io.Writer, name string, outputs []dexpreoptOutput) {
+	for _, install := range dexpreoptMakeInstalls(name, outputs) {
+		fmt.Fprintln(w, "include $(CLEAR_VARS)")
+		fmt.Fprintln(w, "LOCAL_MODULE :=", install.module)
+		fmt.Fprintln(w, "LOCAL_MODULE_CLASS := ETC")
+		fmt.Fprintln(w, "LOCAL_MODULE_PATH := $(TARGET_OUT)/"+install.installDir)
+		fmt.Fprintln(w, "LOCAL_INSTALLED_MODULE_STEM :=", install.file.Base())
+		fmt.Fprintln(w, "LOCAL_PREBUILT_MODULE_FILE :=", install.file.String())
+		fmt.Fprintln(w, "include $(BUILD_PREBUILT)")
+	}
+}
@@ -24,10 +24,22 @@ import (
 	"github.com/google/blueprint/proptools"
 
 	"android/soong/android"
+	"android/soong/cc"
+	"android/soong/java/config"
 )
 
-// AAR prebuilts
-// AndroidManifest.xml merging
+var instrumentationTestConfig = pctx.AndroidStaticRule("instrumentationTestConfig",
+	blueprint.RuleParams{
+		Command:     `$instrumentationTestConfigCmd $name $in $out`,
+		CommandDeps: []string{"$instrumentationTestConfigCmd"},
+	},
+	"name")
+
+func init() {
+	pctx.SourcePathVariable("instrumentationTestConfigCmd",
+		"build/soong/scripts/gen-instrumentation-test-config.py")
+}
+
 // package splits
 
 type androidAppProperties struct {
@@ -42,75 +54,87 @@ type androidAppProperties struct {
 	// use to get PRODUCT-agnostic resource data like IDs and type definitions.
 	Export_package_resources bool
 
-	// flags passed to aapt when creating the apk
-	Aaptflags []string
-
 	// list of resource labels to generate individual resource packages
 	Package_splits []string
 
-	// list of directories relative to the Blueprints file containing assets.
-	// Defaults to "assets"
-	Asset_dirs []string
+	// list of cc_library_shared modules to package into the app, built for each of the device's
+	// ABIs selected by jni_multilib.  The shared libraries that they depend on are packaged too,
+	// except for the ones that the platform provides to apps through the NDK.
+	Jni_libs []string
 
-	// list of directories relative to the Blueprints file containing
-	// Android resources
-	Resource_dirs []string
+	// the device ABIs that the app packages jni_libs for: "both" (the default), "first", "32" or
+	// "64".  The app runs as the first of them, which is the architecture it is compiled ahead of
+	// time for.
+	Jni_multilib *string
+
+	// if true, store the native libraries uncompressed and page aligned in the apk under
+	// lib/<abi>/ so that they can be loaded directly from the apk.  If false, install them next to
+	// the app in app/<name>/lib/<arch>/ instead.  Defaults to true.
+	Use_embedded_native_libs *bool
+
+	// the package name of the app.  If set, the build fails if the manifest declares a different
+	// package.
+	Package_name *string
 }
 
 type AndroidApp struct {
 	Module
+	aapt
 
 	appProperties androidAppProperties
-
-	aaptJavaFileList android.Path
-	exportPackage    android.Path
 }
 
 func (a *AndroidApp) DepsMutator(ctx android.BottomUpMutatorContext) {
 	a.Module.deps(ctx)
-
-	if !proptools.Bool(a.properties.No_standard_libs) {
-		switch a.deviceProperties.Sdk_version { // TODO: Res_sdk_version?
-		case "current", "system_current", "":
-			ctx.AddDependency(ctx.Module(), frameworkResTag, "framework-res")
-		default:
-			// We'll already have a dependency on an sdk prebuilt android.jar
-		}
+	a.aapt.deps(ctx, proptools.Bool(a.properties.No_standard_libs), a.deviceProperties.Sdk_version)
+
+	for _, target := range a.targets(ctx) {
+		ctx.AddFarVariationDependencies([]blueprint.Variation{
+			{Mutator: "arch", Variation: target.String()},
+			{Mutator: "image", Variation: "core"},
+			{Mutator: "link", Variation: "shared"},
+		}, jniLibTag, a.appProperties.Jni_libs...)
 	}
 }
 
 func (a *AndroidApp) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	aaptFlags, aaptDeps, hasResources := a.aaptFlags(ctx)
+	useAapt2 := a.useAapt2(ctx)
+
+	var packageRes android.Path
+	if useAapt2 {
+		// aapt2 links the resources and the manifest into a resource package and generates
+		// R.java in a single step, even if the app has no resources of its own.
+		var rJar, proguardOptionsFile, rTxt android.Path
+		packageRes, rJar, proguardOptionsFile, rTxt =
+			Aapt2Link(ctx, aaptProductFlags(ctx, aaptFlags), a.extraAaptPackages, aaptDeps)
+		a.aaptSrcJar = rJar
+		a.rTxt = rTxt
+		a.ExtraSrcJars = append(a.ExtraSrcJars, rJar)
 
-	if hasResources {
+		if a.appProperties.Export_package_resources {
+			a.exportPackage = packageRes
+			ctx.CheckbuildFile(a.exportPackage)
+		}
+		ctx.CheckbuildFile(proguardOptionsFile)
+		ctx.CheckbuildFile(rTxt)
+	} else if hasResources {
 		// First generate R.java so we can build the .class files
 		aaptRJavaFlags := append([]string(nil), aaptFlags...)
 
-		publicResourcesFile, proguardOptionsFile, aaptJavaFileList :=
-			CreateResourceJavaFiles(ctx, aaptRJavaFlags, aaptDeps)
-		a.aaptJavaFileList = aaptJavaFileList
-		// TODO(ccross):  export aapt generated java files as a src jar
+		rJar, publicResourcesFile, proguardOptionsFile, rTxt :=
+			CreateResourceJavaFiles(ctx, aaptRJavaFlags, a.extraAaptPackages, aaptDeps)
+		a.aaptSrcJar = rJar
+		a.rTxt = rTxt
+		a.ExtraSrcJars = append(a.ExtraSrcJars, rJar)
 
 		if a.appProperties.Export_package_resources {
-			aaptPackageFlags := append([]string(nil), aaptFlags...)
-			var hasProduct bool
-			for _, f := range aaptPackageFlags {
-				if strings.HasPrefix(f, "--product") {
-					hasProduct = true
-					break
-				}
-			}
-
-			if !hasProduct {
-				aaptPackageFlags = append(aaptPackageFlags,
-					"--product "+ctx.AConfig().ProductAaptCharacteristics())
-			}
-			a.exportPackage = CreateExportPackage(ctx, aaptPackageFlags, aaptDeps)
+			a.exportPackage = CreateExportPackage(ctx, aaptProductFlags(ctx, aaptFlags), aaptDeps)
 			ctx.CheckbuildFile(a.exportPackage)
 		}
 		ctx.CheckbuildFile(publicResourcesFile)
 		ctx.CheckbuildFile(proguardOptionsFile)
-		ctx.CheckbuildFile(aaptJavaFileList)
+		ctx.CheckbuildFile(rTxt)
 	}
 
 	// apps manifests are handled by aapt, don't let Module see them
@@ -120,57 +144,133 @@ func (a *AndroidApp) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	//	a.properties.Proguard.Enabled = true
 	//}
 
+	a.Module.lintManifest = a.manifestPath
+	a.Module.lintResources = a.resourceFiles
 	a.Module.compile(ctx)
 
-	aaptPackageFlags := append([]string(nil), aaptFlags...)
-	var hasProduct bool
-	for _, f := range aaptPackageFlags {
-		if strings.HasPrefix(f, "--product") {
-			hasProduct = true
-			break
+	jniLibs := a.collectJniDeps(ctx)
+
+	var jniJarFile android.OptionalPath
+	if len(jniLibs) > 0 {
+		embedJni := a.appProperties.Use_embedded_native_libs == nil ||
+			*a.appProperties.Use_embedded_native_libs
+		if embedJni {
+			jniJarFile = android.OptionalPathForPath(TransformJniLibsToJar(ctx, jniLibs))
+		} else {
+			for _, jni := range jniLibs {
+				ctx.InstallFile(android.PathForModuleInstall(ctx, "app", ctx.ModuleName(), "lib",
+					jni.target.Arch.ArchType.String()), jni.name, jni.path)
+			}
 		}
 	}
 
-	if !hasProduct {
-		aaptPackageFlags = append(aaptPackageFlags,
-			"--product "+ctx.AConfig().ProductAaptCharacteristics())
+	// Apps are only compiled ahead of time for the architecture they run as.
+	var archTypes []android.ArchType
+	if targets := a.targets(ctx); len(targets) > 0 {
+		archTypes = append(archTypes, targets[0].Arch.ArchType)
+	}
+	dexJarFile := a.dexpreopt(ctx, a.outputFile, "app", ctx.ModuleName()+".apk", archTypes)
+
+	certificates := []string{appCertificate(ctx, a.appProperties.Certificate)}
+	for _, c := range a.appProperties.Additional_certificates {
+		certificates = append(certificates, filepath.Join(android.PathForSource(ctx).String(), c))
+	}
+
+	if useAapt2 {
+		a.outputFile = CreateAapt2AppPackage(ctx, packageRes, dexJarFile, jniJarFile, certificates)
+	} else {
+		a.outputFile = CreateAppPackage(ctx, aaptProductFlags(ctx, aaptFlags), dexJarFile,
+			jniJarFile, certificates)
 	}
+	ctx.InstallFile(android.PathForModuleInstall(ctx, "app"), ctx.ModuleName()+".apk", a.outputFile)
+}
 
-	certificate := a.appProperties.Certificate
+// appCertificate returns the path to a certificate, without the .x509.pem or .pk8 extension, from
+// the value of a certificate property.  A certificate with no directory is looked up in the default
+// certificate directory, and an empty one selects the default product certificate.
+func appCertificate(ctx android.ModuleContext, certificate string) string {
 	if certificate == "" {
-		certificate = ctx.AConfig().DefaultAppCertificate(ctx).String()
+		return ctx.AConfig().DefaultAppCertificate(ctx).String()
 	} else if dir, _ := filepath.Split(certificate); dir == "" {
-		certificate = filepath.Join(ctx.AConfig().DefaultAppCertificateDir(ctx).String(), certificate)
+		return filepath.Join(ctx.AConfig().DefaultAppCertificateDir(ctx).String(), certificate)
 	} else {
-		certificate = filepath.Join(android.PathForSource(ctx).String(), certificate)
+		return filepath.Join(android.PathForSource(ctx).String(), certificate)
 	}
+}
 
-	certificates := []string{certificate}
-	for _, c := range a.appProperties.Additional_certificates {
-		certificates = append(certificates, filepath.Join(android.PathForSource(ctx).String(), c))
+// targets returns the device targets that the app packages its native libraries for, in order of
+// preference.
+func (a *AndroidApp) targets(ctx android.BaseContext) []android.Target {
+	multilib := "both"
+	if a.appProperties.Jni_multilib != nil {
+		multilib = *a.appProperties.Jni_multilib
 	}
+	targets, err := android.DecodeMultilib(multilib, ctx.AConfig().Targets[android.Device],
+		ctx.AConfig().DevicePrefer32BitExecutables())
+	if err != nil {
+		ctx.PropertyErrorf("jni_multilib", "%s", err.Error())
+	}
+	return targets
+}
 
-	a.outputFile = CreateAppPackage(ctx, aaptPackageFlags, a.outputFile, certificates)
-	ctx.InstallFile(android.PathForModuleInstall(ctx, "app"), ctx.ModuleName()+".apk", a.outputFile)
+type jniLib struct {
+	name   string
+	path   android.Path
+	target android.Target
 }
 
-var aaptIgnoreFilenames = []string{
-	".svn",
-	".git",
-	".ds_store",
-	"*.scc",
-	".*",
-	"CVS",
-	"thumbs.db",
-	"picasa.ini",
-	"*~",
+// collectJniDeps returns the shared libraries listed in jni_libs for each device ABI, and the
+// shared libraries that they depend on except for the ones that the platform provides through the
+// NDK.
+func (a *AndroidApp) collectJniDeps(ctx android.ModuleContext) []jniLib {
+	var jniLibs []jniLib
+	seen := make(map[string]bool)
+
+	ctx.WalkDeps(func(module, parent blueprint.Module) bool {
+		tag := ctx.OtherModuleDependencyTag(module)
+		name := ctx.OtherModuleName(module)
+		if parent == a {
+			if tag != jniLibTag {
+				return false
+			}
+		} else if !cc.IsSharedDepTag(tag) || cc.IsNdkLibrary(name) {
+			return false
+		}
+
+		dep, ok := module.(*cc.Module)
+		if !ok {
+			ctx.ModuleErrorf("jni_libs dependency %q is not a cc module", name)
+			return false
+		}
+
+		lib := dep.IntermPathForModuleOut()
+		if !lib.Valid() {
+			ctx.ModuleErrorf("jni_libs dependency %q missing output file", name)
+			return false
+		}
+		if seen[lib.String()] {
+			return false
+		}
+		seen[lib.String()] = true
+
+		jniLibs = append(jniLibs, jniLib{
+			name:   lib.Path().Base(),
+			path:   lib.Path(),
+			target: dep.Target(),
+		})
+		return true
+	})
+
+	return jniLibs
 }
 
 func (a *AndroidApp) aaptFlags(ctx android.ModuleContext) ([]string, android.Paths, bool) {
-	aaptFlags := a.appProperties.Aaptflags
+	aaptFlags, aaptDeps, hasResources := a.aapt.aaptFlags(ctx, a.deviceProperties.Sdk_version,
+		a.properties.Manifest, true, a.manifestFixerFlags(ctx))
+
 	hasVersionCode := false
 	hasVersionName := false
-	for _, f := range aaptFlags {
+	for _, f := range a.aaptProperties.Aaptflags {
 		if strings.HasPrefix(f, "--version-code") {
 			hasVersionCode = true
 		} else if strings.HasPrefix(f, "--version-name") {
@@ -178,106 +278,163 @@ func (a *AndroidApp) aaptFlags(ctx android.ModuleContext) ([]string, android.Pat
 		}
 	}
 
-	if true /* is not a test */ {
-		aaptFlags = append(aaptFlags, "-z")
+	if !hasVersionCode {
+		aaptFlags = append(aaptFlags, "--version-code "+ctx.AConfig().PlatformSdkVersion())
 	}
 
-	assetDirs := android.PathsWithOptionalDefaultForModuleSrc(ctx, a.appProperties.Asset_dirs, "assets")
-	resourceDirs := android.PathsWithOptionalDefaultForModuleSrc(ctx, a.appProperties.Resource_dirs, "res")
-
-	var overlayResourceDirs android.Paths
-	// For every resource directory, check if there is an overlay directory with the same path.
-	// If found, it will be prepended to the list of resource directories.
-	for _, overlayDir := range ctx.AConfig().ResourceOverlays() {
-		for _, resourceDir := range resourceDirs {
-			overlay := overlayDir.OverlayPath(ctx, resourceDir)
-			if overlay.Valid() {
-				overlayResourceDirs = append(overlayResourceDirs, overlay.Path())
-			}
-		}
+	if !hasVersionName {
+		aaptFlags = append(aaptFlags,
+			"--version-name "+ctx.AConfig().PlatformVersion()+"-"+ctx.AConfig().BuildNumber())
 	}
 
-	if len(overlayResourceDirs) > 0 {
-		resourceDirs = append(overlayResourceDirs, resourceDirs...)
-	}
+	// TODO: LOCAL_PACKAGE_OVERRIDES
+	//    $(addprefix --rename-manifest-package , $(PRIVATE_MANIFEST_PACKAGE_NAME)) \
+
+	// TODO: LOCAL_INSTRUMENTATION_FOR
+	//    $(addprefix --rename-instrumentation-target-package , $(PRIVATE_MANIFEST_INSTRUMENTATION_FOR))
+
+	return aaptFlags, aaptDeps, hasResources
+}
 
-	// aapt needs to rerun if any files are added or modified in the assets or resource directories,
-	// use glob to create a filelist.
-	var aaptDeps android.Paths
-	var hasResources bool
-	for _, d := range resourceDirs {
-		newDeps := ctx.Glob(filepath.Join(d.String(), "**/*"), aaptIgnoreFilenames)
-		aaptDeps = append(aaptDeps, newDeps...)
-		if len(newDeps) > 0 {
-			hasResources = true
+// manifestFixerFlags returns the flags for manifest_fixer to fill in the SDK versions of the app if
+// its manifest does not set them, add the SDK libraries in libs as used libraries, and check the
+// package of the app.
+func (a *AndroidApp) manifestFixerFlags(ctx android.ModuleContext) []string {
+	sdkVersion := manifestSdkVersion(ctx.AConfig(), a.deviceProperties.Sdk_version)
+	flags := []string{"-minSdkVersion " + sdkVersion, "-targetSdkVersion " + sdkVersion}
+
+	for _, lib := range a.properties.Libs {
+		if inList(lib, config.SdkLibraries) {
+			flags = append(flags, "-uses-library "+lib)
 		}
 	}
-	for _, d := range assetDirs {
-		newDeps := ctx.Glob(filepath.Join(d.String(), "**/*"), aaptIgnoreFilenames)
-		aaptDeps = append(aaptDeps, newDeps...)
-	}
 
-	var manifestFile string
-	if a.properties.Manifest == nil {
-		manifestFile = "AndroidManifest.xml"
-	} else {
-		manifestFile = *a.properties.Manifest
+	if a.appProperties.Package_name != nil {
+		flags = append(flags, "-package "+*a.appProperties.Package_name)
 	}
 
-	manifestPath := android.PathForModuleSrc(ctx, manifestFile)
-	aaptDeps = append(aaptDeps, manifestPath)
+	return flags
+}
 
-	aaptFlags = append(aaptFlags, "-M "+manifestPath.String())
-	aaptFlags = append(aaptFlags, android.JoinWithPrefix(assetDirs.Strings(), "-A "))
-	aaptFlags = append(aaptFlags, android.JoinWithPrefix(resourceDirs.Strings(), "-S "))
+// manifestSdkVersion returns the SDK version to put in the manifest of an app built against
+// sdk_version v, using the same value for the min and target SDK versions like Make does.
+func manifestSdkVersion(cfg android.Config, v string) string {
+	switch v {
+	case "", "current", "system_current", "test_current":
+		return cfg.DefaultAppTargetSdk()
+	default:
+		return strings.TrimPrefix(v, "system_")
+	}
+}
 
-	ctx.VisitDirectDeps(func(module blueprint.Module) {
-		var depFiles android.Paths
-		if javaDep, ok := module.(Dependency); ok {
-			if ctx.OtherModuleName(module) == "framework-res" {
-				depFiles = android.Paths{javaDep.(*AndroidApp).exportPackage}
-			}
+// aaptProductFlags adds the product characteristics of the device to the aapt flags, unless a
+// --product flag was already set.
+func aaptProductFlags(ctx android.ModuleContext, aaptFlags []string) []string {
+	for _, f := range aaptFlags {
+		if strings.HasPrefix(f, "--product") {
+			return aaptFlags
 		}
+	}
 
-		for _, dep := range depFiles {
-			aaptFlags = append(aaptFlags, "-I "+dep.String())
-		}
-		aaptDeps = append(aaptDeps, depFiles...)
-	})
+	return append(append([]string(nil), aaptFlags...),
+		"--product "+ctx.AConfig().ProductAaptCharacteristics())
+}
 
-	sdkVersion := a.deviceProperties.Sdk_version
-	if sdkVersion == "" {
-		sdkVersion = ctx.AConfig().PlatformSdkVersion()
-	}
+func AndroidAppFactory() android.Module {
+	module := &AndroidApp{}
 
-	aaptFlags = append(aaptFlags, "--min-sdk-version "+sdkVersion)
-	aaptFlags = append(aaptFlags, "--target-sdk-version "+sdkVersion)
+	module.AddProperties(
+		&module.Module.properties,
+		&module.Module.deviceProperties,
+		&module.aaptProperties,
+		&module.appProperties)
 
-	if !hasVersionCode {
-		aaptFlags = append(aaptFlags, "--version-code "+ctx.AConfig().PlatformSdkVersion())
+	android.InitAndroidArchModule(module, android.DeviceSupported, android.MultilibCommon)
+	return module
+}
+
+type appTestProperties struct {
+	// name of the android_app module that the tests instrument.  The test is compiled against
+	// the classes of the app.
+	Instrumentation_for *string
+
+	// list of compatibility suites (for example "cts", "vts") that the module should be
+	// installed into.
+	Test_suites []string
+
+	// the name of the test configuration (for example "AndroidTest.xml") that should be
+	// installed with the module.  If not set, a configuration that runs the instrumentation of
+	// the merged manifest is generated.
+	Test_config *string
+}
+
+// AndroidTest is an android_test module, an app that contains instrumentation tests.  It is
+// installed to the data partition and into the testcases directories with its test config.
+type AndroidTest struct {
+	AndroidApp
+
+	testProperties appTestProperties
+
+	testConfig android.Path
+}
+
+func (a *AndroidTest) DepsMutator(ctx android.BottomUpMutatorContext) {
+	a.AndroidApp.DepsMutator(ctx)
+	if a.testProperties.Instrumentation_for != nil {
+		ctx.AddDependency(ctx.Module(), instrumentationForTag, *a.testProperties.Instrumentation_for)
 	}
+}
 
-	if !hasVersionName {
-		aaptFlags = append(aaptFlags,
-			"--version-name "+ctx.AConfig().PlatformVersion()+"-"+ctx.AConfig().BuildNumber())
+func (a *AndroidTest) InstallInData() bool {
+	return true
+}
+
+func (a *AndroidTest) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	a.AndroidApp.GenerateAndroidBuildActions(ctx)
+	if ctx.Failed() {
+		return
 	}
 
-	// TODO: LOCAL_PACKAGE_OVERRIDES
-	//    $(addprefix --rename-manifest-package , $(PRIVATE_MANIFEST_PACKAGE_NAME)) \
+	if a.testProperties.Test_config != nil {
+		a.testConfig = android.PathForModuleSrc(ctx, *a.testProperties.Test_config)
+	} else {
+		testConfig := android.PathForModuleOut(ctx, "test_config", ctx.ModuleName()+".config")
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        instrumentationTestConfig,
+			Description: "test config",
+			Output:      testConfig,
+			Input:       a.manifestPath,
+			Args: map[string]string{
+				"name": ctx.ModuleName(),
+			},
+		})
+		a.testConfig = testConfig
+	}
 
-	// TODO: LOCAL_INSTRUMENTATION_FOR
-	//    $(addprefix --rename-instrumentation-target-package , $(PRIVATE_MANIFEST_INSTRUMENTATION_FOR))
+	for _, dir := range a.testcasesDirs(ctx) {
+		ctx.InstallFile(dir, ctx.ModuleName()+".apk", a.outputFile)
+		ctx.InstallFile(dir, ctx.ModuleName()+".config", a.testConfig)
+	}
+}
 
-	return aaptFlags, aaptDeps, hasResources
+// testcasesDirs returns the directories that the test is installed into along with its test
+// config: the testcases directory of the product, and the testcases directory of each of the
+// compatibility suites in test_suites.
+func (a *AndroidTest) testcasesDirs(ctx android.ModuleContext) []android.OutputPath {
+	dirs := []android.OutputPath{android.PathForOutput(ctx, "target", "product",
+		ctx.AConfig().DeviceName(), "testcases", ctx.ModuleName())}
+	return append(dirs, android.PathsForTestSuites(ctx, a.testProperties.Test_suites)...)
 }
 
-func AndroidAppFactory() android.Module {
-	module := &AndroidApp{}
+func AndroidTestFactory() android.Module {
+	module := &AndroidTest{}
 
 	module.AddProperties(
 		&module.Module.properties,
 		&module.Module.deviceProperties,
-		&module.appProperties)
+		&module.aaptProperties,
+		&module.appProperties,
+		&module.testProperties)
 
 	android.InitAndroidArchModule(module, android.DeviceSupported, android.MultilibCommon)
 	return module
@@ -19,6 +19,7 @@ package java
 // functions.
 
 import (
+	"path/filepath"
 	"strings"
 
 	"github.com/google/blueprint"
@@ -30,12 +31,12 @@ var (
 	aaptCreateResourceJavaFile = pctx.AndroidStaticRule("aaptCreateResourceJavaFile",
 		blueprint.RuleParams{
 			Command: `rm -rf "$javaDir" && mkdir -p "$javaDir" && ` +
-				`$aaptCmd package -m $aaptFlags -P $publicResourcesFile -G $proguardOptionsFile ` +
-				`-J $javaDir || ( rm -rf "$javaDir/*"; exit 41 ) && ` +
-				`find $javaDir -name "*.java" > $javaFileList`,
-			CommandDeps: []string{"$aaptCmd"},
+				`$aaptCmd package -m $aaptFlags $extraPackages -P $publicResourcesFile -G $proguardOptionsFile ` +
+				`-J $javaDir --output-text-symbols $rTxtDir || ( rm -rf "$javaDir/*"; exit 41 ) && ` +
+				`${config.SoongZipCmd} -jar -o $out -C $javaDir -D $javaDir`,
+			CommandDeps: []string{"$aaptCmd", "${config.SoongZipCmd}"},
 		},
-		"aaptFlags", "publicResourcesFile", "proguardOptionsFile", "javaDir", "javaFileList")
+		"aaptFlags", "extraPackages", "publicResourcesFile", "proguardOptionsFile", "javaDir", "rTxtDir")
 
 	aaptCreateAssetsPackage = pctx.AndroidStaticRule("aaptCreateAssetsPackage",
 		blueprint.RuleParams{
@@ -52,10 +53,13 @@ var (
 		},
 		"aaptFlags")
 
+	// Aligns the stored entries of the apk, page aligning stored shared libraries so that they
+	// can be loaded directly from the apk, and signs it with JAR signatures and the APK Signature
+	// Scheme v2 and v3.
 	signapk = pctx.AndroidStaticRule("signapk",
 		blueprint.RuleParams{
-			Command:     `java -jar $signapkCmd $certificates $in $out`,
-			CommandDeps: []string{"$signapkCmd"},
+			Command:     `$apkSignerCmd -p -o $out $certificates $in`,
+			CommandDeps: []string{"$apkSignerCmd"},
 		},
 		"certificates")
 
@@ -67,36 +71,126 @@ var (
 			Description: "merge manifest files",
 		},
 		"libsManifests")
+
+	// Fills in the SDK versions and shared libraries of an app in its manifest, and checks its
+	// package.
+	manifestFixer = pctx.AndroidStaticRule("manifestFixer",
+		blueprint.RuleParams{
+			Command:     `$manifestFixerCmd $args $in $out`,
+			CommandDeps: []string{"$manifestFixerCmd"},
+		},
+		"args")
+
+	zipJniLibs = pctx.AndroidStaticRule("zipJniLibs",
+		blueprint.RuleParams{
+			Command:     `${config.SoongZipCmd} -o $out $args`,
+			CommandDeps: []string{"${config.SoongZipCmd}"},
+		},
+		"args")
+
+	// Extracts the package name from a text AndroidManifest.xml so that apps can pass it to
+	// aapt --extra-packages and generate R.java files for the packages of their static libraries.
+	extractManifestPackage = pctx.AndroidStaticRule("extractManifestPackage",
+		blueprint.RuleParams{
+			Command: `sed -n -e 's/.*[[:space:]]package="\([^"]*\)".*/\1/p' $in | head -n 1 > $out`,
+		})
 )
 
 func init() {
 	pctx.SourcePathVariable("androidManifestMergerCmd", "prebuilts/devtools/tools/lib/manifest-merger.jar")
 	pctx.HostBinToolVariable("aaptCmd", "aapt")
-	pctx.HostJavaToolVariable("signapkCmd", "signapk.jar")
+	pctx.HostBinToolVariable("apkSignerCmd", "apk_signer")
+	pctx.HostBinToolVariable("manifestFixerCmd", "manifest_fixer")
 }
 
-func CreateResourceJavaFiles(ctx android.ModuleContext, flags []string,
-	deps android.Paths) (android.Path, android.Path, android.Path) {
+// CreateResourceJavaFiles runs aapt to generate R.java, packaged into a srcjar, along with the
+// public resources file, the proguard options file and R.txt.  extraPackages is a list of files,
+// each containing the package name of a static Android library whose R.java should also be
+// generated with this module's resource IDs.
+func CreateResourceJavaFiles(ctx android.ModuleContext, flags []string, extraPackages android.Paths,
+	deps android.Paths) (rJar, publicResourcesFile, proguardOptionsFile, rTxt android.Path) {
+
 	javaDir := android.PathForModuleGen(ctx, "R")
-	javaFileList := android.PathForModuleOut(ctx, "R.filelist")
-	publicResourcesFile := android.PathForModuleOut(ctx, "public_resources.xml")
-	proguardOptionsFile := android.PathForModuleOut(ctx, "proguard.options")
+	srcJar := android.PathForModuleGen(ctx, "R.jar")
+	publicResources := android.PathForModuleOut(ctx, "public_resources.xml")
+	proguardOptions := android.PathForModuleOut(ctx, "proguard.options")
+	symbols := android.PathForModuleOut(ctx, "R.txt")
+
+	var extraPackagesFlag string
+	if len(extraPackages) > 0 {
+		extraPackagesFlag = "--extra-packages $$(cat " + strings.Join(extraPackages.Strings(), " ") +
+			" | paste -sd: -)"
+	}
 
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        aaptCreateResourceJavaFile,
-		Description: "aapt create R.java",
-		Outputs:     android.WritablePaths{publicResourcesFile, proguardOptionsFile, javaFileList},
-		Implicits:   deps,
+		Rule:            aaptCreateResourceJavaFile,
+		Description:     "aapt create R.java",
+		Output:          srcJar,
+		ImplicitOutputs: android.WritablePaths{publicResources, proguardOptions, symbols},
+		Implicits:       append(append(android.Paths(nil), deps...), extraPackages...),
 		Args: map[string]string{
 			"aaptFlags":           strings.Join(flags, " "),
-			"publicResourcesFile": publicResourcesFile.String(),
-			"proguardOptionsFile": proguardOptionsFile.String(),
+			"extraPackages":       extraPackagesFlag,
+			"publicResourcesFile": publicResources.String(),
+			"proguardOptionsFile": proguardOptions.String(),
 			"javaDir":             javaDir.String(),
-			"javaFileList":        javaFileList.String(),
+			"rTxtDir":             android.PathForModuleOut(ctx).String(),
+		},
+	})
+
+	return srcJar, publicResources, proguardOptions, symbols
+}
+
+// MergeManifests merges the manifests of static Android libraries into the main manifest of a
+// module.
+func MergeManifests(ctx android.ModuleContext, mainManifest android.Path,
+	libManifests android.Paths) android.Path {
+
+	outputFile := android.PathForModuleOut(ctx, "manifest_merger", "AndroidManifest.xml")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        androidManifestMerger,
+		Description: "merge manifest files",
+		Output:      outputFile,
+		Input:       mainManifest,
+		Implicits:   libManifests,
+		Args: map[string]string{
+			"libsManifests": strings.Join(libManifests.Strings(), ":"),
 		},
 	})
 
-	return publicResourcesFile, proguardOptionsFile, javaFileList
+	return outputFile
+}
+
+// FixManifest runs manifest_fixer with flags over the merged manifest of an app.
+func FixManifest(ctx android.ModuleContext, manifest android.Path, flags []string) android.Path {
+	outputFile := android.PathForModuleOut(ctx, "manifest_fixer", "AndroidManifest.xml")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        manifestFixer,
+		Description: "fix manifest",
+		Output:      outputFile,
+		Input:       manifest,
+		Args: map[string]string{
+			"args": strings.Join(flags, " "),
+		},
+	})
+
+	return outputFile
+}
+
+// ExtractManifestPackage writes the package name declared in a manifest to a file.
+func ExtractManifestPackage(ctx android.ModuleContext, manifest android.Path) android.Path {
+	outputFile := android.PathForModuleOut(ctx, "extra_packages")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        extractManifestPackage,
+		Description: "extract manifest package",
+		Output:      outputFile,
+		Input:       manifest,
+	})
+
+	return outputFile
 }
 
 func CreateExportPackage(ctx android.ModuleContext, flags []string, deps android.Paths) android.ModuleOutPath {
@@ -116,7 +210,7 @@ func CreateExportPackage(ctx android.ModuleContext, flags []string, deps android
 }
 
 func CreateAppPackage(ctx android.ModuleContext, flags []string, jarFile android.Path,
-	certificates []string) android.Path {
+	jniJarFile android.OptionalPath, certificates []string) android.Path {
 
 	resourceApk := android.PathForModuleOut(ctx, "resources.apk")
 
@@ -130,18 +224,67 @@ func CreateAppPackage(ctx android.ModuleContext, flags []string, jarFile android
 		},
 	})
 
+	if jniJarFile.Valid() {
+		jniApk := android.PathForModuleOut(ctx, "resources-jni.apk")
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        mergeAppPackage,
+			Description: "merge jni libs",
+			Output:      jniApk,
+			Inputs:      android.Paths{resourceApk, jniJarFile.Path()},
+		})
+		return signAppPackage(ctx, jniApk, certificates)
+	}
+
+	return signAppPackage(ctx, resourceApk, certificates)
+}
+
+// TransformJniLibsToJar creates a zip file containing the native libraries stored uncompressed
+// under lib/<abi>/, to be merged into an apk.
+func TransformJniLibsToJar(ctx android.ModuleContext, jniLibs []jniLib) android.Path {
+	outputFile := android.PathForModuleOut(ctx, "jnilibs.zip")
+
+	var args []string
+	var deps android.Paths
+	for _, jni := range jniLibs {
+		if len(jni.target.Arch.Abi) == 0 {
+			ctx.PropertyErrorf("jni_libs", "target %s has no ABI to package %q under",
+				jni.target.String(), jni.name)
+			continue
+		}
+		dir := "lib/" + jni.target.Arch.Abi[0]
+		args = append(args, "-P "+dir, "-C "+filepath.Dir(jni.path.String()), "-f "+jni.path.String(),
+			"-s "+dir+"/"+jni.name)
+		deps = append(deps, jni.path)
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        zipJniLibs,
+		Description: "zip jni libs",
+		Output:      outputFile,
+		Implicits:   deps,
+		Args: map[string]string{
+			"args": strings.Join(args, " "),
+		},
+	})
+
+	return outputFile
+}
+
+func signAppPackage(ctx android.ModuleContext, unsignedApk android.Path,
+	certificates []string) android.Path {
+
 	outputFile := android.PathForModuleOut(ctx, "package.apk")
 
 	var certificateArgs []string
 	for _, c := range certificates {
-		certificateArgs = append(certificateArgs, c+".x509.pem", c+".pk8")
+		certificateArgs = append(certificateArgs, "-cert "+c+".x509.pem", "-key "+c+".pk8")
 	}
 
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
 		Rule:        signapk,
 		Description: "signapk",
 		Output:      outputFile,
-		Input:       resourceApk,
+		Input:       unsignedApk,
 		Args: map[string]string{
 			"certificates": strings.Join(certificateArgs, " "),
 		},
@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the module type for importing prebuilt Android apps.
+
+import (
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+type androidAppImportProperties struct {
+	// path to the prebuilt apk to import.  It can be set for each architecture, for example
+	// arch: { arm64: { apk: "foo_arm64.apk" } }, to select the apk for the primary device
+	// architecture.
+	Apk *string `android:"arch_variant"`
+
+	// path to a certificate, or the name of a certificate in the default certificate directory,
+	// or blank to use the default product certificate.  The apk is re-signed with it unless
+	// presigned is set.
+	Certificate string
+
+	// if true, the apk is installed with its original signature instead of being re-signed
+	Presigned *bool
+
+	Dex_preopt struct {
+		// If false, do not dexpreopt the apk when it is installed.  Defaults to true.  The dex
+		// files of a presigned apk are kept in it when it is dexpreopted, removing them would
+		// invalidate the signature.
+		Enabled *bool
+
+		// If set, the path to a profile listing the classes and methods to compile ahead of time.
+		Profile *string
+	}
+
+	// names of other apps that should not be installed when this app is installed.  They are
+	// removed by Make when it collects the packages of the product.
+	Overrides []string
+}
+
+type AndroidAppImport struct {
+	android.ModuleBase
+	prebuilt android.Prebuilt
+
+	properties androidAppImportProperties
+
+	// the apk property after the arch variant properties of the primary device architecture
+	// were applied
+	apkSrcs []string
+
+	outputFile  android.Path
+	installFile android.Path
+
+	// odex and vdex files compiled from the apk, if it was dexpreopted
+	dexpreoptOutputs []dexpreoptOutput
+}
+
+func (a *AndroidAppImport) Prebuilt() *android.Prebuilt {
+	return &a.prebuilt
+}
+
+func (a *AndroidAppImport) PrebuiltSrcs() []string {
+	return a.apkSrcs
+}
+
+func (a *AndroidAppImport) Name() string {
+	return a.prebuilt.Name(a.ModuleBase.Name())
+}
+
+func (a *AndroidAppImport) DepsMutator(ctx android.BottomUpMutatorContext) {
+	// The prebuilt source is read by the prebuilt_select mutator, after the arch mutator has
+	// selected the apk for the architecture.
+	a.apkSrcs = nil
+	if a.properties.Apk != nil {
+		a.apkSrcs = []string{*a.properties.Apk}
+	}
+}
+
+var stripApkSignatures = pctx.AndroidStaticRule("stripApkSignatures",
+	blueprint.RuleParams{
+		Command: `${config.MergeZipsCmd} -stripFile "*.SF" -stripFile "*.RSA" -stripFile "*.DSA" ` +
+			`-stripFile "*.EC" -stripFile MANIFEST.MF $out $in`,
+		CommandDeps: []string{"${config.MergeZipsCmd}"},
+	})
+
+func (a *AndroidAppImport) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	apk := a.prebuilt.SingleSourcePath(ctx)
+	if ctx.Failed() {
+		return
+	}
+
+	presigned := a.properties.Presigned != nil && *a.properties.Presigned
+	if presigned && a.properties.Certificate != "" {
+		ctx.PropertyErrorf("certificate", "cannot be set for a presigned apk")
+		return
+	}
+
+	installName := ctx.ModuleName() + ".apk"
+
+	// The apk is only compiled for the architecture it was selected for, which is the primary
+	// device architecture.
+	// Prebuilt apps are dexpreopted by default, like in Make.
+	dexpreopt := !dexpreoptDisabled(ctx, a.properties.Dex_preopt.Enabled == nil ||
+		*a.properties.Dex_preopt.Enabled)
+	if dexpreopt {
+		a.dexpreoptOutputs = dexpreoptCompile(ctx, apk, a.properties.Dex_preopt.Profile, "app",
+			installName, []android.ArchType{ctx.Arch().ArchType})
+	}
+
+	if presigned {
+		a.outputFile = apk
+	} else {
+		// Remove the existing v1 signature files, the v2 and v3 signatures are dropped when the
+		// apk is rewritten.
+		unsignedApk := android.PathForModuleOut(ctx, "unsigned.apk")
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        stripApkSignatures,
+			Description: "strip apk signatures",
+			Output:      unsignedApk,
+			Input:       apk,
+		})
+
+		var apkToSign android.Path = unsignedApk
+		if dexpreopt {
+			apkToSign = dexpreoptStripDex(ctx, unsignedApk, installName)
+		}
+
+		a.outputFile = signAppPackage(ctx, apkToSign,
+			[]string{appCertificate(ctx, a.properties.Certificate)})
+	}
+
+	a.installFile = ctx.InstallFile(android.PathForModuleInstall(ctx, "app"), installName,
+		a.outputFile)
+}
+
+var _ android.PrebuiltInterface = (*AndroidAppImport)(nil)
+
+// AndroidAppImportFactory returns a module that installs a prebuilt apk.  Like Make, it is built
+// for the primary device architecture only, which selects the arch variant of the apk property.
+func AndroidAppImportFactory() android.Module {
+	module := &AndroidAppImport{}
+
+	module.AddProperties(&module.properties)
+
+	android.InitPrebuiltModule(module, &module.apkSrcs)
+	android.InitAndroidArchModule(module, android.DeviceSupported, android.MultilibFirst)
+	return module
+}
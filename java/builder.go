@@ -22,6 +22,7 @@ import (
 	"strings"
 
 	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
 
 	"android/soong/android"
 	"android/soong/java/config"
@@ -35,45 +36,92 @@ var (
 	// will get compiled into multiple .class files if it contains inner classes.  To work around
 	// this, all java rules write into separate directories and then a post-processing step lists
 	// the files in the the directory into a list file that later rules depend on (and sometimes
-	// read from directly using @<listfile>)
+	// read from directly using @<listfile>).  Sources in srcjars are extracted and compiled along
+	// with the other sources so that all of their classes end up in the output jar.
 	javac = pctx.AndroidGomaStaticRule("javac",
 		blueprint.RuleParams{
-			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
+			Command: `rm -rf "$outDir" "$annoDir" "$srcJarDir" && mkdir -p "$outDir" "$annoDir" "$srcJarDir" && ` +
+				`for jar in $srcJars; do unzip -qo -d $srcJarDir $$jar || exit 1; done && ` +
+				`find $srcJarDir -name "*.java" > $srcJarDir/list && ` +
 				`${config.SoongJavacWrapper} ${config.JavacWrapper}${config.JavacCmd} ${config.JavacHeapFlags} ${config.CommonJdkFlags} ` +
 				`$javacFlags $sourcepath $bootClasspath $classpath ` +
 				`-source $javaVersion -target $javaVersion ` +
-				`-d $outDir -s $annoDir @$out.rsp && ` +
+				`-d $outDir -s $annoDir @$out.rsp @$srcJarDir/list && ` +
 				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
 			CommandDeps:      []string{"${config.JavacCmd}", "${config.SoongZipCmd}"},
 			CommandOrderOnly: []string{"${config.SoongJavacWrapper}"},
 			Rspfile:          "$out.rsp",
 			RspfileContent:   "$in",
 		},
-		"javacFlags", "sourcepath", "bootClasspath", "classpath", "outDir", "annoDir", "javaVersion")
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "srcJars", "srcJarDir",
+		"outDir", "annoDir", "javaVersion")
 
 	kotlinc = pctx.AndroidGomaStaticRule("kotlinc",
 		blueprint.RuleParams{
 			// TODO(ccross): kotlinc doesn't support @ file for arguments, which will limit the
 			// maximum number of input files, especially on darwin.
-			Command: `rm -rf "$outDir" && mkdir -p "$outDir" && ` +
+			//
+			// The jvm-abi-gen plugin writes the ABI of the kotlin classes into a header jar, which
+			// is only updated when the ABI changes so that dependents are not recompiled for
+			// changes to the implementation.
+			Command: `rm -rf "$outDir" "$headerClassesDir" && mkdir -p "$outDir" "$headerClassesDir" && ` +
 				`${config.KotlincCmd} $classpath $kotlincFlags ` +
+				`-Xplugin=${config.KotlinAbiGenPluginJar} ` +
+				`-P plugin:org.jetbrains.kotlin.jvm.abi:outputDir=$headerClassesDir ` +
 				`-jvm-target $javaVersion -d $outDir $in && ` +
-				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
+				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir && ` +
+				`${config.SoongZipCmd} -jar -o $headerJar.tmp -C $headerClassesDir -D $headerClassesDir && ` +
+				`(if cmp -s $headerJar.tmp $headerJar ; then rm $headerJar.tmp ; ` +
+				`else mv $headerJar.tmp $headerJar ; fi )`,
+			CommandDeps: []string{
+				"${config.KotlincCmd}",
+				"${config.KotlinCompilerJar}",
+				"${config.KotlinAbiGenPluginJar}",
+				"${config.SoongZipCmd}",
+			},
+			Restat: true,
+		},
+		"kotlincFlags", "classpath", "outDir", "headerClassesDir", "headerJar", "javaVersion")
+
+	// kapt generates java stubs for the kotlin sources so that the annotation processors can see
+	// the kotlin classes, then runs the annotation processors over the stubs and the java sources.
+	// The generated sources are packaged into a srcjar that is compiled by javac.
+	kapt = pctx.AndroidGomaStaticRule("kapt",
+		blueprint.RuleParams{
+			Command: `rm -rf "$srcJarDir" "$kaptDir" && mkdir -p "$srcJarDir" "$kaptDir/sources" ` +
+				`"$kaptDir/classes" "$kaptDir/stubs" && ` +
+				`for jar in $srcJars; do unzip -qo -d $srcJarDir $$jar || exit 1; done && ` +
+				`find $srcJarDir -name "*.java" -o -name "*.kt" > $srcJarDir/list && ` +
+				`${config.KotlincCmd} $classpath $kotlincFlags ` +
+				`-Xplugin=${config.KotlinKaptJar} ` +
+				`-P plugin:org.jetbrains.kotlin.kapt3:sources=$kaptDir/sources ` +
+				`-P plugin:org.jetbrains.kotlin.kapt3:classes=$kaptDir/classes ` +
+				`-P plugin:org.jetbrains.kotlin.kapt3:stubs=$kaptDir/stubs ` +
+				`-P plugin:org.jetbrains.kotlin.kapt3:correctErrorTypes=true ` +
+				`-P plugin:org.jetbrains.kotlin.kapt3:aptMode=stubsAndApt ` +
+				`$processorPath $processors ` +
+				`-jvm-target $javaVersion $in $$(cat $srcJarDir/list) && ` +
+				`${config.SoongZipCmd} -jar -o $out -C $kaptDir/sources -D $kaptDir/sources`,
 			CommandDeps: []string{
 				"${config.KotlincCmd}",
 				"${config.KotlinCompilerJar}",
+				"${config.KotlinKaptJar}",
 				"${config.SoongZipCmd}",
 			},
 		},
-		"kotlincFlags", "classpath", "outDir", "javaVersion")
+		"kotlincFlags", "classpath", "srcJars", "srcJarDir", "kaptDir", "processorPath",
+		"processors", "javaVersion")
 
 	errorprone = pctx.AndroidStaticRule("errorprone",
 		blueprint.RuleParams{
-			Command: `rm -rf "$outDir" "$annoDir" && mkdir -p "$outDir" "$annoDir" && ` +
-				`${config.SoongJavacWrapper} ${config.ErrorProneCmd} ` +
+			Command: `rm -rf "$outDir" "$annoDir" "$srcJarDir" && mkdir -p "$outDir" "$annoDir" "$srcJarDir" && ` +
+				`for jar in $srcJars; do unzip -qo -d $srcJarDir $$jar || exit 1; done && ` +
+				`find $srcJarDir -name "*.java" > $srcJarDir/list && ` +
+				`(${config.SoongJavacWrapper} ${config.ErrorProneCmd} ` +
 				`$javacFlags $sourcepath $bootClasspath $classpath ` +
 				`-source $javaVersion -target $javaVersion ` +
-				`-d $outDir -s $annoDir @$out.rsp && ` +
+				`-d $outDir -s $annoDir @$out.rsp @$srcJarDir/list > $out.log 2>&1 ; ` +
+				`ret=$$? ; cat $out.log ; exit $$ret) && ` +
 				`${config.SoongZipCmd} -jar -o $out -C $outDir -D $outDir`,
 			CommandDeps: []string{
 				"${config.JavaCmd}",
@@ -85,7 +133,26 @@ var (
 			Rspfile:          "$out.rsp",
 			RspfileContent:   "$in",
 		},
-		"javacFlags", "sourcepath", "bootClasspath", "classpath", "outDir", "annoDir", "javaVersion")
+		"javacFlags", "sourcepath", "bootClasspath", "classpath", "srcJars", "srcJarDir",
+		"outDir", "annoDir", "javaVersion")
+
+	// errorproneFindings extracts the findings from the output of Error Prone as lines of
+	// "<file> <check>", without the line numbers so that they are stable across unrelated edits.
+	errorproneFindings = pctx.AndroidStaticRule("errorproneFindings",
+		blueprint.RuleParams{
+			Command: `sed -nE 's/^([^: ]+):[0-9]+: (warning|error): \[([A-Za-z0-9]+)\].*/\1 \3/p' $in | ` +
+				`sort -u > $out`,
+		})
+
+	// errorproneBaseline fails if there are findings that are not listed in the baseline.
+	errorproneBaseline = pctx.AndroidStaticRule("errorproneBaseline",
+		blueprint.RuleParams{
+			Command: `sort -u $baseline | comm -13 - $in > $out.new && ` +
+				`if [ -s $out.new ]; then ` +
+				`echo "New Error Prone findings that are not in $baseline:" ; cat $out.new ; exit 1 ; ` +
+				`fi && touch $out`,
+		},
+		"baseline")
 
 	turbine = pctx.AndroidStaticRule("turbine",
 		blueprint.RuleParams{
@@ -110,6 +177,13 @@ var (
 		},
 		"jarArgs")
 
+	checkDuplicateClasses = pctx.AndroidStaticRule("checkDuplicateClasses",
+		blueprint.RuleParams{
+			Command:     `${config.CheckDuplicateClassesCmd} -o $out $allowFlags $jarFlags`,
+			CommandDeps: []string{"${config.CheckDuplicateClassesCmd}"},
+		},
+		"allowFlags", "jarFlags")
+
 	combineJar = pctx.AndroidStaticRule("combineJar",
 		blueprint.RuleParams{
 			Command:     `${config.MergeZipsCmd} -j $jarArgs $out $in`,
@@ -143,6 +217,34 @@ var (
 		},
 		"outDir", "dxFlags")
 
+	d8 = pctx.AndroidStaticRule("d8",
+		blueprint.RuleParams{
+			Command: `rm -rf "$outDir" && mkdir -p "$outDir" && ` +
+				`${config.D8Cmd} --output $outDir $d8Flags $in && ` +
+				`${config.SoongZipCmd} -o $outDir/classes.dex.jar -C $outDir -D $outDir && ` +
+				`${config.MergeZipsCmd} -D -stripFile "*.class" $out $outDir/classes.dex.jar $resJar`,
+			CommandDeps: []string{
+				"${config.D8Cmd}",
+				"${config.SoongZipCmd}",
+				"${config.MergeZipsCmd}",
+			},
+		},
+		"outDir", "d8Flags", "resJar")
+
+	d8DexArchive = pctx.AndroidStaticRule("d8DexArchive",
+		blueprint.RuleParams{
+			Command: `rm -f $out && ` +
+				`${config.D8Cmd} --intermediate --file-per-class --output $out $d8Flags $in`,
+			CommandDeps: []string{"${config.D8Cmd}"},
+		},
+		"d8Flags")
+
+	mergeDexArchives = pctx.AndroidStaticRule("mergeDexArchives",
+		blueprint.RuleParams{
+			Command:     `${config.MergeZipsCmd} -j $out $in`,
+			CommandDeps: []string{"${config.MergeZipsCmd}"},
+		})
+
 	jarjar = pctx.AndroidStaticRule("jarjar",
 		blueprint.RuleParams{
 			Command:     "${config.JavaCmd} -jar ${config.JarjarCmd} process $rulesFile $in $out",
@@ -157,40 +259,92 @@ func init() {
 
 type javaBuilderFlags struct {
 	javacFlags    string
+	d8Flags       string
 	dxFlags       string
+	desugarFlags  string
 	bootClasspath classpath
 	classpath     classpath
 	systemModules classpath
-	desugarFlags  string
 	aidlFlags     string
 	javaVersion   string
 
 	kotlincFlags     string
 	kotlincClasspath classpath
 
+	processorPath classpath
+	processors    []string
+
 	protoFlags   string
 	protoOutFlag string
 }
 
-func TransformKotlinToClasses(ctx android.ModuleContext, outputFile android.WritablePath,
-	srcFiles android.Paths, srcJars classpath,
+// TransformKotlinToClasses compiles the kotlin sources in srcFiles into outputFile, and writes the
+// ABI of the compiled classes into headerJarFile.
+func TransformKotlinToClasses(ctx android.ModuleContext,
+	outputFile, headerJarFile android.WritablePath, srcFiles android.Paths, srcJars classpath,
 	flags javaBuilderFlags) {
 
 	classDir := android.PathForModuleOut(ctx, "kotlinc", "classes")
+	headerClassesDir := android.PathForModuleOut(ctx, "kotlinc", "header_classes")
 
 	inputs := append(android.Paths(nil), srcFiles...)
 	inputs = append(inputs, srcJars...)
 
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        kotlinc,
-		Description: "kotlinc",
+		Rule:           kotlinc,
+		Description:    "kotlinc",
+		Output:         outputFile,
+		ImplicitOutput: headerJarFile,
+		Inputs:         inputs,
+		Args: map[string]string{
+			"classpath":        flags.kotlincClasspath.FormJavaClassPath("--classpath"),
+			"kotlincFlags":     flags.kotlincFlags,
+			"outDir":           classDir.String(),
+			"headerClassesDir": headerClassesDir.String(),
+			"headerJar":        headerJarFile.String(),
+			"javaVersion":      flags.javaVersion,
+		},
+	})
+}
+
+// TransformKotlinKapt runs the annotation processors in flags.processorPath over the kotlin and
+// java sources and packages the generated sources into the srcjar outputFile.
+func TransformKotlinKapt(ctx android.ModuleContext, outputFile android.WritablePath,
+	srcFiles android.Paths, srcJars classpath,
+	flags javaBuilderFlags) {
+
+	var deps android.Paths
+	deps = append(deps, srcJars...)
+	deps = append(deps, flags.kotlincClasspath...)
+	deps = append(deps, flags.processorPath...)
+
+	var processorPath []string
+	for _, processor := range flags.processorPath {
+		processorPath = append(processorPath,
+			"-P plugin:org.jetbrains.kotlin.kapt3:apclasspath="+processor.String())
+	}
+
+	var processors string
+	if len(flags.processors) > 0 {
+		processors = "-P plugin:org.jetbrains.kotlin.kapt3:processors=" +
+			strings.Join(flags.processors, ",")
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        kapt,
+		Description: "kapt",
 		Output:      outputFile,
-		Inputs:      inputs,
+		Inputs:      srcFiles,
+		Implicits:   deps,
 		Args: map[string]string{
-			"classpath":    flags.kotlincClasspath.FormJavaClassPath("--classpath"),
-			"kotlincFlags": flags.kotlincFlags,
-			"outDir":       classDir.String(),
-			"javaVersion":  flags.javaVersion,
+			"classpath":     flags.kotlincClasspath.FormJavaClassPath("--classpath"),
+			"kotlincFlags":  flags.kotlincFlags,
+			"srcJars":       strings.Join(srcJars.Strings(), " "),
+			"srcJarDir":     android.PathForModuleOut(ctx, "kapt", "srcJars").String(),
+			"kaptDir":       android.PathForModuleOut(ctx, "kapt", "gen").String(),
+			"processorPath": strings.Join(processorPath, " "),
+			"processors":    processors,
+			"javaVersion":   flags.javaVersion,
 		},
 	})
 }
@@ -199,19 +353,52 @@ func TransformJavaToClasses(ctx android.ModuleContext, outputFile android.Writab
 	srcFiles android.Paths, srcJars classpath,
 	flags javaBuilderFlags, deps android.Paths) {
 
-	transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, deps,
+	transformJavaToClasses(ctx, outputFile, nil, srcFiles, srcJars, flags, deps,
 		"javac", "javac", javac)
 }
 
+// RunErrorProne compiles the sources with Error Prone into outputFile.  It returns a file listing
+// the findings of Error Prone as lines of "<file> <check>".
 func RunErrorProne(ctx android.ModuleContext, outputFile android.WritablePath,
-	srcFiles android.Paths, srcJars classpath, flags javaBuilderFlags) {
+	srcFiles android.Paths, srcJars classpath, flags javaBuilderFlags) android.Path {
 
 	if config.ErrorProneJar == "" {
 		ctx.ModuleErrorf("cannot build with Error Prone, missing external/error_prone?")
 	}
 
-	transformJavaToClasses(ctx, outputFile, srcFiles, srcJars, flags, nil,
-		"errorprone", "errorprone", errorprone)
+	log := android.PathForModuleOut(ctx, "errorprone", outputFile.Base()+".log")
+	transformJavaToClasses(ctx, outputFile, android.WritablePaths{log}, srcFiles, srcJars, flags,
+		nil, "errorprone", "errorprone", errorprone)
+
+	findings := android.PathForModuleOut(ctx, "errorprone", "findings.txt")
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        errorproneFindings,
+		Description: "errorprone findings",
+		Output:      findings,
+		Input:       log,
+	})
+
+	return findings
+}
+
+// CheckErrorProneBaseline fails the build if findings contains any finding that is not listed in
+// baseline.  It returns a stamp file that must be built to run the check.
+func CheckErrorProneBaseline(ctx android.ModuleContext,
+	findings, baseline android.Path) android.Path {
+
+	stamp := android.PathForModuleOut(ctx, "errorprone", "baseline.stamp")
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        errorproneBaseline,
+		Description: "errorprone baseline",
+		Output:      stamp,
+		Input:       findings,
+		Implicit:    baseline,
+		Args: map[string]string{
+			"baseline": baseline.String(),
+		},
+	})
+
+	return stamp
 }
 
 func TransformJavaToHeaderClasses(ctx android.ModuleContext, outputFile android.WritablePath,
@@ -256,6 +443,7 @@ func TransformJavaToHeaderClasses(ctx android.ModuleContext, outputFile android.
 // transformJavaToClasses takes source files and converts them to a jar containing .class files.
 // srcFiles is a list of paths to sources, srcJars is a list of paths to jar files that contain
 // sources.  flags contains various command line flags to be passed to the compiler.
+// implicitOutputs lists any other files written by the rule.
 //
 // This method may be used for different compilers, including javac and Error Prone.  The rule
 // argument specifies which command line to use and desc sets the description of the rule that will
@@ -263,7 +451,7 @@ func TransformJavaToHeaderClasses(ctx android.ModuleContext, outputFile android.
 // suffix will be appended to various intermediate files and directories to avoid collisions when
 // this function is called twice in the same module directory.
 func transformJavaToClasses(ctx android.ModuleContext, outputFile android.WritablePath,
-	srcFiles android.Paths, srcJars classpath,
+	implicitOutputs android.WritablePaths, srcFiles android.Paths, srcJars classpath,
 	flags javaBuilderFlags, deps android.Paths,
 	intermediatesDir, desc string, rule blueprint.Rule) {
 
@@ -285,13 +473,15 @@ func transformJavaToClasses(ctx android.ModuleContext, outputFile android.Writab
 	}
 
 	deps = append(deps, flags.classpath...)
+	deps = append(deps, flags.processorPath...)
 
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
-		Rule:        rule,
-		Description: desc,
-		Output:      outputFile,
-		Inputs:      srcFiles,
-		Implicits:   deps,
+		Rule:            rule,
+		Description:     desc,
+		Output:          outputFile,
+		ImplicitOutputs: implicitOutputs,
+		Inputs:          srcFiles,
+		Implicits:       deps,
 		Args: map[string]string{
 			"javacFlags":    flags.javacFlags,
 			"bootClasspath": bootClasspath,
@@ -299,6 +489,8 @@ func transformJavaToClasses(ctx android.ModuleContext, outputFile android.Writab
 			// -sourcepath "" to ensure javac does not fall back to searching the classpath for sources.
 			"sourcepath":  srcJars.FormJavaClassPath("-sourcepath"),
 			"classpath":   flags.classpath.FormJavaClassPath("-classpath"),
+			"srcJars":     strings.Join(srcJars.Strings(), " "),
+			"srcJarDir":   android.PathForModuleOut(ctx, intermediatesDir, "srcjars").String(),
 			"outDir":      android.PathForModuleOut(ctx, intermediatesDir, "classes").String(),
 			"annoDir":     android.PathForModuleOut(ctx, intermediatesDir, "anno").String(),
 			"javaVersion": flags.javaVersion,
@@ -321,9 +513,13 @@ func TransformResourcesToJar(ctx android.ModuleContext, outputFile android.Writa
 }
 
 func TransformJarsToJar(ctx android.ModuleContext, outputFile android.WritablePath, desc string,
-	jars android.Paths, manifest android.OptionalPath, stripDirs bool, dirsToStrip []string) {
+	jars android.Paths, manifest android.OptionalPath, stripDirs bool, dirsToStrip []string,
+	filesToStrip []string, check android.Path) {
 
 	var deps android.Paths
+	if check != nil {
+		deps = append(deps, check)
+	}
 
 	var jarArgs []string
 	if manifest.Valid() {
@@ -337,6 +533,10 @@ func TransformJarsToJar(ctx android.ModuleContext, outputFile android.WritablePa
 		}
 	}
 
+	for _, file := range proptools.NinjaAndShellEscape(filesToStrip) {
+		jarArgs = append(jarArgs, "-stripFile ", file)
+	}
+
 	if stripDirs {
 		jarArgs = append(jarArgs, "-D")
 	}
@@ -353,6 +553,28 @@ func TransformJarsToJar(ctx android.ModuleContext, outputFile android.WritablePa
 	})
 }
 
+// CheckDuplicateClasses writes outputFile if none of the classes in jars is in more than one of the
+// jars passed with jarFlags, except for classes matching one of the allowed patterns.
+func CheckDuplicateClasses(ctx android.ModuleContext, outputFile android.WritablePath,
+	jars android.Paths, jarFlags []string, allowed []string) {
+
+	var allowFlags []string
+	for _, pattern := range allowed {
+		allowFlags = append(allowFlags, "-allow '"+pattern+"'")
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        checkDuplicateClasses,
+		Description: "check duplicate classes",
+		Output:      outputFile,
+		Inputs:      jars,
+		Args: map[string]string{
+			"allowFlags": strings.Join(allowFlags, " "),
+			"jarFlags":   strings.Join(jarFlags, " "),
+		},
+	})
+}
+
 func TransformDesugar(ctx android.ModuleContext, outputFile android.WritablePath,
 	classesJar android.Path, flags javaBuilderFlags) {
 
@@ -386,9 +608,9 @@ func TransformDesugar(ctx android.ModuleContext, outputFile android.WritablePath
 	})
 }
 
-// Converts a classes.jar file to classes*.dex, then combines the dex files with any resources
-// in the classes.jar file into a dex jar.
-func TransformClassesJarToDexJar(ctx android.ModuleContext, outputFile android.WritablePath,
+// Converts a desugared classes.jar file to classes*.dex with dx, then combines the dex files with
+// any resources in the classes.jar file into a dex jar.
+func TransformClassesJarToDexJarWithDx(ctx android.ModuleContext, outputFile android.WritablePath,
 	classesJar android.Path, flags javaBuilderFlags) {
 
 	outDir := android.PathForModuleOut(ctx, "dex")
@@ -405,6 +627,95 @@ func TransformClassesJarToDexJar(ctx android.ModuleContext, outputFile android.W
 	})
 }
 
+// d8ClasspathFlags returns the flags that pass the classpath of the module to d8, which it uses to
+// desugar the classes.
+func d8ClasspathFlags(flags javaBuilderFlags) ([]string, android.Paths) {
+	var d8Flags []string
+	d8Flags = append(d8Flags, flags.bootClasspath.FormDesugarClasspath("--lib")...)
+	d8Flags = append(d8Flags, flags.classpath.FormDesugarClasspath("--classpath")...)
+
+	var deps android.Paths
+	deps = append(deps, flags.bootClasspath...)
+	deps = append(deps, flags.classpath...)
+
+	return d8Flags, deps
+}
+
+// Desugars and converts a classes.jar file to classes*.dex, then combines the dex files with any
+// resources in the classes.jar file into a dex jar.
+func TransformClassesJarToDexJar(ctx android.ModuleContext, outputFile android.WritablePath,
+	classesJar android.Path, flags javaBuilderFlags) {
+
+	outDir := android.PathForModuleOut(ctx, "dex")
+	d8Flags, deps := d8ClasspathFlags(flags)
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        d8,
+		Description: "d8",
+		Output:      outputFile,
+		Input:       classesJar,
+		Implicits:   deps,
+		Args: map[string]string{
+			"d8Flags": strings.Join(append([]string{flags.d8Flags}, d8Flags...), " "),
+			"outDir":  outDir.String(),
+			"resJar":  classesJar.String(),
+		},
+	})
+}
+
+// Desugars and converts the classes in jars to an archive containing a dex file for each class,
+// which can be merged with the dex archives of other modules without converting the classes again.
+func TransformJarsToDexArchive(ctx android.ModuleContext, outputFile android.WritablePath,
+	jars android.Paths, flags javaBuilderFlags) {
+
+	d8Flags, deps := d8ClasspathFlags(flags)
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        d8DexArchive,
+		Description: "d8 dex archive",
+		Output:      outputFile,
+		Inputs:      jars,
+		Implicits:   deps,
+		Args: map[string]string{
+			"d8Flags": strings.Join(append([]string{flags.d8Flags}, d8Flags...), " "),
+		},
+	})
+}
+
+// Merges dex archives into a single dex archive.  When a class is present in more than one archive
+// the first one is kept.
+func TransformMergeDexArchives(ctx android.ModuleContext, outputFile android.WritablePath,
+	dexArchives android.Paths) {
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        mergeDexArchives,
+		Description: "merge dex archives",
+		Output:      outputFile,
+		Inputs:      dexArchives,
+	})
+}
+
+// Merges the dex files in a dex archive into classes*.dex, then combines them with the resources
+// in resourcesJar into a dex jar.
+func TransformDexArchiveToDexJar(ctx android.ModuleContext, outputFile android.WritablePath,
+	dexArchive android.Path, resourcesJar android.Path, flags javaBuilderFlags) {
+
+	outDir := android.PathForModuleOut(ctx, "dex")
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        d8,
+		Description: "d8 merge",
+		Output:      outputFile,
+		Input:       dexArchive,
+		Implicit:    resourcesJar,
+		Args: map[string]string{
+			"d8Flags": flags.d8Flags,
+			"outDir":  outDir.String(),
+			"resJar":  resourcesJar.String(),
+		},
+	})
+}
+
 func TransformJarJar(ctx android.ModuleContext, outputFile android.WritablePath,
 	classesJar android.Path, rulesFile android.Path) {
 	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
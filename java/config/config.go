@@ -28,6 +28,12 @@ var (
 	DefaultBootclasspathLibraries = []string{"core-oj", "core-libart"}
 	DefaultSystemModules          = "core-system-modules"
 	DefaultLibraries              = []string{"ext", "framework", "okhttp"}
+
+	// SdkLibraries are the libraries that are part of the SDK but not on the bootclasspath.  An
+	// app that is compiled against one of them needs a <uses-library> element in its manifest to
+	// have the library loaded at runtime.
+	SdkLibraries = []string{"android.test.base", "android.test.mock", "android.test.runner",
+		"org.apache.http.legacy"}
 )
 
 func init() {
@@ -76,22 +82,19 @@ func init() {
 	pctx.SourcePathVariable("Ziptime", "prebuilts/build-tools/${hostPrebuiltTag}/bin/ziptime")
 
 	pctx.SourcePathVariable("JarArgsCmd", "build/soong/scripts/jar-args.sh")
+	pctx.SourcePathVariable("LintCmd", "prebuilts/devtools/tools/lint")
 	pctx.HostBinToolVariable("SoongZipCmd", "soong_zip")
 	pctx.HostBinToolVariable("MergeZipsCmd", "merge_zips")
+	pctx.HostBinToolVariable("CheckDuplicateClassesCmd", "check_duplicate_classes")
 	pctx.VariableFunc("DxCmd", func(config interface{}) (string, error) {
 		dexer := "dx"
 		if config.(android.Config).Getenv("USE_D8") == "true" {
 			dexer = "d8"
 		}
-		if config.(android.Config).UnbundledBuild() {
-			return "prebuilts/build-tools/common/bin/" + dexer, nil
-		} else {
-			path, err := pctx.HostBinToolPath(config, dexer)
-			if err != nil {
-				return "", err
-			}
-			return path.String(), nil
-		}
+		return dexerCmd(config, dexer)
+	})
+	pctx.VariableFunc("D8Cmd", func(config interface{}) (string, error) {
+		return dexerCmd(config, "d8")
 	})
 
 	pctx.HostJavaToolVariable("JarjarCmd", "jarjar.jar")
@@ -107,3 +110,16 @@ func init() {
 		return "", nil
 	})
 }
+
+// dexerCmd returns the path to dx or d8, which is taken from prebuilts in unbundled builds.
+func dexerCmd(config interface{}, dexer string) (string, error) {
+	if config.(android.Config).UnbundledBuild() {
+		return "prebuilts/build-tools/common/bin/" + dexer, nil
+	} else {
+		path, err := pctx.HostBinToolPath(config, dexer)
+		if err != nil {
+			return "", err
+		}
+		return path.String(), nil
+	}
+}
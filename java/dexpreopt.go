@@ -0,0 +1,270 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the rules for compiling the dex files of java libraries and apps ahead of time
+// with dex2oat.  The odex and vdex files for each architecture are installed next to the jar or
+// apk in oat/<arch>/, and the dex files are stripped from the installed jar or apk.
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
+
+	"android/soong/android"
+)
+
+var (
+	profman = pctx.AndroidStaticRule("profman",
+		blueprint.RuleParams{
+			Command: `$profmanCmd --create-profile-from=$in --apk=$dexJar --dex-location=$dexLocation ` +
+				`--reference-profile-file=$out`,
+			CommandDeps: []string{"$profmanCmd"},
+		},
+		"dexJar", "dexLocation")
+
+	dex2oat = pctx.AndroidStaticRule("dex2oat",
+		blueprint.RuleParams{
+			Command: `rm -f $out && mkdir -p $$(dirname $out) && ` +
+				`$dex2oatCmd --runtime-arg -Xms64m --runtime-arg -Xmx512m ` +
+				`--boot-image=$bootImage --dex-file=$in --dex-location=$dexLocation ` +
+				`--oat-file=$out --android-root=$androidRoot ` +
+				`--instruction-set=$instructionSet --instruction-set-variant=$instructionSetVariant ` +
+				`--instruction-set-features=default --compiler-filter=$compilerFilter $profileFlags ` +
+				`--no-generate-debug-info --generate-build-id --abort-on-hard-verifier-error ` +
+				`--force-determinism --no-inline-from=core-oj.jar`,
+			CommandDeps: []string{"$dex2oatCmd"},
+		},
+		"bootImage", "dexLocation", "androidRoot", "instructionSet", "instructionSetVariant",
+		"compilerFilter", "profileFlags")
+
+	stripDex = pctx.AndroidStaticRule("stripDex",
+		blueprint.RuleParams{
+			Command:     `${config.MergeZipsCmd} -stripFile "classes*.dex" $out $in`,
+			CommandDeps: []string{"${config.MergeZipsCmd}"},
+		})
+)
+
+func init() {
+	pctx.HostBinToolVariable("dex2oatCmd", "dex2oat")
+	pctx.HostBinToolVariable("profmanCmd", "profman")
+}
+
+type dexpreoptOutput struct {
+	archType android.ArchType
+
+	odex, vdex android.Path
+
+	// the directory the odex and vdex files are installed to, relative to the partition
+	installDir string
+}
+
+// dexpreoptMakeInstall is a Make module that installs an odex or vdex file of a module that was
+// dexpreopted by Soong.
+type dexpreoptMakeInstall struct {
+	module     string
+	file       android.Path
+	installDir string
+}
+
+// dexpreoptMakeInstalls returns the Make modules that install the odex and vdex files of the
+// module called name.
+func dexpreoptMakeInstalls(name string, outputs []dexpreoptOutput) []dexpreoptMakeInstall {
+	var installs []dexpreoptMakeInstall
+	for _, output := range outputs {
+		for _, file := range []android.Path{output.odex, output.vdex} {
+			installs = append(installs, dexpreoptMakeInstall{
+				module:     name + "." + output.archType.String() + filepath.Ext(file.Base()),
+				file:       file,
+				installDir: output.installDir,
+			})
+		}
+	}
+	return installs
+}
+
+// dexpreoptDisabled returns true if the module should keep its dex files instead of being
+// compiled ahead of time.  enabled is the value of the dex_preopt.enabled property of the module,
+// or its default.  Only modules installed to /system are dexpreopted, and modules on the boot
+// classpath are already compiled into the boot image.
+func dexpreoptDisabled(ctx android.ModuleContext, enabled bool) bool {
+	if !enabled {
+		return true
+	}
+
+	if !ctx.Device() || ctx.InstallInData() || ctx.InstallOnVendorPartition() {
+		return true
+	}
+
+	if ctx.AConfig().UnbundledBuild() || ctx.AConfig().DisableDexPreopt(ctx.ModuleName()) {
+		return true
+	}
+
+	if inList(ctx.ModuleName(), ctx.AConfig().BootJars()) {
+		return true
+	}
+
+	return false
+}
+
+// dexpreoptBootImage returns the location of the boot image that dexpreopted modules are compiled
+// against.  dex2oat finds the image for each architecture in the <arch> subdirectory of the
+// location, which is returned as the second value.
+func dexpreoptBootImage(ctx android.ModuleContext,
+	archType android.ArchType) (location, image android.Path) {
+
+	dir := android.PathForOutput(ctx, "target", "product", ctx.AConfig().DeviceName(),
+		"dex_bootjars", "system", "framework")
+	return dir.Join(ctx, "boot.art"), dir.Join(ctx, archType.String(), "boot.art")
+}
+
+// dexpreopt compiles the dex files in dexJarFile ahead of time for the device architectures, if
+// dexpreopting is not disabled for the module.  installDir is the directory relative to the
+// partition that the jar or apk is installed to as installName.  It returns the jar to install,
+// which has the dex files stripped if they were compiled.
+func (j *Module) dexpreopt(ctx android.ModuleContext, dexJarFile android.Path, installDir,
+	installName string, archTypes []android.ArchType) android.Path {
+
+	if dexpreoptDisabled(ctx, proptools.Bool(j.deviceProperties.Dex_preopt.Enabled)) {
+		return dexJarFile
+	}
+
+	j.dexpreoptOutputs = append(j.dexpreoptOutputs, dexpreoptCompile(ctx, dexJarFile,
+		j.deviceProperties.Dex_preopt.Profile, installDir, installName, archTypes)...)
+
+	return dexpreoptStripDex(ctx, dexJarFile, installName)
+}
+
+// dexpreoptCompile adds the rules to compile the dex files in dexJarFile with dex2oat for each
+// of archTypes, optionally guided by a profile, and to install the odex and vdex files next to
+// the jar or apk.
+func dexpreoptCompile(ctx android.ModuleContext, dexJarFile android.Path, profile *string,
+	installDir, installName string, archTypes []android.ArchType) []dexpreoptOutput {
+
+	dexLocation := filepath.Join("/system", installDir, installName)
+
+	compilerFilter := "speed"
+	var profileFlags []string
+	var profileDeps android.Paths
+	if profile != nil {
+		prof := android.PathForModuleOut(ctx, "dexpreopt", "profile.prof")
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:        profman,
+			Description: "profman",
+			Output:      prof,
+			Input:       android.PathForModuleSrc(ctx, *profile),
+			Implicit:    dexJarFile,
+			Args: map[string]string{
+				"dexJar":      dexJarFile.String(),
+				"dexLocation": dexLocation,
+			},
+		})
+
+		compilerFilter = "speed-profile"
+		profileFlags = append(profileFlags, "--profile-file="+prof.String())
+		profileDeps = append(profileDeps, prof)
+	}
+
+	stem := strings.TrimSuffix(installName, filepath.Ext(installName))
+	androidRoot := android.PathForOutput(ctx, "target", "product", ctx.AConfig().DeviceName(),
+		"system")
+
+	var outputs []dexpreoptOutput
+	for _, archType := range archTypes {
+		var cpuVariant string
+		for _, target := range ctx.AConfig().Targets[android.Device] {
+			if target.Arch.ArchType == archType {
+				cpuVariant = target.Arch.CpuVariant
+				break
+			}
+		}
+		if cpuVariant == "" {
+			cpuVariant = "generic"
+		}
+
+		bootImageLocation, bootImage := dexpreoptBootImage(ctx, archType)
+
+		odex := android.PathForModuleOut(ctx, "dexpreopt", "oat", archType.String(), stem+".odex")
+		vdex := android.PathForModuleOut(ctx, "dexpreopt", "oat", archType.String(), stem+".vdex")
+
+		ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+			Rule:           dex2oat,
+			Description:    "dex2oat " + archType.String(),
+			Output:         odex,
+			ImplicitOutput: vdex,
+			Input:          dexJarFile,
+			Implicits:      append(android.Paths{bootImage}, profileDeps...),
+			Args: map[string]string{
+				"bootImage":             bootImageLocation.String(),
+				"dexLocation":           dexLocation,
+				"androidRoot":           androidRoot.String(),
+				"instructionSet":        archType.String(),
+				"instructionSetVariant": cpuVariant,
+				"compilerFilter":        compilerFilter,
+				"profileFlags":          strings.Join(profileFlags, " "),
+			},
+		})
+
+		oatDir := filepath.Join(installDir, "oat", archType.String())
+		installPath := android.PathForModuleInstall(ctx, oatDir)
+		ctx.InstallFile(installPath, odex.Base(), odex)
+		ctx.InstallFile(installPath, vdex.Base(), vdex)
+
+		outputs = append(outputs, dexpreoptOutput{
+			archType:   archType,
+			odex:       odex,
+			vdex:       vdex,
+			installDir: oatDir,
+		})
+	}
+
+	return outputs
+}
+
+// dexpreoptStripDex returns a copy of dexJarFile without the dex files, which are not needed
+// once they have been compiled ahead of time.
+func dexpreoptStripDex(ctx android.ModuleContext, dexJarFile android.Path,
+	installName string) android.Path {
+
+	strippedJar := android.PathForModuleOut(ctx, "dexpreopt", "stripped", installName)
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        stripDex,
+		Description: "strip dex",
+		Output:      strippedJar,
+		Input:       dexJarFile,
+	})
+
+	return strippedJar
+}
+
+// dexpreoptArchTypes returns the architecture types of all the device targets, with duplicates
+// removed.
+func dexpreoptArchTypes(ctx android.ModuleContext) []android.ArchType {
+	var archTypes []android.ArchType
+	for _, target := range ctx.AConfig().Targets[android.Device] {
+		found := false
+		for _, archType := range archTypes {
+			if archType == target.Arch.ArchType {
+				found = true
+			}
+		}
+		if !found {
+			archTypes = append(archTypes, target.Arch.ArchType)
+		}
+	}
+	return archTypes
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the per-module Error Prone flags and the singleton that aggregates the
+// findings of all modules into a report of the number of findings of each check per directory.
+
+import (
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+var (
+	errorproneReport = pctx.AndroidStaticRule("errorproneReport",
+		blueprint.RuleParams{
+			Command: `cat $out.rsp | xargs cat | sed -E 's|/[^/ ]* | |' | ` +
+				`sort | uniq -c | sort -rn > $out`,
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$in",
+		})
+)
+
+func init() {
+	pctx.IntermediatesPathVariable("errorproneReportFile", "errorprone/report.txt")
+}
+
+// errorproneFlags returns the flags to compile the module with Error Prone.
+func (j *Module) errorproneFlags(flags javaBuilderFlags) javaBuilderFlags {
+	var errorproneFlags []string
+	errorproneFlags = append(errorproneFlags, j.properties.Errorprone.Javacflags...)
+	for _, check := range j.properties.Errorprone.Enabled_checks {
+		errorproneFlags = append(errorproneFlags, "-Xep:"+check+":ERROR")
+	}
+	for _, check := range j.properties.Errorprone.Disabled_checks {
+		errorproneFlags = append(errorproneFlags, "-Xep:"+check+":OFF")
+	}
+
+	if len(errorproneFlags) > 0 {
+		flags.javacFlags += " " + strings.Join(errorproneFlags, " ")
+	}
+	return flags
+}
+
+func ErrorProneReportSingleton() blueprint.Singleton {
+	return &errorproneReportSingleton{}
+}
+
+type errorproneFindingsProducer interface {
+	errorproneFindingsFile() android.Path
+}
+
+var _ errorproneFindingsProducer = (*Module)(nil)
+
+func (j *Module) errorproneFindingsFile() android.Path {
+	return j.errorproneFindings
+}
+
+// errorproneReportSingleton writes the report of the Error Prone findings of all modules, as lines
+// of "<count> <directory> <check>", when building the errorprone-report goal.
+type errorproneReportSingleton struct{}
+
+func (e *errorproneReportSingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
+	var findings android.Paths
+	ctx.VisitAllModules(func(module blueprint.Module) {
+		if producer, ok := module.(errorproneFindingsProducer); ok {
+			if f := producer.errorproneFindingsFile(); f != nil {
+				findings = append(findings, f)
+			}
+		}
+	})
+
+	if len(findings) == 0 {
+		return
+	}
+
+	ctx.Build(pctx, blueprint.BuildParams{
+		Rule:        errorproneReport,
+		Description: "errorprone report",
+		Outputs:     []string{"$errorproneReportFile"},
+		Inputs:      findings.Strings(),
+		Optional:    true,
+	})
+
+	ctx.Build(pctx, blueprint.BuildParams{
+		Rule:     blueprint.Phony,
+		Outputs:  []string{"errorprone-report"},
+		Inputs:   []string{"$errorproneReportFile"},
+		Optional: true,
+	})
+}
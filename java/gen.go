@@ -87,7 +87,7 @@ func genLogtags(ctx android.ModuleContext, logtagsFile android.Path) android.Pat
 func (j *Module) genSources(ctx android.ModuleContext, srcFiles android.Paths,
 	flags javaBuilderFlags) (android.Paths, classpath) {
 
-	var protoFiles android.Paths
+	var protoFiles, srcJars android.Paths
 	outSrcFiles := make(android.Paths, 0, len(srcFiles))
 
 	for _, srcFile := range srcFiles {
@@ -101,12 +101,15 @@ func (j *Module) genSources(ctx android.ModuleContext, srcFiles android.Paths,
 			outSrcFiles = append(outSrcFiles, javaFile)
 		case ".proto":
 			protoFiles = append(protoFiles, srcFile)
+		case ".srcjar":
+			// for example the packaged tree of an out_dir genrule
+			srcJars = append(srcJars, srcFile)
 		default:
 			outSrcFiles = append(outSrcFiles, srcFile)
 		}
 	}
 
-	var outSrcJars classpath
+	outSrcJars := classpath(srcJars)
 
 	if len(protoFiles) > 0 {
 		protoSrcJar := android.PathForModuleGen(ctx, "proto.src.jar")
@@ -37,13 +37,21 @@ func init() {
 	android.RegisterModuleType("java_library", LibraryFactory(true))
 	android.RegisterModuleType("java_library_static", LibraryFactory(false))
 	android.RegisterModuleType("java_library_host", LibraryHostFactory)
+	android.RegisterModuleType("java_plugin", PluginFactory)
 	android.RegisterModuleType("java_binary", BinaryFactory)
 	android.RegisterModuleType("java_binary_host", BinaryHostFactory)
 	android.RegisterModuleType("java_import", ImportFactory)
 	android.RegisterModuleType("java_import_host", ImportFactoryHost)
 	android.RegisterModuleType("android_app", AndroidAppFactory)
+	android.RegisterModuleType("android_library", AndroidLibraryFactory)
+	android.RegisterModuleType("android_library_import", AARImportFactory)
+	android.RegisterModuleType("android_app_import", AndroidAppImportFactory)
+	android.RegisterModuleType("android_test", AndroidTestFactory)
 
 	android.RegisterSingletonType("logtags", LogtagsSingleton)
+	android.RegisterSingletonType("errorprone_report", ErrorProneReportSingleton)
+	android.RegisterSingletonType("lint_check", LintCheckSingleton)
+	android.RegisterSingletonType("jdeps_generator", JDepsGeneratorSingleton)
 }
 
 // TODO:
@@ -117,6 +125,55 @@ type CompilerProperties struct {
 	// List of classes to pass to javac to use as annotation processors
 	Annotation_processor_classes []string
 
+	// List of patterns of fully qualified class names that may be in more than one of the jars
+	// that are merged into this module, or in this module and on its runtime classpath.  A
+	// duplicate class that matches one of the patterns is a warning instead of an error.
+	Allowed_duplicate_classes []string
+
+	// Properties for running Android lint over the module, which happens when building the
+	// lint-check goal.
+	Lint struct {
+		// If false, don't run lint over the module.  Defaults to true for device modules.
+		Enabled *bool
+
+		// List of host java libraries containing extra lint checks to run over the module.
+		Extra_check_modules []string
+
+		// Name of a file in the module directory listing the lint findings that are accepted
+		// for this module.  Any other error fails lint-check, and so does any other warning
+		// unless warnings_as_errors is false.
+		Baseline_filename *string
+
+		// If true, warnings fail lint-check like errors.  Defaults to true if baseline_filename
+		// is set, so that new findings of any severity have to be fixed or added to the
+		// baseline, and to false otherwise.
+		Warnings_as_errors *bool
+
+		// List of lint checks that should be turned off.
+		Disabled_checks []string
+	}
+
+	// List of java_plugin modules that provide extra functionality to javac, for example
+	// annotation processors.
+	Plugins []string
+
+	// Properties used when the module is compiled with Error Prone, which happens when
+	// RUN_ERROR_PRONE is set.
+	Errorprone struct {
+		// List of javac flags that should only be used when running Error Prone.
+		Javacflags []string
+
+		// List of Error Prone checks that should fail the build.
+		Enabled_checks []string
+
+		// List of Error Prone checks that should be turned off.
+		Disabled_checks []string
+
+		// Path to a file listing the Error Prone findings that are accepted for this module,
+		// one per line in the form "<file> <check>".  Any other finding fails the build.
+		Baseline *string
+	}
+
 	Openjdk9 struct {
 		// List of source files that should only be used when passing -source 1.9
 		Srcs []string
@@ -143,9 +200,15 @@ type CompilerDeviceProperties struct {
 	// If true, export a copy of the module as a -hostdex module for host testing.
 	Hostdex *bool
 
-	// If false, prevent dexpreopting and stripping the dex file from the final jar.  Defaults to
-	// true.
-	Dex_preopt *bool
+	Dex_preopt struct {
+		// If true, compile the dex file ahead of time with dex2oat and strip it from the final
+		// jar.  Defaults to false.
+		Enabled *bool
+
+		// If set, the path to a profile listing the classes and methods to compile ahead of time.
+		// Everything else is left to the JIT.
+		Profile *string
+	}
 
 	// When targeting 1.9, override the modules to use with --system
 	System_modules *string
@@ -169,6 +232,15 @@ type Module struct {
 	// output file containing classes.dex
 	dexJarFile android.Path
 
+	// archive containing a dex file for each class of the implementation jar, or nil if it
+	// couldn't be created
+	dexArchive android.Path
+
+	// the dex archives merged into dexArchive, without duplicates, and the --min-api they were
+	// compiled for
+	dexArchives android.Paths
+	dexMinApi   string
+
 	// output file suitable for installing or running
 	outputFile android.Path
 
@@ -180,8 +252,31 @@ type Module struct {
 	// for example R.java generated by aapt for android apps
 	ExtraSrcJars android.Paths
 
+	// names of class files to leave out of the implementation jar, for example the R classes of
+	// an android_library, which are generated again with the final resource IDs by the app
+	stripFiles []string
+
 	// installed file for binary dependency
 	installFile android.Path
+
+	// odex and vdex files compiled from the dex jar for each architecture, if it was dexpreopted
+	dexpreoptOutputs []dexpreoptOutput
+
+	// dex jar with the dex files stripped if it was dexpreopted, otherwise the dex jar
+	dexpreoptJarFile android.Path
+
+	// the findings of Error Prone, if the module was compiled with it
+	errorproneFindings android.Path
+
+	// the sources and dependencies of the module, for IDE project files
+	ideInfo ideInfo
+
+	// the manifest and resource files passed to lint, set by modules that use aapt
+	lintManifest  android.Path
+	lintResources android.Paths
+
+	// the xml report of lint, if lint is run over the module
+	lintReport android.Path
 }
 
 type Dependency interface {
@@ -190,6 +285,18 @@ type Dependency interface {
 	AidlIncludeDirs() android.Paths
 }
 
+// dexArchiveDependency is implemented by modules that convert the classes of their implementation
+// jar to dex, so that the modules that include them statically can merge the dex files instead of
+// converting the classes again.
+type dexArchiveDependency interface {
+	// DexArchives returns the dex archives of the module and of its static dependencies, which
+	// together contain the classes of the implementation jar, or nil if there are none.
+	DexArchives() android.Paths
+
+	// DexMinApi returns the --min-api that the dex archives were compiled for.
+	DexMinApi() string
+}
+
 func InitJavaModule(module android.DefaultableModule, hod android.HostOrDeviceSupported) {
 	android.InitAndroidArchModule(module, hod, android.MultilibCommon)
 	android.InitDefaultableModule(module)
@@ -201,12 +308,17 @@ type dependencyTag struct {
 }
 
 var (
-	staticLibTag     = dependencyTag{name: "staticlib"}
-	libTag           = dependencyTag{name: "javalib"}
-	bootClasspathTag = dependencyTag{name: "bootclasspath"}
-	systemModulesTag = dependencyTag{name: "system modules"}
-	frameworkResTag  = dependencyTag{name: "framework-res"}
-	kotlinStdlibTag  = dependencyTag{name: "kotlin-stdlib"}
+	staticLibTag          = dependencyTag{name: "staticlib"}
+	libTag                = dependencyTag{name: "javalib"}
+	bootClasspathTag      = dependencyTag{name: "bootclasspath"}
+	systemModulesTag      = dependencyTag{name: "system modules"}
+	frameworkResTag       = dependencyTag{name: "framework-res"}
+	kotlinStdlibTag       = dependencyTag{name: "kotlin-stdlib"}
+	jniLibTag             = dependencyTag{name: "jnilib"}
+	annoProcessorTag      = dependencyTag{name: "annotation processor"}
+	pluginTag             = dependencyTag{name: "plugin"}
+	lintCheckTag          = dependencyTag{name: "lint check"}
+	instrumentationForTag = dependencyTag{name: "instrumentation for"}
 )
 
 type sdkDep struct {
@@ -329,7 +441,17 @@ func (j *Module) deps(ctx android.BottomUpMutatorContext) {
 
 	ctx.AddDependency(ctx.Module(), libTag, j.properties.Libs...)
 	ctx.AddDependency(ctx.Module(), staticLibTag, j.properties.Static_libs...)
-	ctx.AddDependency(ctx.Module(), libTag, j.properties.Annotation_processors...)
+	ctx.AddDependency(ctx.Module(), annoProcessorTag, j.properties.Annotation_processors...)
+	// Plugins run inside javac on the build host.
+	ctx.AddFarVariationDependencies([]blueprint.Variation{
+		{Mutator: "arch", Variation: android.BuildOs.String() + "_common"},
+	}, pluginTag, j.properties.Plugins...)
+	if ctx.Device() {
+		// Lint checks run inside lint on the build host.
+		ctx.AddFarVariationDependencies([]blueprint.Variation{
+			{Mutator: "arch", Variation: android.BuildOs.String() + "_common"},
+		}, lintCheckTag, j.properties.Lint.Extra_check_modules...)
+	}
 
 	android.ExtractSourcesDeps(ctx, j.properties.Srcs)
 	android.ExtractSourcesDeps(ctx, j.properties.Java_resources)
@@ -386,16 +508,30 @@ type deps struct {
 	bootClasspath      android.Paths
 	staticJars         android.Paths
 	staticHeaderJars   android.Paths
+	staticJarsToDex    android.Paths
+	staticDexArchives  android.Paths
 	staticJarResources android.Paths
 	aidlIncludeDirs    android.Paths
 	srcJars            android.Paths
 	systemModules      android.Path
 	aidlPreprocess     android.OptionalPath
 	kotlinStdlib       android.Paths
+	processorPath      android.Paths
+	processorClasses   []string
+	disableTurbine     bool
+
+	// the jars that are on the classpath when the module runs, which are checked for classes
+	// that are also in the module
+	runtimeClasspath android.Paths
+	lintCheckJars    android.Paths
+
+	// the name of the module that provided each dependency jar, keyed by the path of the jar
+	jarModules map[string]string
 }
 
 func (j *Module) collectDeps(ctx android.ModuleContext) deps {
 	var deps deps
+	deps.jarModules = make(map[string]string)
 
 	sdkDep := decodeSdkDep(ctx, j.deviceProperties.Sdk_version)
 	if sdkDep.invalidVersion {
@@ -403,6 +539,8 @@ func (j *Module) collectDeps(ctx android.ModuleContext) deps {
 	} else if sdkDep.useFiles {
 		// sdkDep.jar is actually equivalent to turbine header.jar.
 		deps.classpath = append(deps.classpath, sdkDep.jar)
+		deps.runtimeClasspath = append(deps.runtimeClasspath, sdkDep.jar)
+		deps.jarModules[sdkDep.jar.String()] = "sdk_version " + j.deviceProperties.Sdk_version
 		deps.aidlIncludeDirs = append(deps.aidlIncludeDirs, sdkDep.aidl)
 	}
 
@@ -415,6 +553,8 @@ func (j *Module) collectDeps(ctx android.ModuleContext) deps {
 			switch tag {
 			case android.DefaultsDepTag, android.SourceDepTag:
 				// Nothing to do
+			case jniLibTag:
+				// Handled by AndroidApp
 			case systemModulesTag:
 				if deps.systemModules != nil {
 					panic("Found two system module dependencies")
@@ -433,12 +573,50 @@ func (j *Module) collectDeps(ctx android.ModuleContext) deps {
 		switch tag {
 		case bootClasspathTag:
 			deps.bootClasspath = append(deps.bootClasspath, dep.HeaderJars()...)
+			deps.runtimeClasspath = append(deps.runtimeClasspath, dep.HeaderJars()...)
 		case libTag:
 			deps.classpath = append(deps.classpath, dep.HeaderJars()...)
+			deps.runtimeClasspath = append(deps.runtimeClasspath, dep.HeaderJars()...)
+		case instrumentationForTag:
+			if _, ok := module.(*AndroidApp); !ok {
+				ctx.PropertyErrorf("instrumentation_for", "%q is not an android_app module",
+					otherName)
+				return
+			}
+			// The tests run in the process of the instrumented app.
+			deps.classpath = append(deps.classpath, dep.HeaderJars()...)
+			deps.runtimeClasspath = append(deps.runtimeClasspath, dep.HeaderJars()...)
+		case annoProcessorTag:
+			// javac finds the annotation processors on the classpath, kapt needs them separately.
+			deps.classpath = append(deps.classpath, dep.HeaderJars()...)
+			deps.processorPath = append(deps.processorPath, dep.ImplementationJars()...)
+		case pluginTag:
+			plugin, ok := module.(*Plugin)
+			if !ok {
+				ctx.PropertyErrorf("plugins", "%q is not a java_plugin module", otherName)
+				return
+			}
+			deps.processorPath = append(deps.processorPath, plugin.ImplementationJars()...)
+			if plugin.pluginProperties.Processor_class != nil {
+				deps.processorClasses = append(deps.processorClasses,
+					*plugin.pluginProperties.Processor_class)
+			}
+			// Classes generated by the plugin may be referenced by other modules, which turbine
+			// would not see.
+			deps.disableTurbine = deps.disableTurbine ||
+				proptools.Bool(plugin.pluginProperties.Generates_api)
 		case staticLibTag:
 			deps.classpath = append(deps.classpath, dep.HeaderJars()...)
 			deps.staticJars = append(deps.staticJars, dep.ImplementationJars()...)
 			deps.staticHeaderJars = append(deps.staticHeaderJars, dep.HeaderJars()...)
+			// The dex archives of a dependency can only be merged if they were compiled for the
+			// same API level, d8 desugars the classes differently for other ones.
+			if d, ok := module.(dexArchiveDependency); ok && len(d.DexArchives()) > 0 &&
+				d.DexMinApi() == j.minSdkVersion(ctx) {
+				deps.staticDexArchives = append(deps.staticDexArchives, d.DexArchives()...)
+			} else {
+				deps.staticJarsToDex = append(deps.staticJarsToDex, dep.ImplementationJars()...)
+			}
 		case frameworkResTag:
 			if ctx.ModuleName() == "framework" {
 				// framework.jar has a one-off dependency on the R.java and Manifest.java files
@@ -447,10 +625,16 @@ func (j *Module) collectDeps(ctx android.ModuleContext) deps {
 			}
 		case kotlinStdlibTag:
 			deps.kotlinStdlib = dep.HeaderJars()
+		case lintCheckTag:
+			deps.lintCheckJars = append(deps.lintCheckJars, dep.ImplementationJars()...)
 		default:
 			panic(fmt.Errorf("unknown dependency %q for %q", otherName, ctx.ModuleName()))
 		}
 
+		for _, jar := range append(dep.HeaderJars(), dep.ImplementationJars()...) {
+			deps.jarModules[jar.String()] = otherName
+		}
+
 		deps.aidlIncludeDirs = append(deps.aidlIncludeDirs, dep.AidlIncludeDirs()...)
 	})
 
@@ -490,6 +674,18 @@ func (j *Module) collectBuilderFlags(ctx android.ModuleContext, deps deps) javaB
 	// classpath
 	flags.bootClasspath.AddPaths(deps.bootClasspath)
 	flags.classpath.AddPaths(deps.classpath)
+	flags.processorPath.AddPaths(deps.processorPath)
+	flags.processors = append(flags.processors, j.properties.Annotation_processor_classes...)
+	flags.processors = append(flags.processors, deps.processorClasses...)
+
+	// Pass the annotation processors to javac explicitly, it only searches the classpath for them
+	// when there is no -processorpath.
+	if len(flags.processorPath) > 0 {
+		flags.javacFlags += " " + flags.processorPath.FormJavaClassPath("-processorpath")
+	}
+	if len(flags.processors) > 0 {
+		flags.javacFlags += " -processor " + strings.Join(flags.processors, ",")
+	}
 	// systemModules
 	if deps.systemModules != nil {
 		flags.systemModules = append(flags.systemModules, deps.systemModules)
@@ -526,10 +722,24 @@ func (j *Module) compile(ctx android.ModuleContext) {
 	srcJars = append(srcJars, deps.srcJars...)
 	srcJars = append(srcJars, j.ExtraSrcJars...)
 
+	j.ideInfo = ideInfo{
+		srcs:         srcFiles,
+		srcJars:      android.Paths(srcJars),
+		resourceDirs: android.PathsForModuleSrc(ctx, j.properties.Java_resource_dirs),
+		jars:         append(append(android.Paths(nil), deps.runtimeClasspath...), deps.staticJars...),
+		deps:         append(append([]string(nil), j.properties.Libs...), j.properties.Static_libs...),
+	}
+
 	var jars android.Paths
 
 	jarName := ctx.ModuleName() + ".jar"
 
+	// The flags used to compile the header jar with turbine, which uses the kotlin header jar
+	// instead of the kotlin classes so that it is not rerun for changes to the kotlin
+	// implementation.
+	headerFlags := flags
+	var kotlinHeaderJars android.Paths
+
 	if srcFiles.HasExt(".kt") {
 		// If there are kotlin files, compile them first but pass all the kotlin and java files
 		// kotlinc will use the java files to resolve types referenced by the kotlin files, but
@@ -543,12 +753,29 @@ func (j *Module) compile(ctx android.ModuleContext) {
 		flags.kotlincClasspath = append(flags.kotlincClasspath, deps.kotlinStdlib...)
 		flags.kotlincClasspath = append(flags.kotlincClasspath, deps.classpath...)
 
+		if len(flags.processorPath) > 0 {
+			// Run the annotation processors over the kotlin and java sources with kapt, and
+			// compile the generated sources with javac.  javac must not run the annotation
+			// processors again.
+			kaptSrcJar := android.PathForModuleGen(ctx, "kapt", "kapt-sources.jar")
+			TransformKotlinKapt(ctx, kaptSrcJar, srcFiles, srcJars, flags)
+			srcJars = append(srcJars, kaptSrcJar)
+			flags.javacFlags += " -proc:none"
+		}
+
 		kotlinJar := android.PathForModuleOut(ctx, "kotlin", jarName)
-		TransformKotlinToClasses(ctx, kotlinJar, srcFiles, srcJars, flags)
+		kotlinHeaderJar := android.PathForModuleOut(ctx, "kotlin_headers", jarName)
+		TransformKotlinToClasses(ctx, kotlinJar, kotlinHeaderJar, srcFiles, srcJars, flags)
 		if ctx.Failed() {
 			return
 		}
 
+		headerFlags = flags
+		headerFlags.classpath = append(classpath(nil), flags.classpath...)
+		headerFlags.classpath = append(headerFlags.classpath, kotlinHeaderJar)
+		kotlinHeaderJars = append(kotlinHeaderJars, kotlinHeaderJar)
+		kotlinHeaderJars = append(kotlinHeaderJars, deps.kotlinStdlib...)
+
 		// Make javac rule depend on the kotlinc rule
 		flags.classpath = append(flags.classpath, kotlinJar)
 		// Jar kotlin classes into the final jar after javac
@@ -566,17 +793,22 @@ func (j *Module) compile(ctx android.ModuleContext) {
 		}
 	}
 
-	if ctx.Device() && !ctx.AConfig().IsEnvFalse("TURBINE_ENABLED") {
+	// Modules whose only sources come from srcjars (for example an android_library that contains
+	// only resources) are not compiled with turbine, the implementation jar is used as the header
+	// jar instead.
+	if ctx.Device() && !ctx.AConfig().IsEnvFalse("TURBINE_ENABLED") && !deps.disableTurbine &&
+		(len(uniqueSrcFiles) > 0 || len(deps.staticHeaderJars) > 0 || len(kotlinHeaderJars) > 0) {
 		// If sdk jar is java module, then directly return classesJar as header.jar
 		if j.Name() != "android_stubs_current" && j.Name() != "android_system_stubs_current" &&
 			j.Name() != "android_test_stubs_current" {
-			j.headerJarFile = j.compileJavaHeader(ctx, uniqueSrcFiles, srcJars, deps, flags, jarName)
+			j.headerJarFile = j.compileJavaHeader(ctx, uniqueSrcFiles, srcJars, deps, headerFlags,
+				kotlinHeaderJars, jarName)
 			if ctx.Failed() {
 				return
 			}
 		}
 	}
-	if len(uniqueSrcFiles) > 0 {
+	if len(uniqueSrcFiles) > 0 || len(srcJars) > 0 {
 		var extraJarDeps android.Paths
 		if ctx.AConfig().IsEnvTrue("RUN_ERROR_PRONE") {
 			// If error-prone is enabled, add an additional rule to compile the java files into
@@ -585,8 +817,14 @@ func (j *Module) compile(ctx android.ModuleContext) {
 			// TODO(ccross): Once we always compile with javac9 we may be able to conditionally
 			//    enable error-prone without affecting the output class files.
 			errorprone := android.PathForModuleOut(ctx, "errorprone", jarName)
-			RunErrorProne(ctx, errorprone, javaSrcFiles, srcJars, flags)
+			j.errorproneFindings = RunErrorProne(ctx, errorprone, javaSrcFiles, srcJars,
+				j.errorproneFlags(flags))
 			extraJarDeps = append(extraJarDeps, errorprone)
+			if j.properties.Errorprone.Baseline != nil {
+				baseline := android.PathForModuleSrc(ctx, *j.properties.Errorprone.Baseline)
+				extraJarDeps = append(extraJarDeps,
+					CheckErrorProneBaseline(ctx, j.errorproneFindings, baseline))
+			}
 		}
 
 		// Compile java sources into .class files
@@ -627,21 +865,34 @@ func (j *Module) compile(ctx android.ModuleContext) {
 		jars = append(jars, resourceJar)
 	}
 
+	// The dex archive can't be used if jarjar renames the classes of the combined jar.
+	if ctx.Device() && j.properties.Jarjar_rules == nil && useD8(ctx) {
+		flags.d8Flags = j.d8Flags(ctx)
+		j.dexArchive = j.compileDexArchive(ctx, flags, deps, jars, jarName)
+		if ctx.Failed() {
+			return
+		}
+	}
+
 	// static classpath jars have the resources in them, so the resource jars aren't necessary here
 	jars = append(jars, deps.staticJars...)
 
 	manifest := android.OptionalPathForModuleSrc(ctx, j.properties.Manifest)
 
+	checkDuplicateClasses := j.checkDuplicateClasses(ctx, jars, deps)
+
 	// Combine the classes built from sources, any manifests, and any static libraries into
 	// classes.jar. If there is only one input jar this step will be skipped.
 	var outputFile android.Path
 
-	if len(jars) == 1 && !manifest.Valid() {
+	if len(jars) == 1 && !manifest.Valid() && checkDuplicateClasses == nil &&
+		len(j.stripFiles) == 0 {
 		// Optimization: skip the combine step if there is nothing to do
 		outputFile = jars[0]
 	} else {
 		combinedJar := android.PathForModuleOut(ctx, "combined", jarName)
-		TransformJarsToJar(ctx, combinedJar, "for javac", jars, manifest, false, nil)
+		TransformJarsToJar(ctx, combinedJar, "for javac", jars, manifest, false, nil,
+			j.stripFiles, checkDuplicateClasses)
 		outputFile = combinedJar
 	}
 
@@ -660,7 +911,12 @@ func (j *Module) compile(ctx android.ModuleContext) {
 		j.headerJarFile = j.implementationJarFile
 	}
 
+	if j.lintEnabled(ctx) {
+		j.lint(ctx, srcFiles, deps)
+	}
+
 	if ctx.Device() && j.installable() {
+		flags.d8Flags = j.d8Flags(ctx)
 		outputFile = j.compileDex(ctx, flags, outputFile, jarName)
 		if ctx.Failed() {
 			return
@@ -671,7 +927,7 @@ func (j *Module) compile(ctx android.ModuleContext) {
 }
 
 func (j *Module) compileJavaHeader(ctx android.ModuleContext, srcFiles android.Paths, srcJars classpath,
-	deps deps, flags javaBuilderFlags, jarName string) android.Path {
+	deps deps, flags javaBuilderFlags, kotlinHeaderJars android.Paths, jarName string) android.Path {
 
 	var jars android.Paths
 	if len(srcFiles) > 0 {
@@ -684,9 +940,9 @@ func (j *Module) compileJavaHeader(ctx android.ModuleContext, srcFiles android.P
 		jars = append(jars, turbineJar)
 	}
 
-	// Combine any static header libraries into classes-header.jar. If there is only
-	// one input jar this step will be skipped.
+	// Combine the kotlin header jar and any static header libraries into classes-header.jar.
 	var headerJar android.Path
+	jars = append(jars, kotlinHeaderJars...)
 	jars = append(jars, deps.staticHeaderJars...)
 
 	if len(jars) == 0 {
@@ -695,7 +951,8 @@ func (j *Module) compileJavaHeader(ctx android.ModuleContext, srcFiles android.P
 		// we cannot skip the combine step for now if there is only one jar
 		// since we have to strip META-INF/TRANSITIVE dir from turbine.jar
 		combinedJar := android.PathForModuleOut(ctx, "turbine-combined", jarName)
-		TransformJarsToJar(ctx, combinedJar, "for turbine", jars, android.OptionalPath{}, false, []string{"META-INF"})
+		TransformJarsToJar(ctx, combinedJar, "for turbine", jars, android.OptionalPath{}, false,
+			[]string{"META-INF"}, nil, nil)
 		headerJar = combinedJar
 	}
 
@@ -713,19 +970,157 @@ func (j *Module) compileJavaHeader(ctx android.ModuleContext, srcFiles android.P
 	return headerJar
 }
 
+// checkDuplicateClasses adds a rule to check that no class is in more than one of the jars that are
+// merged into the implementation jar of the module, or for apps in one of the jars and on the
+// runtime classpath.  It returns the output of the check, which the merged jar must depend on, or
+// nil if there is nothing to check.
+func (j *Module) checkDuplicateClasses(ctx android.ModuleContext, jars android.Paths,
+	deps deps) android.Path {
+
+	if ctx.AConfig().IsEnvFalse("CHECK_DUPLICATE_CLASSES") {
+		return nil
+	}
+
+	var runtimeClasspath android.Paths
+	if isApp(ctx) {
+		runtimeClasspath = deps.runtimeClasspath
+	}
+
+	if len(jars) < 2 && (len(jars) == 0 || len(runtimeClasspath) == 0) {
+		return nil
+	}
+
+	jarModule := func(jar android.Path) string {
+		if module, ok := deps.jarModules[jar.String()]; ok {
+			return module
+		}
+		return ctx.ModuleName()
+	}
+
+	var jarFlags []string
+	for _, jar := range jars {
+		jarFlags = append(jarFlags, "-jar "+jarModule(jar)+"="+jar.String())
+	}
+	for _, jar := range runtimeClasspath {
+		jarFlags = append(jarFlags, "-classpath "+jarModule(jar)+"="+jar.String())
+	}
+
+	stamp := android.PathForModuleOut(ctx, "check_duplicate_classes.stamp")
+	CheckDuplicateClasses(ctx, stamp, append(append(android.Paths(nil), jars...),
+		runtimeClasspath...), jarFlags, j.properties.Allowed_duplicate_classes)
+	return stamp
+}
+
+// d8Flags returns the flags passed to every d8 invocation of the module.  dxflags may still contain
+// flags for dx, the ones that d8 doesn't support are dropped.
+func (j *Module) d8Flags(ctx android.ModuleContext) string {
+	var d8Flags []string
+	for _, f := range j.deviceProperties.Dxflags {
+		switch f {
+		case "--core-library", "--dex", "--multi-dex", "--no-locals", "--no-optimize":
+			// d8 has no equivalent of these dx flags
+		default:
+			d8Flags = append(d8Flags, f)
+		}
+	}
+
+	debug := ctx.AConfig().Getenv("NO_OPTIMIZE_DX") != "" ||
+		ctx.AConfig().Getenv("GENERATE_DEX_DEBUG") != ""
+	if debug {
+		if !inList("--debug", d8Flags) {
+			d8Flags = append(d8Flags, "--debug")
+		}
+	} else if !inList("--debug", d8Flags) && !inList("--release", d8Flags) {
+		d8Flags = append(d8Flags, "--release")
+	}
+
+	d8Flags = append(d8Flags, "--min-api "+j.minSdkVersion(ctx))
+
+	return strings.Join(d8Flags, " ")
+}
+
+// minSdkVersion returns the API level that the dex files of the module are compiled for.
+func (j *Module) minSdkVersion(ctx android.BaseContext) string {
+	switch j.deviceProperties.Sdk_version {
+	case "", "current", "test_current", "system_current":
+		return strconv.Itoa(ctx.AConfig().DefaultAppTargetSdkInt())
+	default:
+		return j.deviceProperties.Sdk_version
+	}
+}
+
+// useD8 returns false if the classes are desugared with desugar and converted to dex with dx
+// instead of d8, which is selected with USE_D8=false.
+func useD8(ctx android.BaseContext) bool {
+	return ctx.AConfig().Getenv("USE_D8") != "false"
+}
+
+// compileDexArchive converts the classes compiled by the module itself and the classes of its
+// static dependencies that don't have usable dex archives into a dex archive, and merges it with
+// the dex archives of the other static dependencies.  Each class is only converted to dex once, by
+// the module that compiles it, instead of again by every app or binary that includes it.  The dex
+// archives of a library that is reached through several static dependencies are only merged once.
+func (j *Module) compileDexArchive(ctx android.ModuleContext, flags javaBuilderFlags, deps deps,
+	jars android.Paths, jarName string) android.Path {
+
+	var dexArchives android.Paths
+
+	jars = append(append(android.Paths(nil), jars...), deps.staticJarsToDex...)
+	if len(jars) > 1 || (len(jars) == 1 && len(j.stripFiles) > 0) {
+		// d8 fails on classes that are present in more than one input, combine the jars first
+		// to keep only the first copy like the implementation jar.
+		combinedJar := android.PathForModuleOut(ctx, "dex-archive", "combined", jarName)
+		TransformJarsToJar(ctx, combinedJar, "for dex archive", jars, android.OptionalPath{}, false,
+			nil, j.stripFiles, nil)
+		jars = android.Paths{combinedJar}
+	}
+	if len(jars) > 0 {
+		dexArchive := android.PathForModuleOut(ctx, "dex-archive", "classes", jarName)
+		TransformJarsToDexArchive(ctx, dexArchive, jars, flags)
+		dexArchives = append(dexArchives, dexArchive)
+	}
+
+	dexArchives = android.FirstUniquePaths(append(dexArchives, deps.staticDexArchives...))
+	j.dexArchives = dexArchives
+	j.dexMinApi = j.minSdkVersion(ctx)
+
+	if len(dexArchives) == 1 {
+		return dexArchives[0]
+	} else if len(dexArchives) > 1 {
+		dexArchive := android.PathForModuleOut(ctx, "dex-archive", "merged", jarName)
+		TransformMergeDexArchives(ctx, dexArchive, dexArchives)
+		return dexArchive
+	}
+
+	return nil
+}
+
 func (j *Module) compileDex(ctx android.ModuleContext, flags javaBuilderFlags,
 	classesJar android.Path, jarName string) android.Path {
 
-	dxFlags := j.deviceProperties.Dxflags
-	if false /* emma enabled */ {
-		// If you instrument class files that have local variable debug information in
-		// them emma does not correctly maintain the local variable table.
-		// This will cause an error when you try to convert the class files for Android.
-		// The workaround here is to build different dex file here based on emma switch
-		// then later copy into classes.dex. When emma is on, dx is run with --no-locals
-		// option to remove local variable information
-		dxFlags = append(dxFlags, "--no-locals")
+	// Compile classes.jar into classes.dex and then javalib.jar
+	javalibJar := android.PathForModuleOut(ctx, "dex", jarName)
+	if !useD8(ctx) {
+		j.compileDexWithDx(ctx, flags, javalibJar, classesJar, jarName)
+	} else if j.dexArchive != nil {
+		TransformDexArchiveToDexJar(ctx, javalibJar, j.dexArchive, classesJar, flags)
+	} else {
+		TransformClassesJarToDexJar(ctx, javalibJar, classesJar, flags)
 	}
+	if ctx.Failed() {
+		return nil
+	}
+
+	j.dexJarFile = javalibJar
+	return javalibJar
+}
+
+// compileDexWithDx desugars classesJar with desugar and converts it to dex with dx, which is the
+// fallback for d8.
+func (j *Module) compileDexWithDx(ctx android.ModuleContext, flags javaBuilderFlags,
+	javalibJar android.WritablePath, classesJar android.Path, jarName string) {
+
+	dxFlags := j.deviceProperties.Dxflags
 
 	if ctx.AConfig().Getenv("NO_OPTIMIZE_DX") != "" {
 		dxFlags = append(dxFlags, "--no-optimize")
@@ -739,14 +1134,7 @@ func (j *Module) compileDex(ctx android.ModuleContext, flags javaBuilderFlags,
 			"--dump-width=1000")
 	}
 
-	var minSdkVersion string
-	switch j.deviceProperties.Sdk_version {
-	case "", "current", "test_current", "system_current":
-		minSdkVersion = strconv.Itoa(ctx.AConfig().DefaultAppTargetSdkInt())
-	default:
-		minSdkVersion = j.deviceProperties.Sdk_version
-	}
-
+	minSdkVersion := j.minSdkVersion(ctx)
 	dxFlags = append(dxFlags, "--min-sdk-version="+minSdkVersion)
 
 	flags.dxFlags = strings.Join(dxFlags, " ")
@@ -765,19 +1153,7 @@ func (j *Module) compileDex(ctx android.ModuleContext, flags javaBuilderFlags,
 
 	desugarJar := android.PathForModuleOut(ctx, "desugar", jarName)
 	TransformDesugar(ctx, desugarJar, classesJar, flags)
-	if ctx.Failed() {
-		return nil
-	}
-
-	// Compile classes.jar into classes.dex and then javalib.jar
-	javalibJar := android.PathForModuleOut(ctx, "dex", jarName)
-	TransformClassesJarToDexJar(ctx, javalibJar, desugarJar, flags)
-	if ctx.Failed() {
-		return nil
-	}
-
-	j.dexJarFile = javalibJar
-	return javalibJar
+	TransformClassesJarToDexJarWithDx(ctx, javalibJar, desugarJar, flags)
 }
 
 func (j *Module) installable() bool {
@@ -798,6 +1174,16 @@ func (j *Module) AidlIncludeDirs() android.Paths {
 	return j.exportAidlIncludeDirs
 }
 
+var _ dexArchiveDependency = (*Module)(nil)
+
+func (j *Module) DexArchives() android.Paths {
+	return j.dexArchives
+}
+
+func (j *Module) DexMinApi() string {
+	return j.dexMinApi
+}
+
 var _ logtagsProducer = (*Module)(nil)
 
 func (j *Module) logtags() android.Paths {
@@ -816,8 +1202,14 @@ func (j *Library) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	j.compile(ctx)
 
 	if j.installable() {
+		installFile := j.outputFile
+		if ctx.Device() {
+			j.dexpreoptJarFile = j.dexpreopt(ctx, j.outputFile, "framework", ctx.ModuleName()+".jar",
+				dexpreoptArchTypes(ctx))
+			installFile = j.dexpreoptJarFile
+		}
 		j.installFile = ctx.InstallFile(android.PathForModuleInstall(ctx, "framework"),
-			ctx.ModuleName()+".jar", j.outputFile)
+			ctx.ModuleName()+".jar", installFile)
 	}
 }
 
@@ -953,7 +1345,8 @@ func (j *Import) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	j.classpathFiles = android.PathsForModuleSrc(ctx, j.properties.Jars)
 
 	outputFile := android.PathForModuleOut(ctx, "classes.jar")
-	TransformJarsToJar(ctx, outputFile, "for prebuilts", j.classpathFiles, android.OptionalPath{}, false, nil)
+	TransformJarsToJar(ctx, outputFile, "for prebuilts", j.classpathFiles, android.OptionalPath{},
+		false, nil, nil, nil)
 	j.combinedClasspathFile = outputFile
 }
 
@@ -16,7 +16,10 @@ package java
 
 import (
 	"android/soong/android"
+	"android/soong/cc"
 	"android/soong/genrule"
+	"android/soong/java/config"
+	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,12 +58,42 @@ func testJava(t *testing.T, bp string) *android.TestContext {
 }
 
 func testJavaWithEnv(t *testing.T, bp string, env map[string]string) *android.TestContext {
-	config := android.TestArchConfig(buildDir, env)
+	return testJavaWithConfig(t, bp, android.TestArchConfig(buildDir, env))
+}
+
+func testJavaWithConfig(t *testing.T, bp string, config android.Config) *android.TestContext {
+	ctx, errs := testJavaContext(bp, config)
+	fail(t, errs)
+	return ctx
+}
+
+// testJavaError runs the test context and checks that one of the errors matches pattern.
+func testJavaError(t *testing.T, pattern string, bp string) {
+	_, errs := testJavaContext(bp, android.TestArchConfig(buildDir, nil))
+	if len(errs) == 0 {
+		t.Fatalf("missing expected error %q (0 errors are returned)", pattern)
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), pattern) {
+			return
+		}
+	}
+	t.Errorf("missing expected error %q, errors:", pattern)
+	for _, err := range errs {
+		t.Errorf("  %s", err)
+	}
+}
 
+func testJavaContext(bp string, config android.Config) (*android.TestContext, []error) {
 	ctx := android.NewTestArchContext()
 	ctx.RegisterModuleType("android_app", android.ModuleFactoryAdaptor(AndroidAppFactory))
+	ctx.RegisterModuleType("android_library", android.ModuleFactoryAdaptor(AndroidLibraryFactory))
+	ctx.RegisterModuleType("android_library_import", android.ModuleFactoryAdaptor(AARImportFactory))
+	ctx.RegisterModuleType("android_app_import", android.ModuleFactoryAdaptor(AndroidAppImportFactory))
+	ctx.RegisterModuleType("android_test", android.ModuleFactoryAdaptor(AndroidTestFactory))
 	ctx.RegisterModuleType("java_library", android.ModuleFactoryAdaptor(LibraryFactory(true)))
 	ctx.RegisterModuleType("java_library_host", android.ModuleFactoryAdaptor(LibraryHostFactory))
+	ctx.RegisterModuleType("java_plugin", android.ModuleFactoryAdaptor(PluginFactory))
 	ctx.RegisterModuleType("java_import", android.ModuleFactoryAdaptor(ImportFactory))
 	ctx.RegisterModuleType("java_defaults", android.ModuleFactoryAdaptor(defaultsFactory))
 	ctx.RegisterModuleType("java_system_modules", android.ModuleFactoryAdaptor(SystemModulesFactory))
@@ -69,8 +102,11 @@ func testJavaWithEnv(t *testing.T, bp string, env map[string]string) *android.Te
 	ctx.PreArchMutators(android.RegisterPrebuiltsPreArchMutators)
 	ctx.PreArchMutators(android.RegisterPrebuiltsPostDepsMutators)
 	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
+	cc.RegisterRequiredBuildComponentsForTest(ctx)
 	ctx.Register()
 
+	bp += cc.GatherRequiredDepsForTest()
+
 	extraModules := []string{
 		"core-oj",
 		"core-libart",
@@ -114,14 +150,28 @@ func testJavaWithEnv(t *testing.T, bp string, env map[string]string) *android.Te
 	ctx.MockFileSystem(map[string][]byte{
 		"Android.bp": []byte(bp),
 		"a.java":     nil,
+		"a.c":        nil,
 		"b.java":     nil,
 		"c.java":     nil,
+		"a&b.java":   nil,
 		"b.kt":       nil,
+		"b.aidl":     nil,
 		"a.jar":      nil,
 		"b.jar":      nil,
 		"res/a":      nil,
 		"res/b":      nil,
 		"res2/a":     nil,
+		"a.aar":      nil,
+		"a.apk":      nil,
+		"b.apk":      nil,
+		"profile":    nil,
+
+		"errorprone_baseline.txt": nil,
+		"lint_baseline.xml":       nil,
+
+		"AndroidManifest.xml": nil,
+
+		"build/target/product/security/testkey": nil,
 
 		"prebuilts/sdk/14/android.jar":                nil,
 		"prebuilts/sdk/14/framework.aidl":             nil,
@@ -134,11 +184,11 @@ func testJavaWithEnv(t *testing.T, bp string, env map[string]string) *android.Te
 	})
 
 	_, errs := ctx.ParseBlueprintsFiles("Android.bp")
-	fail(t, errs)
+	if len(errs) > 0 {
+		return ctx, errs
+	}
 	_, errs = ctx.PrepareBuildActions(config)
-	fail(t, errs)
-
-	return ctx
+	return ctx, errs
 }
 
 func moduleToPath(name string) string {
@@ -625,6 +675,37 @@ func TestGeneratedSources(t *testing.T) {
 	}
 }
 
+func TestGeneratedSrcJar(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: [
+				"a.java",
+				":gen",
+			],
+		}
+
+		genrule {
+			name: "gen",
+			tool_files: ["res/a"],
+			cmd: "$(location) $(out_dir)",
+			out_dir: true,
+			out: ["gen.srcjar"],
+		}
+	`)
+
+	javac := ctx.ModuleForTests("foo", "android_common").Rule("javac")
+	genrule := ctx.ModuleForTests("gen", "").Rule("generator")
+
+	if len(javac.Inputs) != 1 || javac.Inputs[0].String() != "a.java" {
+		t.Errorf(`foo inputs %v != ["a.java"]`, javac.Inputs)
+	}
+
+	if !strings.Contains(javac.Args["srcJars"], genrule.Output.String()) {
+		t.Errorf("foo srcjars %q do not contain %q", javac.Args["srcJars"], genrule.Output)
+	}
+}
+
 func TestKotlin(t *testing.T) {
 	ctx := testJava(t, `
 		java_library {
@@ -657,6 +738,161 @@ func TestKotlin(t *testing.T) {
 	}
 }
 
+func TestPlugins(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			plugins: ["bar"],
+		}
+
+		java_library {
+			name: "baz",
+			srcs: ["a.java"],
+			plugins: ["qux"],
+		}
+
+		java_plugin {
+			name: "bar",
+			srcs: ["b.java"],
+			processor_class: "com.bar.Processor",
+		}
+
+		java_plugin {
+			name: "qux",
+			srcs: ["b.java"],
+			processor_class: "com.qux.Processor",
+			generates_api: true,
+		}
+		`)
+
+	hostVariant := android.BuildOs.String() + "_common"
+	bar := ctx.ModuleForTests("bar", hostVariant).Module().(*Plugin).ImplementationJars()[0]
+
+	javac := ctx.ModuleForTests("foo", "android_common").Rule("javac")
+	if !strings.Contains(javac.Args["javacFlags"], "-processorpath "+bar.String()) {
+		t.Errorf("foo javacFlags %q does not contain -processorpath %q",
+			javac.Args["javacFlags"], bar.String())
+	}
+	if !strings.Contains(javac.Args["javacFlags"], "-processor com.bar.Processor") {
+		t.Errorf("foo javacFlags %q does not contain -processor com.bar.Processor",
+			javac.Args["javacFlags"])
+	}
+	if !inList(bar.String(), javac.Implicits.Strings()) {
+		t.Errorf("foo javac implicits %v does not contain %q", javac.Implicits.Strings(), bar.String())
+	}
+
+	// foo uses turbine, baz doesn't because qux generates an api.
+	ctx.ModuleForTests("foo", "android_common").Rule("turbine")
+	baz := ctx.ModuleForTests("baz", "android_common").Module().(*Library)
+	if baz.HeaderJars()[0] != baz.ImplementationJars()[0] {
+		t.Errorf("baz header jar %q should be its implementation jar %q",
+			baz.HeaderJars()[0], baz.ImplementationJars()[0])
+	}
+}
+
+func TestErrorProne(t *testing.T) {
+	errorProneJar := config.ErrorProneJar
+	config.ErrorProneJar = "errorprone.jar"
+	defer func() { config.ErrorProneJar = errorProneJar }()
+
+	ctx := testJavaWithEnv(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			errorprone: {
+				javacflags: ["-XepDisableWarningsInGeneratedCode"],
+				enabled_checks: ["MissingOverride"],
+				disabled_checks: ["UnusedVariable"],
+				baseline: "errorprone_baseline.txt",
+			},
+		}
+		`, map[string]string{"RUN_ERROR_PRONE": "true"})
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	errorprone := foo.Rule("errorprone")
+	javac := foo.Rule("javac")
+
+	for _, flag := range []string{"-XepDisableWarningsInGeneratedCode", "-Xep:MissingOverride:ERROR",
+		"-Xep:UnusedVariable:OFF"} {
+		if !strings.Contains(errorprone.Args["javacFlags"], flag) {
+			t.Errorf("foo errorprone flags %q does not contain %q", errorprone.Args["javacFlags"], flag)
+		}
+		if strings.Contains(javac.Args["javacFlags"], flag) {
+			t.Errorf("foo javac flags %q should not contain %q", javac.Args["javacFlags"], flag)
+		}
+	}
+
+	findings := foo.Output("errorprone/findings.txt")
+	if findings.Input.String() != errorprone.ImplicitOutputs[0].String() {
+		t.Errorf("foo errorprone findings input %q != %q", findings.Input, errorprone.ImplicitOutputs[0])
+	}
+
+	baseline := foo.Rule("errorproneBaseline")
+	if baseline.Input.String() != findings.Output.String() ||
+		baseline.Args["baseline"] != "errorprone_baseline.txt" {
+		t.Errorf("foo errorprone baseline check of %q against %q, expected %q against %q",
+			baseline.Input, baseline.Args["baseline"], findings.Output, "errorprone_baseline.txt")
+	}
+
+	if !inList(baseline.Output.String(), javac.Implicits.Strings()) {
+		t.Errorf("foo javac implicits %v does not contain %q", javac.Implicits.Strings(),
+			baseline.Output.String())
+	}
+}
+
+func TestKapt(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java", "b.kt"],
+			annotation_processors: ["bar"],
+			annotation_processor_classes: ["com.bar.Processor"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+		}
+		`)
+
+	kapt := ctx.ModuleForTests("foo", "android_common").Rule("kapt")
+	kotlinc := ctx.ModuleForTests("foo", "android_common").Rule("kotlinc")
+	javac := ctx.ModuleForTests("foo", "android_common").Rule("javac")
+	turbine := ctx.ModuleForTests("foo", "android_common").Rule("turbine")
+	bar := ctx.ModuleForTests("bar", "android_common").Output("combined/bar.jar")
+
+	if !strings.Contains(kapt.Args["processorPath"], "apclasspath="+bar.Output.String()) {
+		t.Errorf("foo kapt processorPath %q does not contain %q",
+			kapt.Args["processorPath"], bar.Output.String())
+	}
+
+	if !strings.Contains(kapt.Args["processors"], "processors=com.bar.Processor") {
+		t.Errorf("foo kapt processors %q does not contain com.bar.Processor", kapt.Args["processors"])
+	}
+
+	if !strings.Contains(javac.Args["srcJars"], kapt.Output.String()) {
+		t.Errorf("foo javac srcJars %q does not contain %q", javac.Args["srcJars"], kapt.Output.String())
+	}
+
+	if !strings.Contains(javac.Args["javacFlags"], "-proc:none") {
+		t.Errorf("foo javac flags %q does not contain -proc:none", javac.Args["javacFlags"])
+	}
+
+	kotlinHeaderJar := kotlinc.ImplicitOutput.String()
+	if !strings.Contains(turbine.Args["classpath"], kotlinHeaderJar) ||
+		strings.Contains(turbine.Args["classpath"], kotlinc.Output.String()) {
+		t.Errorf("foo turbine classpath %q should contain %q and not %q",
+			turbine.Args["classpath"], kotlinHeaderJar, kotlinc.Output.String())
+	}
+
+	headerJar := ctx.ModuleForTests("foo", "android_common").Output("turbine-combined/foo.jar")
+	if !inList(kotlinHeaderJar, headerJar.Inputs.Strings()) {
+		t.Errorf("foo header jar inputs %v does not contain %q", headerJar.Inputs.Strings(),
+			kotlinHeaderJar)
+	}
+}
+
 func fail(t *testing.T, errs []error) {
 	if len(errs) > 0 {
 		for _, err := range errs {
@@ -665,3 +901,1013 @@ func fail(t *testing.T, errs []error) {
 		t.FailNow()
 	}
 }
+
+func TestAndroidLibraryResources(t *testing.T) {
+	ctx := testJava(t, `
+		android_library {
+			name: "foo",
+			srcs: ["a.java"],
+			resource_dirs: ["res"],
+			static_libs: ["bar", "baz"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_library {
+			name: "bar",
+			srcs: ["b.java"],
+			resource_dirs: ["res2"],
+			static_libs: ["baz"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_library_import {
+			name: "baz",
+			aars: ["a.aar"],
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common").Description("aapt create R.java")
+	bazRes := filepath.Join(buildDir, ".intermediates", "baz", "android_common", "aar", "res")
+
+	expected := "-S res -S res2 -S " + bazRes
+	if !strings.Contains(foo.Args["aaptFlags"], expected) {
+		t.Errorf("foo aaptFlags %q does not contain %q", foo.Args["aaptFlags"], expected)
+	}
+
+	if !strings.Contains(foo.Args["aaptFlags"], "--auto-add-overlay") {
+		t.Errorf("foo aaptFlags %q does not contain --auto-add-overlay", foo.Args["aaptFlags"])
+	}
+
+	javac := ctx.ModuleForTests("foo", "android_common").Rule("javac")
+	if !strings.Contains(javac.Args["srcJars"], "R.jar") {
+		t.Errorf("foo srcJars %q does not contain R.jar", javac.Args["srcJars"])
+	}
+}
+
+func TestAndroidLibraryRClasses(t *testing.T) {
+	ctx := testJava(t, `
+		android_app {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_library {
+			name: "bar",
+			srcs: ["b.java"],
+			resource_dirs: ["res"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+	`)
+
+	// The app generates the R classes of bar again with the final resource IDs, the ones compiled
+	// by bar must not be merged into the app with them.
+	barCombined := ctx.ModuleForTests("bar", "android_common").Output("combined/bar.jar")
+	for _, f := range []string{"-stripFile  'R.class'", "-stripFile  'R$$*.class'"} {
+		if !strings.Contains(barCombined.Args["jarArgs"], f) {
+			t.Errorf("bar combined jar args %q do not contain %q", barCombined.Args["jarArgs"], f)
+		}
+	}
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	fooJavac := foo.Output("javac/foo.jar")
+	check := foo.Rule("checkDuplicateClasses")
+	expected := "-jar foo=" + fooJavac.Output.String() + " -jar bar=" + barCombined.Output.String()
+	if check.Args["jarFlags"] != expected {
+		t.Errorf("foo duplicate classes jar flags %q != %q", check.Args["jarFlags"], expected)
+	}
+
+	if fooCombined := foo.Output("combined/foo.jar"); fooCombined.Args["jarArgs"] != "" {
+		t.Errorf("foo combined jar args %q should not strip any files", fooCombined.Args["jarArgs"])
+	}
+}
+
+func TestAapt2(t *testing.T) {
+	ctx := testJavaWithEnv(t, `
+		android_library {
+			name: "foo",
+			srcs: ["a.java"],
+			resource_dirs: ["res"],
+			static_libs: ["bar"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_library {
+			name: "bar",
+			srcs: ["b.java"],
+			resource_dirs: ["res2"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+			use_aapt2: false,
+		}
+	`, map[string]string{"USE_AAPT2": "true"})
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	link := foo.Rule("aapt2Link")
+
+	fooRes := filepath.Join(buildDir, ".intermediates", "foo", "android_common", "aapt2", "res.flata")
+	barRes := filepath.Join(buildDir, ".intermediates", "bar", "android_common", "aapt2", "res2.flata")
+
+	expected := barRes + " -R " + fooRes + " --auto-add-overlay"
+	if !strings.Contains(link.Args["flags"], expected) {
+		t.Errorf("foo aapt2 link flags %q does not contain %q", link.Args["flags"], expected)
+	}
+
+	if compile := foo.Output("aapt2/res.flata"); compile.Args["resDir"] != "res" {
+		t.Errorf("foo aapt2 compile resDir %q != %q", compile.Args["resDir"], "res")
+	}
+
+	// bar overrides USE_AAPT2, but its compiled resources are still available to foo.
+	bar := ctx.ModuleForTests("bar", "android_common")
+	bar.Rule("aaptCreateResourceJavaFile")
+	bar.Output("aapt2/res2.flata")
+}
+
+func TestAndroidAppImport(t *testing.T) {
+	ctx := testJava(t, `
+		android_app_import {
+			name: "foo",
+			apk: "a.apk",
+			arch: {
+				arm64: {
+					apk: "b.apk",
+				},
+			},
+			certificate: "platform",
+		}
+
+		android_app_import {
+			name: "bar",
+			apk: "a.apk",
+			presigned: true,
+			dex_preopt: {
+				profile: "profile",
+			},
+		}
+
+		android_app_import {
+			name: "baz",
+			apk: "a.apk",
+			dex_preopt: {
+				enabled: false,
+			},
+		}
+	`)
+
+	// Prebuilt apps are built for the primary device architecture only, like in Make.
+	const variant = "android_arm64_armv8-a"
+
+	foo := ctx.ModuleForTests("foo", variant)
+	strip := foo.Rule("stripApkSignatures")
+	if strip.Input.String() != "b.apk" {
+		t.Errorf("foo input %q != %q", strip.Input.String(), "b.apk")
+	}
+
+	dex2oat := foo.Output(filepath.Join("dexpreopt", "oat", "arm64", "foo.odex"))
+	if dex2oat.Input.String() != "b.apk" {
+		t.Errorf("foo dex2oat input %q != %q", dex2oat.Input.String(), "b.apk")
+	}
+	if dex2oat.Args["dexLocation"] != "/system/app/foo.apk" {
+		t.Errorf("foo dex location %q != %q", dex2oat.Args["dexLocation"], "/system/app/foo.apk")
+	}
+	foo.Output("target/product/test_device/system/app/oat/arm64/foo.odex")
+
+	// The dex files are stripped before the apk is signed again.
+	stripped := foo.Output(filepath.Join("dexpreopt", "stripped", "foo.apk"))
+	sign := foo.Rule("signapk")
+	if sign.Input.String() != stripped.Output.String() {
+		t.Errorf("foo signed apk %q != %q", sign.Input.String(), stripped.Output.String())
+	}
+	certificate := filepath.Join("build", "target", "product", "security", "platform")
+	if !strings.Contains(sign.Args["certificates"], "-cert "+certificate+".x509.pem") {
+		t.Errorf("foo certificates %q do not contain %q", sign.Args["certificates"], certificate)
+	}
+	install := foo.Output("target/product/test_device/system/app/foo.apk")
+	if install.Input.String() != sign.Output.String() {
+		t.Errorf("foo installed apk %q != %q", install.Input.String(), sign.Output.String())
+	}
+
+	// A presigned apk is compiled, but it keeps its dex files and signature.
+	bar := ctx.ModuleForTests("bar", variant)
+	dex2oat = bar.Output(filepath.Join("dexpreopt", "oat", "arm64", "bar.odex"))
+	if dex2oat.Args["compilerFilter"] != "speed-profile" {
+		t.Errorf("bar compiler filter %q != %q", dex2oat.Args["compilerFilter"], "speed-profile")
+	}
+	install = bar.Output("target/product/test_device/system/app/bar.apk")
+	if install.Input.String() != "a.apk" {
+		t.Errorf("bar installed apk %q != %q", install.Input.String(), "a.apk")
+	}
+
+	baz := ctx.ModuleForTests("baz", variant)
+	for _, p := range baz.Module().BuildParamsForTests() {
+		if strings.Contains(p.Rule.String(), "dex2oat") {
+			t.Errorf("baz was dexpreopted with dex_preopt.enabled false")
+		}
+	}
+}
+
+func TestDexpreopt(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			dex_preopt: {
+				enabled: true,
+				profile: "profile",
+			},
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	for _, arch := range []string{"arm64", "arm"} {
+		dex2oat := foo.Output(filepath.Join("dexpreopt", "oat", arch, "foo.odex"))
+		if dex2oat.Args["instructionSet"] != arch {
+			t.Errorf("foo %s instruction set %q != %q", arch, dex2oat.Args["instructionSet"], arch)
+		}
+		if dex2oat.Args["dexLocation"] != "/system/framework/foo.jar" {
+			t.Errorf("foo %s dex location %q != %q", arch, dex2oat.Args["dexLocation"],
+				"/system/framework/foo.jar")
+		}
+		if dex2oat.Args["compilerFilter"] != "speed-profile" {
+			t.Errorf("foo %s compiler filter %q != %q", arch, dex2oat.Args["compilerFilter"],
+				"speed-profile")
+		}
+	}
+	foo.Rule("profman")
+
+	foo.Output(filepath.Join("dexpreopt", "stripped", "foo.jar"))
+
+	bar := ctx.ModuleForTests("bar", "android_common")
+	for _, p := range bar.Module().BuildParamsForTests() {
+		if strings.Contains(p.Rule.String(), "dex2oat") {
+			t.Errorf("bar was dexpreopted without dex_preopt.enabled")
+		}
+	}
+}
+
+func TestAppDexpreoptArch(t *testing.T) {
+	bp := `
+		android_app {
+			name: "foo",
+			srcs: ["a.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+			dex_preopt: {
+				enabled: true,
+			},
+		}
+
+		android_app {
+			name: "bar",
+			srcs: ["a.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+			jni_libs: ["libjni32"],
+			jni_multilib: "32",
+			dex_preopt: {
+				enabled: true,
+			},
+		}
+
+		cc_library_shared {
+			name: "libjni32",
+			srcs: ["a.c"],
+			compile_multilib: "32",
+			system_shared_libs: [],
+			stl: "none",
+		}
+	`
+
+	config := android.TestArchConfig(buildDir, nil)
+	config.Targets[android.Device][0].Arch.Abi = []string{"arm64-v8a"}
+	config.Targets[android.Device][1].Arch.Abi = []string{"armeabi-v7a"}
+	ctx := testJavaWithConfig(t, bp, config)
+
+	// An app without native code runs as the primary architecture.
+	foo := ctx.ModuleForTests("foo", "android_common")
+	foo.Output(filepath.Join("dexpreopt", "oat", "arm64", "foo.odex"))
+
+	// An app that only packages 32-bit native code runs as a 32-bit process.
+	bar := ctx.ModuleForTests("bar", "android_common")
+	dex2oat := bar.Output(filepath.Join("dexpreopt", "oat", "arm", "bar.odex"))
+	if dex2oat.Args["dexLocation"] != "/system/app/bar.apk" {
+		t.Errorf("bar dex location %q != %q", dex2oat.Args["dexLocation"], "/system/app/bar.apk")
+	}
+	for _, p := range bar.Module().BuildParamsForTests() {
+		if p.Output != nil && strings.Contains(p.Output.String(), "oat/arm64") {
+			t.Errorf("bar was dexpreopted for arm64: %q", p.Output.String())
+		}
+	}
+}
+
+func TestDexArchives(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+			installable: false,
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	barArchive := filepath.Join(buildDir, ".intermediates", "bar", "android_common", "dex-archive",
+		"classes", "bar.jar")
+
+	merge := foo.Rule("mergeDexArchives")
+	if len(merge.Inputs) != 2 || merge.Inputs[1].String() != barArchive {
+		t.Errorf("foo dex archives %v do not end with %q", merge.Inputs, barArchive)
+	}
+
+	d8 := foo.Description("d8 merge")
+	if d8.Input.String() != merge.Output.String() {
+		t.Errorf("foo d8 merge input %q != %q", d8.Input.String(), merge.Output.String())
+	}
+
+	// bar's classes are converted to dex by bar, not again by foo.
+	if classes := foo.Rule("d8DexArchive"); len(classes.Inputs) != 1 ||
+		!strings.HasSuffix(classes.Inputs[0].String(), "javac/foo.jar") {
+		t.Errorf("foo dex archive inputs %v != [javac/foo.jar]", classes.Inputs)
+	}
+}
+
+func TestDexArchivesDiamond(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar", "baz"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+			static_libs: ["qux"],
+			installable: false,
+		}
+
+		java_library {
+			name: "baz",
+			srcs: ["c.java"],
+			static_libs: ["qux"],
+			installable: false,
+		}
+
+		java_library {
+			name: "qux",
+			srcs: ["a.java"],
+			installable: false,
+		}
+	`)
+
+	archive := func(name string) string {
+		return filepath.Join(buildDir, ".intermediates", name, "android_common", "dex-archive",
+			"classes", name+".jar")
+	}
+
+	// qux is reached through both bar and baz, but its dex archive is only merged once.
+	merge := ctx.ModuleForTests("foo", "android_common").Rule("mergeDexArchives")
+	expected := []string{archive("foo"), archive("bar"), archive("qux"), archive("baz")}
+	if !reflect.DeepEqual(merge.Inputs.Strings(), expected) {
+		t.Errorf("foo dex archives %v != %v", merge.Inputs.Strings(), expected)
+	}
+}
+
+func TestDexArchivesMinApi(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+			sdk_version: "14",
+			installable: false,
+		}
+	`)
+
+	// bar's dex archive was compiled for a different API level, so foo converts bar's classes
+	// again instead of merging it.
+	foo := ctx.ModuleForTests("foo", "android_common")
+	for _, p := range foo.Module().BuildParamsForTests() {
+		if p.Rule != nil && strings.Contains(p.Rule.String(), "mergeDexArchives") {
+			t.Errorf("foo merged dex archives %v compiled for another API level", p.Inputs)
+		}
+	}
+
+	barJar := filepath.Join(buildDir, ".intermediates", "bar", "android_common", "javac", "bar.jar")
+	combined := foo.Output(filepath.Join("dex-archive", "combined", "foo.jar"))
+	if !inList(barJar, combined.Inputs.Strings()) {
+		t.Errorf("foo dex archive inputs %v do not contain %q", combined.Inputs, barJar)
+	}
+}
+
+func TestDx(t *testing.T) {
+	ctx := testJavaWithEnv(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+		}
+	`, map[string]string{"USE_D8": "false"})
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	desugar := foo.Rule("desugar")
+	dx := foo.Rule("dx")
+	if dx.Input.String() != desugar.Output.String() {
+		t.Errorf("foo dx input %q != %q", dx.Input.String(), desugar.Output.String())
+	}
+	if !strings.Contains(dx.Args["dxFlags"], "--min-sdk-version=") {
+		t.Errorf("foo dx flags %q do not contain --min-sdk-version", dx.Args["dxFlags"])
+	}
+
+	for _, p := range foo.Module().BuildParamsForTests() {
+		if p.Rule != nil && strings.Contains(p.Rule.String(), "d8") {
+			t.Errorf("foo used d8 with USE_D8=false")
+		}
+	}
+}
+
+func TestCheckDuplicateClasses(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			static_libs: ["bar"],
+			allowed_duplicate_classes: ["com.foo.*"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+			installable: false,
+		}
+
+		java_library {
+			name: "baz",
+			srcs: ["c.java"],
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	javac := foo.Output("javac/foo.jar")
+	bar := ctx.ModuleForTests("bar", "android_common").Output("javac/bar.jar")
+
+	check := foo.Rule("checkDuplicateClasses")
+	expected := "-jar foo=" + javac.Output.String() + " -jar bar=" + bar.Output.String()
+	if check.Args["jarFlags"] != expected {
+		t.Errorf("foo duplicate classes jar flags %q != %q", check.Args["jarFlags"], expected)
+	}
+	if check.Args["allowFlags"] != "-allow 'com.foo.*'" {
+		t.Errorf("foo duplicate classes allow flags %q != %q", check.Args["allowFlags"],
+			"-allow 'com.foo.*'")
+	}
+
+	combined := foo.Output("combined/foo.jar")
+	if !inList(check.Output.String(), combined.Implicits.Strings()) {
+		t.Errorf("foo combined jar implicits %v do not contain %q", combined.Implicits.Strings(),
+			check.Output.String())
+	}
+
+	// baz has nothing to merge.
+	baz := ctx.ModuleForTests("baz", "android_common").Module().(*Library)
+	if !strings.HasSuffix(baz.ImplementationJars()[0].String(), "javac/baz.jar") {
+		t.Errorf("baz implementation jar %q is not the javac output", baz.ImplementationJars()[0])
+	}
+}
+
+func TestIdeInfo(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java", "b.aidl"],
+			libs: ["bar"],
+			static_libs: ["baz"],
+			java_resource_dirs: ["res"],
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+		}
+
+		java_library {
+			name: "baz",
+			srcs: ["c.java"],
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common").Module().(*Library)
+	info := foo.ideInfoForModule()
+
+	if len(info.srcs) != 2 || info.srcs[0].String() != "a.java" ||
+		!strings.HasSuffix(info.srcs[1].String(), "b.java") {
+		t.Errorf("foo ide srcs %v != [a.java, .../b.java]", info.srcs)
+	}
+
+	if !reflect.DeepEqual(info.resourceDirs.Strings(), []string{"res"}) {
+		t.Errorf("foo ide resource dirs %v != [res]", info.resourceDirs)
+	}
+
+	bar := moduleToPath("bar")
+	baz := ctx.ModuleForTests("baz", "android_common").Module().(*Library).ImplementationJars()[0]
+	if !inList(bar, info.jars.Strings()) || !inList(baz.String(), info.jars.Strings()) {
+		t.Errorf("foo ide jars %v do not contain %q and %q", info.jars, bar, baz)
+	}
+
+	if !reflect.DeepEqual(info.deps, []string{"bar", "baz"}) {
+		t.Errorf("foo ide deps %v != [bar baz]", info.deps)
+	}
+}
+
+func TestJavaSourceRoot(t *testing.T) {
+	dir := filepath.Join(buildDir, "jdeps", "roots")
+	files := map[string]string{
+		"src/com/foo/A.java":  "// comment\npackage com.foo;\n",
+		"other/B.java":        "package com.foo;\n",
+		"kotlin/com/foo/C.kt": "package com.foo\n",
+	}
+	for file, contents := range files {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		file, root string
+	}{
+		{"src/com/foo/A.java", "src"},
+		// The directory doesn't match the package.
+		{"other/B.java", "other"},
+		{"kotlin/com/foo/C.kt", "kotlin"},
+		// The file doesn't exist yet, for example because it is generated.
+		{"gen/com/foo/D.java", "gen/com/foo"},
+	}
+	for _, test := range testCases {
+		root := javaSourceRoot(filepath.Join(dir, test.file))
+		if expected := filepath.Join(dir, test.root); root != expected {
+			t.Errorf("source root of %q: %q != %q", test.file, root, expected)
+		}
+	}
+}
+
+func TestWriteIml(t *testing.T) {
+	srcRoot := filepath.Join(buildDir, "jdeps", "src&root")
+	iml := filepath.Join(buildDir, "jdeps", "ide", "foo.iml")
+	err := writeIml(iml, srcRoot, &moduleJavaDeps{
+		Srcs:         []string{"a.java", "b.aidl"},
+		Srcjars:      []string{"/out/gen/b.srcjar"},
+		ResourceDirs: []string{"res"},
+		Jars:         []string{"/out/libs/<bar>.jar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(iml)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var module struct {
+		Component struct {
+			Content []struct {
+				Url          string `xml:"url,attr"`
+				SourceFolder struct {
+					Url  string `xml:"url,attr"`
+					Type string `xml:"type,attr"`
+				} `xml:"sourceFolder"`
+			} `xml:"content"`
+			OrderEntry []struct {
+				Type string `xml:"type,attr"`
+				Root struct {
+					Url string `xml:"url,attr"`
+				} `xml:"library>CLASSES>root"`
+			} `xml:"orderEntry"`
+		} `xml:"component"`
+	}
+	if err := xml.Unmarshal(contents, &module); err != nil {
+		t.Fatalf("invalid iml: %s\n%s", err, contents)
+	}
+
+	var contentUrls []string
+	for _, content := range module.Component.Content {
+		if content.Url != content.SourceFolder.Url {
+			t.Errorf("source folder %q != content %q", content.SourceFolder.Url, content.Url)
+		}
+		contentUrls = append(contentUrls, content.Url)
+	}
+	expected := []string{
+		"file://" + srcRoot,
+		"jar:///out/gen/b.srcjar!/",
+		"file://" + filepath.Join(srcRoot, "res"),
+	}
+	if !reflect.DeepEqual(contentUrls, expected) {
+		t.Errorf("iml content %q != %q", contentUrls, expected)
+	}
+	if resType := module.Component.Content[2].SourceFolder.Type; resType != "java-resource" {
+		t.Errorf("resource dir type %q != %q", resType, "java-resource")
+	}
+
+	var jarUrls []string
+	for _, entry := range module.Component.OrderEntry {
+		if entry.Type == "module-library" {
+			jarUrls = append(jarUrls, entry.Root.Url)
+		}
+	}
+	if expected := []string{"jar:///out/libs/<bar>.jar!/"}; !reflect.DeepEqual(jarUrls, expected) {
+		t.Errorf("iml libraries %q != %q", jarUrls, expected)
+	}
+}
+
+func TestWriteModulesXml(t *testing.T) {
+	file := filepath.Join(buildDir, "jdeps", "ide", "modules.xml")
+	imls := []string{"/ide/a/foo.iml", "/ide/b&c/bar.iml"}
+	if err := writeModulesXml(file, imls); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var project struct {
+		Modules []struct {
+			FileUrl  string `xml:"fileurl,attr"`
+			FilePath string `xml:"filepath,attr"`
+		} `xml:"component>modules>module"`
+	}
+	if err := xml.Unmarshal(contents, &project); err != nil {
+		t.Fatalf("invalid modules.xml: %s\n%s", err, contents)
+	}
+
+	if len(project.Modules) != len(imls) {
+		t.Fatalf("modules.xml has %d modules instead of %d:\n%s", len(project.Modules), len(imls),
+			contents)
+	}
+	for i, iml := range imls {
+		if project.Modules[i].FilePath != iml || project.Modules[i].FileUrl != "file://"+iml {
+			t.Errorf("module %d: %q %q != %q", i, project.Modules[i].FileUrl,
+				project.Modules[i].FilePath, iml)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	ctx := testJava(t, `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			libs: ["bar"],
+			lint: {
+				extra_check_modules: ["checks"],
+				baseline_filename: "lint_baseline.xml",
+				disabled_checks: ["NewApi", "InlinedApi"],
+			},
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["b.java"],
+			lint: {
+				enabled: false,
+			},
+		}
+
+		java_library {
+			name: "baz",
+			srcs: ["c.java", "a&b.java"],
+			lint: {
+				baseline_filename: "lint_baseline.xml",
+				warnings_as_errors: false,
+			},
+		}
+
+		java_library {
+			name: "qux",
+			srcs: ["c.java"],
+			lint: {
+				warnings_as_errors: true,
+			},
+		}
+
+		java_library_host {
+			name: "checks",
+			srcs: ["c.java"],
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+	project := foo.Rule("lintProject")
+	lint := foo.Rule("lint")
+
+	checks := ctx.ModuleForTests("checks", android.BuildOs.String()+"_common").Module().(*Library)
+	for _, s := range []string{
+		`<src file="a.java" />`,
+		`<classpath jar="` + moduleToPath("bar") + `" />`,
+		`<lint-checks jar="` + checks.ImplementationJars()[0].String() + `" />`,
+	} {
+		if !strings.Contains(project.Args["project"], s) {
+			t.Errorf("foo lint project %q does not contain %q", project.Args["project"], s)
+		}
+	}
+
+	if lint.Input.String() != project.Output.String() {
+		t.Errorf("foo lint input %q != %q", lint.Input, project.Output)
+	}
+
+	expectedFlags := "--baseline lint_baseline.xml -Werror --disable NewApi,InlinedApi"
+	if lint.Args["lintFlags"] != expectedFlags {
+		t.Errorf("foo lint flags %q != %q", lint.Args["lintFlags"], expectedFlags)
+	}
+
+	bar := ctx.ModuleForTests("bar", "android_common").Module().(*Library)
+	if report := bar.lintReportFile(); report != nil {
+		t.Errorf("bar should not be linted, found report %q", report)
+	}
+
+	baz := ctx.ModuleForTests("baz", "android_common")
+	bazProject := baz.Rule("lintProject").Args["project"]
+	if s := `<src file="a&amp;b.java" />`; !strings.Contains(bazProject, s) {
+		t.Errorf("baz lint project %q does not contain %q", bazProject, s)
+	}
+	if flags := baz.Rule("lint").Args["lintFlags"]; flags != "--baseline lint_baseline.xml" {
+		t.Errorf("baz lint flags %q != %q", flags, "--baseline lint_baseline.xml")
+	}
+
+	qux := ctx.ModuleForTests("qux", "android_common")
+	if flags := qux.Rule("lint").Args["lintFlags"]; flags != "-Werror" {
+		t.Errorf("qux lint flags %q != %q", flags, "-Werror")
+	}
+}
+
+func TestJniLibs(t *testing.T) {
+	bp := `
+		android_app {
+			name: "foo",
+			srcs: ["a.java"],
+			jni_libs: ["libjni"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_app {
+			name: "bar",
+			srcs: ["a.java"],
+			jni_libs: ["libjni"],
+			use_embedded_native_libs: false,
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		cc_library_shared {
+			name: "libjni",
+			srcs: ["a.c"],
+			shared_libs: ["libdep"],
+			stl: "none",
+		}
+
+		cc_library_shared {
+			name: "libdep",
+			srcs: ["a.c"],
+			system_shared_libs: [],
+			stl: "none",
+		}
+	`
+
+	config := android.TestArchConfig(buildDir, nil)
+	config.Targets[android.Device][0].Arch.Abi = []string{"arm64-v8a"}
+	config.Targets[android.Device][1].Arch.Abi = []string{"armeabi-v7a"}
+	ctx := testJavaWithConfig(t, bp, config)
+
+	jniLib := func(name, variant string) android.Path {
+		m := ctx.ModuleForTests(name, variant).Module().(*cc.Module)
+		return m.IntermPathForModuleOut().Path()
+	}
+
+	// The shared libraries that the listed libraries depend on are packaged too, except for the
+	// ones that the platform provides through the NDK, like libc.
+	zip := ctx.ModuleForTests("foo", "android_common").Output("jnilibs.zip")
+	for _, lib := range []string{"libjni", "libdep"} {
+		lib64 := jniLib(lib, "android_arm64_armv8-a_core_shared")
+		lib32 := jniLib(lib, "android_arm_armv7-a-neon_core_shared")
+		for _, expected := range []string{
+			"-P lib/arm64-v8a -C " + filepath.Dir(lib64.String()) + " -f " + lib64.String(),
+			"-P lib/armeabi-v7a -C " + filepath.Dir(lib32.String()) + " -f " + lib32.String(),
+		} {
+			if !strings.Contains(zip.Args["args"], expected) {
+				t.Errorf("foo jni zip args %q do not contain %q", zip.Args["args"], expected)
+			}
+		}
+	}
+	if strings.Contains(zip.Args["args"], "libc.so") {
+		t.Errorf("foo jni zip args %q should not contain libc.so", zip.Args["args"])
+	}
+	if !inList(zip.Output.String(), ctx.ModuleForTests("foo", "android_common").
+		Output("resources-jni.apk").Inputs.Strings()) {
+		t.Errorf("foo jni libs are not merged into the apk")
+	}
+
+	bar := ctx.ModuleForTests("bar", "android_common")
+	for _, lib := range []string{"libjni.so", "libdep.so"} {
+		bar.Output("target/product/test_device/system/app/bar/lib/arm64/" + lib)
+		bar.Output("target/product/test_device/system/app/bar/lib/arm/" + lib)
+	}
+	bar.Output("target/product/test_device/system/app/bar.apk")
+}
+
+func TestJniLibsNoAbi(t *testing.T) {
+	testJavaError(t, `target android_arm64_armv8-a has no ABI to package "libjni.so" under`, `
+		android_app {
+			name: "foo",
+			srcs: ["a.java"],
+			jni_libs: ["libjni"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		cc_library_shared {
+			name: "libjni",
+			srcs: ["a.c"],
+			system_shared_libs: [],
+			stl: "none",
+		}
+	`)
+}
+
+func TestAndroidTest(t *testing.T) {
+	ctx := testJava(t, `
+		android_app {
+			name: "app",
+			srcs: ["a.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_test {
+			name: "foo",
+			srcs: ["b.java"],
+			instrumentation_for: "app",
+			test_suites: ["cts"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+	`)
+
+	foo := ctx.ModuleForTests("foo", "android_common")
+
+	app := ctx.ModuleForTests("app", "android_common").Module().(*AndroidApp)
+	javac := foo.Rule("javac")
+	if !strings.Contains(javac.Args["classpath"], app.HeaderJars()[0].String()) {
+		t.Errorf("foo classpath %q does not contain %q", javac.Args["classpath"],
+			app.HeaderJars()[0].String())
+	}
+
+	testConfig := foo.Output("test_config/foo.config")
+	manifest := foo.Output("manifest_fixer/AndroidManifest.xml").Output
+	if testConfig.Input.String() != manifest.String() {
+		t.Errorf("foo test config input %q != %q", testConfig.Input, manifest)
+	}
+
+	foo.Output("target/product/test_device/data/app/foo.apk")
+	foo.Output("target/product/test_device/testcases/foo/foo.apk")
+	foo.Output("target/product/test_device/testcases/foo/foo.config")
+}
+
+func TestManifestFixer(t *testing.T) {
+	ctx := testJava(t, `
+		android_app {
+			name: "foo",
+			srcs: ["a.java"],
+			libs: ["org.apache.http.legacy", "bar"],
+			package_name: "com.android.foo",
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		android_app {
+			name: "baz",
+			srcs: ["a.java"],
+			sdk_version: "14",
+		}
+
+		android_library {
+			name: "lib",
+			srcs: ["a.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		java_library {
+			name: "org.apache.http.legacy",
+			srcs: ["b.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+
+		java_library {
+			name: "bar",
+			srcs: ["c.java"],
+			no_standard_libs: true,
+			system_modules: "core-system-modules",
+		}
+	`)
+
+	testCases := []struct {
+		module string
+		args   string
+	}{
+		{
+			module: "foo",
+			args: "-minSdkVersion 26 -targetSdkVersion 26 -uses-library org.apache.http.legacy " +
+				"-package com.android.foo",
+		},
+		{
+			module: "baz",
+			args:   "-minSdkVersion 14 -targetSdkVersion 14",
+		},
+	}
+
+	for _, testCase := range testCases {
+		module := ctx.ModuleForTests(testCase.module, "android_common")
+		fixer := module.Rule("manifestFixer")
+		if fixer.Args["args"] != testCase.args {
+			t.Errorf("%s manifest fixer args %q != %q", testCase.module, fixer.Args["args"],
+				testCase.args)
+		}
+
+		aapt := module.Description("aapt package")
+		if !strings.Contains(aapt.Args["aaptFlags"], "-M "+fixer.Output.String()) {
+			t.Errorf("%s aapt flags %q do not use the fixed manifest %q", testCase.module,
+				aapt.Args["aaptFlags"], fixer.Output)
+		}
+	}
+
+	lib := ctx.ModuleForTests("lib", "android_common")
+	for _, p := range lib.Module().BuildParamsForTests() {
+		if p.Rule == manifestFixer {
+			t.Errorf("android_library should not run the manifest fixer")
+		}
+	}
+}
+
+func TestManifestSdkVersion(t *testing.T) {
+	testCases := []struct {
+		name       string
+		final      bool
+		codenames  []string
+		sdkVersion string
+		expected   string
+	}{
+		{name: "current", sdkVersion: "current", expected: "26"},
+		{name: "codename", codenames: []string{"P"}, expected: "P"},
+		{name: "codename system", codenames: []string{"O", "P"}, sdkVersion: "system_current",
+			expected: "P"},
+		{name: "final", final: true, codenames: []string{"P"}, sdkVersion: "test_current",
+			expected: "26"},
+		{name: "numbered", codenames: []string{"P"}, sdkVersion: "14", expected: "14"},
+		{name: "system numbered", codenames: []string{"P"}, sdkVersion: "system_14", expected: "14"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := android.TestConfig(buildDir, nil)
+			config.ProductVariables.Platform_sdk_final = &testCase.final
+			config.ProductVariables.Platform_version_active_codenames = testCase.codenames
+
+			if got := manifestSdkVersion(config, testCase.sdkVersion); got != testCase.expected {
+				t.Errorf("manifestSdkVersion(%q) = %q, expected %q", testCase.sdkVersion, got,
+					testCase.expected)
+			}
+		})
+	}
+}
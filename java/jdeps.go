@@ -0,0 +1,308 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This singleton collects the sources and dependencies of all java modules when
+// SOONG_COLLECT_JAVA_DEPS is set, and writes them to module_bp_java_deps.json in the build
+// directory along with an IntelliJ .iml file for each module.  Setting SOONG_IDE_AGGREGATE_DIRS to
+// a colon separated list of directories also writes an IntelliJ project containing the modules in
+// those directories.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+func JDepsGeneratorSingleton() blueprint.Singleton {
+	return &jdepsGeneratorSingleton{}
+}
+
+type jdepsGeneratorSingleton struct{}
+
+const (
+	jdepsJsonFilename       = "module_bp_java_deps.json"
+	intellijOutputDirectory = "development/ide/intellij"
+	intellijAggregateName   = "aggregate"
+
+	// Environment variables used to modify behavior of this singleton.
+	envVariableCollectJavaDeps  = "SOONG_COLLECT_JAVA_DEPS"
+	envVariableIdeAggregateDirs = "SOONG_IDE_AGGREGATE_DIRS"
+)
+
+// ideInfo contains the sources and dependencies of a java module that are needed to set it up in
+// an IDE.
+type ideInfo struct {
+	// source files, including the java files generated from other sources
+	srcs android.Paths
+	// generated srcjars, for example from aidl, proto, logtags or R.java
+	srcJars      android.Paths
+	resourceDirs android.Paths
+	// header jars of the libraries the module compiles against and implementation jars of its
+	// static libraries
+	jars android.Paths
+	// names of the libs and static_libs
+	deps []string
+}
+
+// moduleJavaDeps is the entry of a module in module_bp_java_deps.json.
+type moduleJavaDeps struct {
+	Path         []string `json:"path"`
+	Srcs         []string `json:"srcs"`
+	Srcjars      []string `json:"srcjars"`
+	ResourceDirs []string `json:"resource_dirs"`
+	Jars         []string `json:"jars"`
+	Dependencies []string `json:"dependencies"`
+}
+
+type ideInfoProvider interface {
+	ideInfoForModule() *ideInfo
+}
+
+var _ ideInfoProvider = (*Module)(nil)
+
+func (j *Module) ideInfoForModule() *ideInfo {
+	return &j.ideInfo
+}
+
+func (j *jdepsGeneratorSingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
+	config := ctx.Config().(android.Config)
+	// Using android.Config.Getenv instead of os.Getenv to guarantee soong will re-run in case
+	// these environment variables change.
+	if !config.IsEnvTrue(envVariableCollectJavaDeps) {
+		return
+	}
+
+	moduleDeps := make(map[string]*moduleJavaDeps)
+	ctx.VisitAllModules(func(module blueprint.Module) {
+		provider, ok := module.(ideInfoProvider)
+		if !ok {
+			return
+		}
+		info := provider.ideInfoForModule()
+		name := ctx.ModuleName(module)
+
+		// Host and device variants of a module share an entry.
+		d := moduleDeps[name]
+		if d == nil {
+			d = &moduleJavaDeps{}
+			moduleDeps[name] = d
+		}
+		d.Path = appendUnique(d.Path, ctx.ModuleDir(module))
+		d.Srcs = appendUnique(d.Srcs, info.srcs.Strings()...)
+		d.Srcjars = appendUnique(d.Srcjars, info.srcJars.Strings()...)
+		d.ResourceDirs = appendUnique(d.ResourceDirs, info.resourceDirs.Strings()...)
+		d.Jars = appendUnique(d.Jars, info.jars.Strings()...)
+		d.Dependencies = appendUnique(d.Dependencies, info.deps...)
+	})
+
+	jsonFile := filepath.Join(config.BuildDir(), jdepsJsonFilename)
+	if err := writeJavaDeps(jsonFile, moduleDeps); err != nil {
+		ctx.Errorf("%s", err)
+		return
+	}
+
+	srcRoot, _ := filepath.Abs(android.PathForSource(ctx).String())
+	outDir := filepath.Join(filepath.Dir(config.BuildDir()), intellijOutputDirectory)
+
+	var aggregateDirs []string
+	if dirs := config.Getenv(envVariableIdeAggregateDirs); dirs != "" {
+		aggregateDirs = strings.Split(dirs, ":")
+	}
+
+	var aggregateImls []string
+	var names []string
+	for name := range moduleDeps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := moduleDeps[name]
+		iml := filepath.Join(outDir, d.Path[0], name+".iml")
+		if err := writeIml(iml, srcRoot, d); err != nil {
+			ctx.Errorf("%s", err)
+			return
+		}
+
+		for _, dir := range aggregateDirs {
+			if d.Path[0] == dir || strings.HasPrefix(d.Path[0], dir+"/") {
+				aggregateImls = append(aggregateImls, iml)
+				break
+			}
+		}
+	}
+
+	if len(aggregateDirs) > 0 {
+		modulesXml := filepath.Join(outDir, intellijAggregateName, ".idea", "modules.xml")
+		if err := writeModulesXml(modulesXml, aggregateImls); err != nil {
+			ctx.Errorf("%s", err)
+		}
+	}
+}
+
+// appendUnique appends the strings that are not already in list to list.
+func appendUnique(list []string, strs ...string) []string {
+	for _, s := range strs {
+		if !inList(s, list) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func writeJavaDeps(file string, moduleDeps map[string]*moduleJavaDeps) error {
+	buf, err := json.MarshalIndent(moduleDeps, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal java deps: %s", err)
+	}
+	return writeIdeFile(file, string(buf)+"\n")
+}
+
+func writeIdeFile(file, contents string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(contents), 0666)
+}
+
+var javaPackageRegexp = regexp.MustCompile(`^\s*package\s+([\w.]+)\s*;?`)
+
+// javaSourceRoot returns the directory that the package of a java or kotlin source file is
+// relative to, or the directory of the file if its package can't be read, for example because it
+// hasn't been generated yet.
+func javaSourceRoot(path string) string {
+	dir := filepath.Dir(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return dir
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if match := javaPackageRegexp.FindStringSubmatch(scanner.Text()); match != nil {
+			pkgDir := strings.Replace(match[1], ".", "/", -1)
+			if strings.HasSuffix(dir, "/"+pkgDir) {
+				return strings.TrimSuffix(dir, "/"+pkgDir)
+			}
+			return dir
+		}
+	}
+	return dir
+}
+
+// writeIml writes an IntelliJ module file for the module, with the source roots of its sources,
+// its srcjars and resource directories, and its jars as libraries.
+func writeIml(file, srcRoot string, d *moduleJavaDeps) error {
+	url := func(path string) string {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(srcRoot, path)
+		}
+		return xmlEscape("file://" + path)
+	}
+	jarUrl := func(path string) string {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(srcRoot, path)
+		}
+		return xmlEscape("jar://" + path + "!/")
+	}
+
+	sourceRoots := make(map[string]bool)
+	for _, src := range d.Srcs {
+		if ext := filepath.Ext(src); ext == ".java" || ext == ".kt" {
+			sourceRoots[javaSourceRoot(filepath.Join(srcRoot, src))] = true
+		}
+	}
+	var sortedSourceRoots []string
+	for root := range sourceRoots {
+		sortedSourceRoots = append(sortedSourceRoots, root)
+	}
+	sort.Strings(sortedSourceRoots)
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<module type="JAVA_MODULE" version="4">` + "\n")
+	buf.WriteString(`  <component name="NewModuleRootManager" inherit-compiler-output="true">` + "\n")
+	buf.WriteString(`    <exclude-output />` + "\n")
+
+	for _, root := range sortedSourceRoots {
+		fmt.Fprintf(&buf, `    <content url="%s">`+"\n", url(root))
+		fmt.Fprintf(&buf, `      <sourceFolder url="%s" isTestSource="false" />`+"\n", url(root))
+		buf.WriteString(`    </content>` + "\n")
+	}
+	for _, srcJar := range d.Srcjars {
+		fmt.Fprintf(&buf, `    <content url="%s">`+"\n", jarUrl(srcJar))
+		fmt.Fprintf(&buf, `      <sourceFolder url="%s" isTestSource="false" />`+"\n", jarUrl(srcJar))
+		buf.WriteString(`    </content>` + "\n")
+	}
+	for _, dir := range d.ResourceDirs {
+		fmt.Fprintf(&buf, `    <content url="%s">`+"\n", url(dir))
+		fmt.Fprintf(&buf, `      <sourceFolder url="%s" type="java-resource" />`+"\n", url(dir))
+		buf.WriteString(`    </content>` + "\n")
+	}
+
+	buf.WriteString(`    <orderEntry type="inheritedJdk" />` + "\n")
+	buf.WriteString(`    <orderEntry type="sourceFolder" forTests="false" />` + "\n")
+	for _, jar := range d.Jars {
+		buf.WriteString(`    <orderEntry type="module-library">` + "\n")
+		buf.WriteString(`      <library>` + "\n")
+		fmt.Fprintf(&buf, `        <CLASSES><root url="%s" /></CLASSES>`+"\n", jarUrl(jar))
+		buf.WriteString(`      </library>` + "\n")
+		buf.WriteString(`    </orderEntry>` + "\n")
+	}
+	buf.WriteString(`  </component>` + "\n")
+	buf.WriteString(`</module>` + "\n")
+
+	return writeIdeFile(file, buf.String())
+}
+
+// writeModulesXml writes the list of modules of an IntelliJ project.
+func writeModulesXml(file string, imls []string) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<project version="4">` + "\n")
+	buf.WriteString(`  <component name="ProjectModuleManager">` + "\n")
+	buf.WriteString(`    <modules>` + "\n")
+	for _, iml := range imls {
+		fmt.Fprintf(&buf, `      <module fileurl="file://%s" filepath="%s" />`+"\n", xmlEscape(iml),
+			xmlEscape(iml))
+	}
+	buf.WriteString(`    </modules>` + "\n")
+	buf.WriteString(`  </component>` + "\n")
+	buf.WriteString(`</project>` + "\n")
+
+	return writeIdeFile(file, buf.String())
+}
+
+// xmlEscape escapes a string to be used as the value of an XML attribute.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
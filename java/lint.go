@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+// This file contains the rules for running Android lint over java modules.  Lint is not part of
+// the normal build, the reports of all modules are built by the lint-check goal.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
+
+	"android/soong/android"
+)
+
+var (
+	// lintProject writes the project description that tells lint where the sources, resources
+	// and jars of the module are.
+	lintProject = pctx.AndroidStaticRule("lintProject",
+		blueprint.RuleParams{
+			Command:        `cp $out.rsp $out`,
+			Rspfile:        "$out.rsp",
+			RspfileContent: "$project",
+		},
+		"project")
+
+	lint = pctx.AndroidStaticRule("lint",
+		blueprint.RuleParams{
+			Command: `rm -rf $cacheDir && mkdir -p $cacheDir && ` +
+				`${config.LintCmd} --quiet --project $in --cache-dir $cacheDir ` +
+				`--xml $out --html $html $lintFlags --exitcode`,
+			CommandDeps: []string{"${config.LintCmd}"},
+		},
+		"cacheDir", "html", "lintFlags")
+)
+
+func (j *Module) lintEnabled(ctx android.ModuleContext) bool {
+	return ctx.Device() && proptools.BoolDefault(j.properties.Lint.Enabled, true)
+}
+
+// lint adds the rules to run lint over the sources, resources and manifest of the module.  It
+// checks the implementation jar of the module against its classpath.
+func (j *Module) lint(ctx android.ModuleContext, srcFiles android.Paths, deps deps) {
+	var project []string
+	var inputs android.Paths
+	add := func(tag, attr string, paths ...android.Path) {
+		for _, path := range paths {
+			project = append(project, fmt.Sprintf(`<%s %s="%s" />`, tag, attr,
+				xmlEscape(path.String())))
+			inputs = append(inputs, path)
+		}
+	}
+
+	project = append(project, `<?xml version="1.0" encoding="utf-8"?>`, `<project>`,
+		`<root dir="." />`)
+	project = append(project, fmt.Sprintf(`<module name="%s" android="true" library="%t">`,
+		xmlEscape(ctx.ModuleName()), !isApp(ctx)))
+
+	if j.lintManifest != nil {
+		add("manifest", "file", j.lintManifest)
+	}
+	add("src", "file", srcFiles.FilterByExt(".java")...)
+	add("src", "file", srcFiles.FilterByExt(".kt")...)
+	add("resource", "file", j.lintResources...)
+	add("classes", "jar", j.implementationJarFile)
+	add("classpath", "jar", deps.bootClasspath...)
+	add("classpath", "jar", deps.classpath...)
+	add("lint-checks", "jar", deps.lintCheckJars...)
+
+	project = append(project, `</module>`, `</project>`)
+
+	projectXml := android.PathForModuleOut(ctx, "lint", "project.xml")
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        lintProject,
+		Description: "lint project",
+		Output:      projectXml,
+		Args: map[string]string{
+			"project": strings.Join(project, " "),
+		},
+	})
+
+	var lintFlags []string
+	if j.properties.Lint.Baseline_filename != nil {
+		baseline := android.PathForModuleSrc(ctx, *j.properties.Lint.Baseline_filename)
+		lintFlags = append(lintFlags, "--baseline "+baseline.String())
+		inputs = append(inputs, baseline)
+	}
+	if proptools.BoolDefault(j.properties.Lint.Warnings_as_errors,
+		j.properties.Lint.Baseline_filename != nil) {
+		lintFlags = append(lintFlags, "-Werror")
+	}
+	if len(j.properties.Lint.Disabled_checks) > 0 {
+		lintFlags = append(lintFlags, "--disable "+strings.Join(j.properties.Lint.Disabled_checks, ","))
+	}
+
+	report := android.PathForModuleOut(ctx, "lint", "lint-report.xml")
+	html := android.PathForModuleOut(ctx, "lint", "lint-report.html")
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:           lint,
+		Description:    "lint",
+		Output:         report,
+		ImplicitOutput: html,
+		Input:          projectXml,
+		Implicits:      inputs,
+		Args: map[string]string{
+			"cacheDir":  android.PathForModuleOut(ctx, "lint", "cache").String(),
+			"html":      html.String(),
+			"lintFlags": strings.Join(lintFlags, " "),
+		},
+	})
+
+	j.lintReport = report
+}
+
+func isApp(ctx android.ModuleContext) bool {
+	switch ctx.Module().(type) {
+	case *AndroidApp, *AndroidTest:
+		return true
+	default:
+		return false
+	}
+}
+
+func LintCheckSingleton() blueprint.Singleton {
+	return &lintCheckSingleton{}
+}
+
+type lintReportProducer interface {
+	lintReportFile() android.Path
+}
+
+var _ lintReportProducer = (*Module)(nil)
+
+func (j *Module) lintReportFile() android.Path {
+	return j.lintReport
+}
+
+// lintCheckSingleton adds the lint-check goal, which runs lint over all modules that enable it.
+type lintCheckSingleton struct{}
+
+func (l *lintCheckSingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
+	var reports android.Paths
+	ctx.VisitAllModules(func(module blueprint.Module) {
+		if producer, ok := module.(lintReportProducer); ok {
+			if report := producer.lintReportFile(); report != nil {
+				reports = append(reports, report)
+			}
+		}
+	})
+
+	ctx.Build(pctx, blueprint.BuildParams{
+		Rule:     blueprint.Phony,
+		Outputs:  []string{"lint-check"},
+		Inputs:   reports.Strings(),
+		Optional: true,
+	})
+}
@@ -17,23 +17,41 @@ package phony
 import (
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
+	"github.com/google/blueprint"
+
 	"android/soong/android"
 )
 
+var pctx = android.NewPackageContext("android/soong/phony")
+
 func init() {
 	android.RegisterModuleType("phony", phonyFactory)
+	android.RegisterSingletonType("phony", phonySingletonFactory)
+}
+
+type phonyProperties struct {
+	// names of modules to install for the host only, in addition to the modules listed in
+	// required, which are installed for every architecture they are built for
+	Host_required []string
+
+	// names of modules to install for the device only
+	Target_required []string
 }
 
 type phony struct {
 	android.ModuleBase
+	properties phonyProperties
+
 	requiredModuleNames []string
 }
 
 func phonyFactory() android.Module {
 	module := &phony{}
 
+	module.AddProperties(&module.properties)
 	android.InitAndroidModule(module)
 	return module
 }
@@ -43,11 +61,21 @@ func (p *phony) DepsMutator(ctx android.BottomUpMutatorContext) {
 
 func (p *phony) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	p.requiredModuleNames = ctx.RequiredModuleNames()
-	if len(p.requiredModuleNames) == 0 {
+	if len(p.requiredModuleNames) == 0 && len(p.properties.Host_required) == 0 &&
+		len(p.properties.Target_required) == 0 {
 		ctx.PropertyErrorf("required", "phony must not have empty required dependencies in order to be useful(and therefore permitted).")
 	}
 }
 
+// phonyTarget returns the name of the ninja phony target for a phony module.  When Soong is
+// embedded in Make the module name is used by the Make phony package, which depends on this target.
+func phonyTarget(config android.Config, name string) string {
+	if config.EmbeddedInMake() {
+		return name + "-soong"
+	}
+	return name
+}
+
 func (p *phony) AndroidMk() android.AndroidMkData {
 	return android.AndroidMkData{
 		Custom: func(w io.Writer, name, prefix, moduleDir string, data android.AndroidMkData) {
@@ -55,7 +83,105 @@ func (p *phony) AndroidMk() android.AndroidMkData {
 			fmt.Fprintln(w, "LOCAL_PATH :=", moduleDir)
 			fmt.Fprintln(w, "LOCAL_MODULE :=", name)
 			fmt.Fprintln(w, "LOCAL_REQUIRED_MODULES := "+strings.Join(p.requiredModuleNames, " "))
+			if len(p.properties.Host_required) > 0 {
+				fmt.Fprintln(w, "LOCAL_HOST_REQUIRED_MODULES := "+
+					strings.Join(p.properties.Host_required, " "))
+			}
+			if len(p.properties.Target_required) > 0 {
+				fmt.Fprintln(w, "LOCAL_TARGET_REQUIRED_MODULES := "+
+					strings.Join(p.properties.Target_required, " "))
+			}
 			fmt.Fprintln(w, "include $(BUILD_PHONY_PACKAGE)")
+			fmt.Fprintln(w, name+":", name+"-soong")
 		},
 	}
 }
+
+func phonySingletonFactory() blueprint.Singleton {
+	return &phonySingleton{}
+}
+
+// phonySingleton creates a ninja phony target for each phony module that depends on the installed
+// files of the modules it requires.  The installed files of all the variants of a module are only
+// known once every module has been generated, so the targets are created by a singleton.
+type phonySingleton struct{}
+
+// installedFiles are the files installed by all the variants of a module.
+type installedFiles struct {
+	host, device android.Paths
+}
+
+func (s *phonySingleton) GenerateBuildActions(ctx blueprint.SingletonContext) {
+	config := ctx.Config().(android.Config)
+
+	installed := make(map[string]*installedFiles)
+	var phonies []blueprint.Module
+	ctx.VisitAllModules(func(module blueprint.Module) {
+		if _, ok := module.(*phony); ok {
+			phonies = append(phonies, module)
+			return
+		}
+
+		m, ok := module.(android.Module)
+		if !ok || !m.Enabled() {
+			return
+		}
+		name := ctx.ModuleName(module)
+		files := installed[name]
+		if files == nil {
+			files = &installedFiles{}
+			installed[name] = files
+		}
+		if m.Target().Os.Class == android.Device {
+			files.device = append(files.device, m.FilesToInstall()...)
+		} else {
+			files.host = append(files.host, m.FilesToInstall()...)
+		}
+	})
+
+	for _, module := range phonies {
+		p := module.(*phony)
+		if !p.Enabled() {
+			continue
+		}
+
+		var deps []string
+		addDeps := func(property string, names []string, host, device bool) {
+			for _, name := range names {
+				files := installed[name]
+				if files == nil {
+					// Modules that Soong does not know about may be defined in Make, which
+					// installs them through the required modules of the Make phony package.
+					if !config.EmbeddedInMake() && !config.AllowMissingDependencies() {
+						ctx.ModuleErrorf(module, "%s: unknown module %q", property, name)
+					}
+					continue
+				}
+				if host {
+					deps = append(deps, files.host.Strings()...)
+				}
+				if device {
+					deps = append(deps, files.device.Strings()...)
+				}
+			}
+		}
+		addDeps("required", p.requiredModuleNames, true, true)
+		addDeps("host_required", p.properties.Host_required, true, false)
+		addDeps("target_required", p.properties.Target_required, false, true)
+
+		sort.Strings(deps)
+		var uniqueDeps []string
+		for i, dep := range deps {
+			if i == 0 || dep != deps[i-1] {
+				uniqueDeps = append(uniqueDeps, dep)
+			}
+		}
+
+		ctx.Build(pctx, blueprint.BuildParams{
+			Rule:      blueprint.Phony,
+			Outputs:   []string{phonyTarget(config, ctx.ModuleName(module))},
+			Implicits: uniqueDeps,
+			Optional:  config.EmbeddedInMake(),
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phony
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+)
+
+var buildDir string
+
+func setUp() {
+	var err error
+	buildDir, err = ioutil.TempDir("", "soong_phony_test")
+	if err != nil {
+		panic(err)
+	}
+}
+
+func tearDown() {
+	os.RemoveAll(buildDir)
+}
+
+func TestMain(m *testing.M) {
+	run := func() int {
+		setUp()
+		defer tearDown()
+
+		return m.Run()
+	}
+
+	os.Exit(run())
+}
+
+// hostVariant is the variant of the installer modules for the build machine.
+var hostVariant = android.BuildOs.String() + "_x86_64"
+
+func testPhonyContext(bp string) (*android.TestContext, []error) {
+	config := android.TestArchConfig(buildDir, nil)
+
+	ctx := android.NewTestArchContext()
+	ctx.RegisterModuleType("phony", android.ModuleFactoryAdaptor(phonyFactory))
+	ctx.RegisterModuleType("installer", android.ModuleFactoryAdaptor(installerFactory))
+	ctx.RegisterSingletonType("phony", phonySingletonFactory)
+	ctx.Register()
+
+	bp += `
+		installer {
+			name: "foo",
+		}
+
+		installer {
+			name: "bar",
+		}
+	`
+
+	ctx.MockFileSystem(map[string][]byte{
+		"Android.bp": []byte(bp),
+	})
+
+	_, errs := ctx.ParseBlueprintsFiles("Android.bp")
+	if len(errs) > 0 {
+		return ctx, errs
+	}
+	_, errs = ctx.PrepareBuildActions(config)
+	return ctx, errs
+}
+
+func testPhony(t *testing.T, bp string) *android.TestContext {
+	ctx, errs := testPhonyContext(bp)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			t.Error(err)
+		}
+		t.FailNow()
+	}
+	return ctx
+}
+
+// phonyDeps returns the dependencies of the ninja phony target with the given name.
+func phonyDeps(t *testing.T, ctx *android.TestContext, name string) []string {
+	buf := &bytes.Buffer{}
+	if err := ctx.WriteBuildFile(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ninja := strings.Replace(buf.String(), " $\n", " ", -1)
+	for _, line := range strings.Split(ninja, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "build" || fields[1] != name+":" ||
+			fields[2] != "phony" {
+			continue
+		}
+		var deps []string
+		for _, field := range fields[3:] {
+			if field != "|" {
+				deps = append(deps, field)
+			}
+		}
+		sort.Strings(deps)
+		return deps
+	}
+	t.Fatalf("missing phony target %q", name)
+	return nil
+}
+
+func TestFilesToInstall(t *testing.T) {
+	ctx := testPhony(t, "")
+
+	host := ctx.ModuleForTests("foo", hostVariant).Module().FilesToInstall()
+	if len(host) != 1 || !strings.Contains(host[0].String(), "/host/") ||
+		!strings.HasSuffix(host[0].String(), "/bin/foo") {
+		t.Errorf("expected the host variant of foo to install host/<os>-x86/bin/foo, got %q", host)
+	}
+
+	device := ctx.ModuleForTests("foo", "android_arm64_armv8-a").Module().FilesToInstall()
+	if len(device) != 1 || !strings.HasSuffix(device[0].String(),
+		"/target/product/test_device/system/bin/foo") {
+		t.Errorf("expected the device variant of foo to install system/bin/foo, got %q", device)
+	}
+}
+
+func TestPhonySingleton(t *testing.T) {
+	ctx := testPhony(t, `
+		phony {
+			name: "all",
+			required: ["foo"],
+		}
+
+		phony {
+			name: "host",
+			host_required: ["foo", "bar"],
+		}
+
+		phony {
+			name: "device",
+			target_required: ["foo"],
+		}
+
+		phony {
+			name: "mixed",
+			required: ["foo"],
+			host_required: ["bar", "foo"],
+			target_required: ["bar"],
+		}
+	`)
+
+	installed := func(name, variant string) string {
+		return ctx.ModuleForTests(name, variant).Module().FilesToInstall()[0].String()
+	}
+	fooHost := installed("foo", hostVariant)
+	fooDevice := installed("foo", "android_arm64_armv8-a")
+	barHost := installed("bar", hostVariant)
+	barDevice := installed("bar", "android_arm64_armv8-a")
+
+	testCases := []struct {
+		phony string
+		deps  []string
+	}{
+		{phony: "all", deps: []string{fooDevice, fooHost}},
+		{phony: "host", deps: []string{barHost, fooHost}},
+		{phony: "device", deps: []string{fooDevice}},
+		{phony: "mixed", deps: []string{barDevice, barHost, fooDevice, fooHost}},
+	}
+
+	for _, testCase := range testCases {
+		sort.Strings(testCase.deps)
+		if deps := phonyDeps(t, ctx, testCase.phony); !reflect.DeepEqual(deps, testCase.deps) {
+			t.Errorf("expected %s to depend on %q, got %q", testCase.phony, testCase.deps, deps)
+		}
+	}
+}
+
+func TestPhonyErrors(t *testing.T) {
+	testCases := []struct {
+		bp  string
+		err string
+	}{
+		{
+			bp: `
+				phony {
+					name: "all",
+					required: ["baz"],
+				}
+			`,
+			err: `required: unknown module "baz"`,
+		},
+		{
+			bp: `
+				phony {
+					name: "all",
+					target_required: ["baz"],
+				}
+			`,
+			err: `target_required: unknown module "baz"`,
+		},
+		{
+			bp: `
+				phony {
+					name: "all",
+				}
+			`,
+			err: "phony must not have empty required dependencies",
+		},
+	}
+
+	for _, testCase := range testCases {
+		_, errs := testPhonyContext(testCase.bp)
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), testCase.err) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing expected error %q, errors are %q", testCase.err, errs)
+		}
+	}
+}
+
+func TestPhonyAndroidMk(t *testing.T) {
+	ctx := testPhony(t, `
+		phony {
+			name: "all",
+			required: ["foo"],
+			host_required: ["bar"],
+			target_required: ["foo", "bar"],
+		}
+	`)
+
+	p := ctx.ModuleForTests("all", "").Module().(*phony)
+	buf := &bytes.Buffer{}
+	p.AndroidMk().Custom(buf, "all", "", "dir", android.AndroidMkData{})
+
+	for _, expected := range []string{
+		"LOCAL_REQUIRED_MODULES := foo\n",
+		"LOCAL_HOST_REQUIRED_MODULES := bar\n",
+		"LOCAL_TARGET_REQUIRED_MODULES := foo bar\n",
+		"include $(BUILD_PHONY_PACKAGE)\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected Android.mk to contain %q, got:\n%s", expected, buf.String())
+		}
+	}
+}
+
+type installer struct {
+	android.ModuleBase
+}
+
+func installerFactory() android.Module {
+	module := &installer{}
+	android.InitAndroidArchModule(module, android.HostAndDeviceSupported, android.MultilibFirst)
+	return module
+}
+
+func (i *installer) DepsMutator(ctx android.BottomUpMutatorContext) {
+}
+
+func (i *installer) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	ctx.InstallFile(android.PathForModuleInstall(ctx, "bin"), ctx.ModuleName(),
+		android.PathForModuleOut(ctx, ctx.ModuleName()))
+}
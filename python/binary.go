@@ -35,6 +35,7 @@ type BinaryProperties struct {
 	// this file must also be listed in srcs.
 	// If left unspecified, module name is used instead.
 	// If name doesn’t match any filename in srcs, main must be specified.
+	// Tests that have neither run the unittest tests in their srcs.
 	Main string `android:"arch_variant"`
 
 	// set the name of the output binary.
@@ -60,6 +61,7 @@ func (binary *binaryDecorator) install(ctx android.ModuleContext, file android.P
 
 var (
 	stubTemplateHost = "build/soong/python/scripts/stub_template_host.txt"
+	testMainTemplate = "build/soong/python/scripts/test_main_template.txt"
 )
 
 func NewBinary(hod android.HostOrDeviceSupported) (*Module, *binaryDecorator) {
@@ -84,12 +86,28 @@ func (binary *binaryDecorator) bootstrapperProps() []interface{} {
 
 func (binary *binaryDecorator) bootstrap(ctx android.ModuleContext, actual_version string,
 	embedded_launcher bool, srcsPathMappings []pathMapping, parSpec parSpec,
-	depsPyRunfiles []string, depsParSpecs []parSpec) android.OptionalPath {
+	depsPyRunfiles []string, depsParSpecs []parSpec,
+	precompiledZips android.Paths) android.OptionalPath {
 	// no Python source file for compiling .par file.
 	if len(srcsPathMappings) == 0 {
 		return android.OptionalPath{}
 	}
 
+	main := binary.getPyMainFile(ctx, srcsPathMappings)
+	if main == "" {
+		return android.OptionalPath{}
+	}
+
+	return binary.bootstrapPar(ctx, actual_version, embedded_launcher, main, srcsPathMappings,
+		parSpec, depsPyRunfiles, depsParSpecs, precompiledZips)
+}
+
+// bootstrapPar registers the build actions for the .par executable whose main program is at the
+// runfiles path main.
+func (binary *binaryDecorator) bootstrapPar(ctx android.ModuleContext, actual_version string,
+	embedded_launcher bool, main string, srcsPathMappings []pathMapping, parSpec parSpec,
+	depsPyRunfiles []string, depsParSpecs []parSpec,
+	precompiledZips android.Paths) android.OptionalPath {
 	// the runfiles packages needs to be populated with "__init__.py".
 	newPyPkgs := []string{}
 	// the set to de-duplicate the new Python packages above.
@@ -128,11 +146,6 @@ func (binary *binaryDecorator) bootstrap(ctx android.ModuleContext, actual_versi
 		populateNewPyPkgs(parentPath, existingPyPkgSet, newPyPkgSet, &newPyPkgs)
 	}
 
-	main := binary.getPyMainFile(ctx, srcsPathMappings)
-	if main == "" {
-		return android.OptionalPath{}
-	}
-
 	var launcher_path android.Path
 	if embedded_launcher {
 		ctx.VisitDirectDeps(func(m blueprint.Module) {
@@ -151,7 +164,7 @@ func (binary *binaryDecorator) bootstrap(ctx android.ModuleContext, actual_versi
 
 	binFile := registerBuildActionForParFile(ctx, embedded_launcher, launcher_path,
 		binary.getHostInterpreterName(ctx, actual_version),
-		main, binary.getStem(ctx), newPyPkgs, append(depsParSpecs, parSpec))
+		main, binary.getStem(ctx), newPyPkgs, append(depsParSpecs, parSpec), precompiledZips)
 
 	return android.OptionalPathForPath(binFile)
 }
@@ -176,19 +189,31 @@ func (binary *binaryDecorator) getHostInterpreterName(ctx android.ModuleContext,
 // find main program path within runfiles tree.
 func (binary *binaryDecorator) getPyMainFile(ctx android.ModuleContext,
 	srcsPathMappings []pathMapping) string {
-	var main string
+	if main := binary.findPyMainFile(ctx, srcsPathMappings); main != "" {
+		return main
+	}
+	ctx.PropertyErrorf("main", "%q is not listed in srcs.", binary.mainSrc(ctx))
+
+	return ""
+}
+
+// the source path of the main program.
+func (binary *binaryDecorator) mainSrc(ctx android.ModuleContext) string {
 	if binary.binaryProperties.Main == "" {
-		main = ctx.ModuleName() + pyExt
-	} else {
-		main = binary.binaryProperties.Main
+		return ctx.ModuleName() + pyExt
 	}
+	return binary.binaryProperties.Main
+}
 
+// find main program path within runfiles tree, or "" if it is not listed in srcs.
+func (binary *binaryDecorator) findPyMainFile(ctx android.ModuleContext,
+	srcsPathMappings []pathMapping) string {
+	main := binary.mainSrc(ctx)
 	for _, path := range srcsPathMappings {
 		if main == path.src.Rel() {
 			return path.dest
 		}
 	}
-	ctx.PropertyErrorf("main", "%q is not listed in srcs.", main)
 
 	return ""
 }
@@ -29,25 +29,46 @@ import (
 var (
 	pctx = android.NewPackageContext("android/soong/python")
 
+	// The par files are reproducible: soong_zip writes all the entries with the same timestamp,
+	// and merge_zips sorts them.
 	host_par = pctx.AndroidStaticRule("host_par",
 		blueprint.RuleParams{
-			Command: `touch $initFile && ` +
-				`sed -e 's/%interpreter%/$interp/g' -e 's/%main%/$main/g' $template > $stub && ` +
-				`$parCmd -o $parFile $parArgs && echo '#!/usr/bin/env python' | cat - $parFile > $out && ` +
-				`chmod +x $out && (rm -f $initFile; rm -f $stub; rm -f $parFile)`,
-			CommandDeps: []string{"$parCmd", "$template"},
+			Command: `sed -e 's/%interpreter%/$interp/g' -e 's/%main%/$main/g' $template > $stub && ` +
+				`$parCmd -o ${parFile}.unsorted $parArgs && ` +
+				`$mergeZipsCmd -s $parFile ${parFile}.unsorted && ` +
+				`echo '#!/usr/bin/env $interp' | cat - $parFile > $out && ` +
+				`chmod +x $out && (rm -f $stub; rm -f ${parFile}.unsorted $parFile)`,
+			CommandDeps: []string{"$parCmd", "$mergeZipsCmd", "$template"},
 		},
-		"initFile", "interp", "main", "template", "stub", "parCmd", "parFile", "parArgs")
+		"interp", "main", "template", "stub", "parCmd", "parFile", "parArgs")
 
 	embedded_par = pctx.AndroidStaticRule("embedded_par",
 		blueprint.RuleParams{
-			Command: `touch $initFile && ` +
-				`echo '$main' > $entry_point && ` +
-				`$parCmd -o $parFile $parArgs && cat $launcher | cat - $parFile > $out && ` +
-				`chmod +x $out && (rm -f $initFile; rm -f $entry_point; rm -f $parFile)`,
-			CommandDeps: []string{"$parCmd"},
+			Command: `echo '$main' > $entry_point && ` +
+				`$parCmd -o ${parFile}.unsorted $parArgs && ` +
+				`$mergeZipsCmd -s $parFile ${parFile}.unsorted $precompiledZips && ` +
+				`cat $launcher | cat - $parFile > $out && ` +
+				`chmod +x $out && (rm -f $entry_point; rm -f ${parFile}.unsorted $parFile)`,
+			CommandDeps: []string{"$parCmd", "$mergeZipsCmd"},
 		},
-		"initFile", "main", "entry_point", "parCmd", "parFile", "parArgs", "launcher")
+		"main", "entry_point", "parCmd", "parFile", "parArgs", "launcher", "precompiledZips")
+
+	// The .pyc files are compiled by the same Python 3 as the embedded launcher, so that they
+	// are valid for the interpreter that runs them. They are hash-based .pyc files (PEP 552),
+	// so the script fails if py3-cmd is older than Python 3.7.
+	precompile = pctx.AndroidStaticRule("precompile",
+		blueprint.RuleParams{
+			Command:     `$py3Cmd $precompileScript $out $srcs`,
+			CommandDeps: []string{"$py3Cmd", "$precompileScript"},
+		},
+		"srcs")
+
+	test_main = pctx.AndroidStaticRule("test_main",
+		blueprint.RuleParams{
+			Command:     `sed -e 's/%name%/$name/g' -e 's/%test_modules%/$testModules/g' $template > $out`,
+			CommandDeps: []string{"$template"},
+		},
+		"name", "testModules", "template")
 )
 
 func init() {
@@ -55,6 +76,9 @@ func init() {
 	pctx.Import("android/soong/common")
 
 	pctx.HostBinToolVariable("parCmd", "soong_zip")
+	pctx.HostBinToolVariable("mergeZipsCmd", "merge_zips")
+	pctx.HostBinToolVariable("py3Cmd", "py3-cmd")
+	pctx.SourcePathVariable("precompileScript", "build/soong/python/scripts/precompile_python.py")
 }
 
 type fileListSpec struct {
@@ -100,12 +124,69 @@ func registerBuildActionForModuleFileList(ctx android.ModuleContext,
 	return fileList
 }
 
+// registerBuildActionForTestMain generates the main program of a test, which runs the tests in the
+// given Python modules.
+func registerBuildActionForTestMain(ctx android.ModuleContext, testModules []string) android.Path {
+	testMain := android.PathForModuleOut(ctx, "test_main", testMainFileName)
+
+	var quoted []string
+	for _, m := range testModules {
+		quoted = append(quoted, `"`+m+`"`)
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        test_main,
+		Description: "python test main",
+		Output:      testMain,
+		Args: map[string]string{
+			"name":        ctx.ModuleName(),
+			"testModules": strings.Join(quoted, ", "),
+			"template":    android.PathForSource(ctx, testMainTemplate).String(),
+		},
+	})
+
+	return testMain
+}
+
+// registerBuildActionForPrecompile compiles the Python 3 files of a module to .pyc files, and
+// returns the zip file that contains them at their runfiles paths.
+func registerBuildActionForPrecompile(ctx android.ModuleContext,
+	srcsPathMappings []pathMapping) android.Path {
+	precompiledZip := android.PathForModuleOut(ctx, ctx.ModuleName()+".pyc.zip")
+
+	srcs := []string{}
+	implicits := android.Paths{}
+	for _, path := range srcsPathMappings {
+		srcs = append(srcs, path.src.String()+":"+path.dest)
+		implicits = append(implicits, path.src)
+	}
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        precompile,
+		Description: "precompile python",
+		Output:      precompiledZip,
+		Implicits:   implicits,
+		Args: map[string]string{
+			"srcs": strings.Join(srcs, " "),
+		},
+	})
+
+	return precompiledZip
+}
+
 func registerBuildActionForParFile(ctx android.ModuleContext, embedded_launcher bool,
 	launcher_path android.Path, interpreter, main, binName string,
-	newPyPkgs []string, parSpecs []parSpec) android.Path {
+	newPyPkgs []string, parSpecs []parSpec, precompiledZips android.Paths) android.Path {
 
-	// .intermediate output path for __init__.py
-	initFile := android.PathForModuleOut(ctx, initFileName).String()
+	// .intermediate output path for __init__.py, an empty file. Its timestamp does not end up
+	// in the par file, since soong_zip writes all the entries with the same timestamp.
+	initFilePath := android.PathForModuleOut(ctx, initFileName)
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        android.Touch,
+		Description: "generate " + initFilePath.Rel(),
+		Output:      initFilePath,
+	})
+	initFile := initFilePath.String()
 
 	// .intermediate output path for par file.
 	parFile := android.PathForModuleOut(ctx, binName+parFileExt)
@@ -114,7 +195,7 @@ func registerBuildActionForParFile(ctx android.ModuleContext, embedded_launcher
 	binFile := android.PathForModuleOut(ctx, binName)
 
 	// implicit dependency for parFile build action.
-	implicits := android.Paths{}
+	implicits := android.Paths{initFilePath}
 	for _, p := range parSpecs {
 		for _, f := range p.fileListSpecs {
 			implicits = append(implicits, f.fileList)
@@ -146,8 +227,7 @@ func registerBuildActionForParFile(ctx android.ModuleContext, embedded_launcher
 			Output:      binFile,
 			Implicits:   implicits,
 			Args: map[string]string{
-				"initFile": initFile,
-				"interp":   strings.Replace(interpreter, "/", `\/`, -1),
+				"interp": strings.Replace(interpreter, "/", `\/`, -1),
 				// we need remove "runfiles/" suffix since stub script starts
 				// searching for main file in each sub-dir of "runfiles" directory tree.
 				"main": strings.Replace(strings.TrimPrefix(main, runFiles+"/"),
@@ -161,6 +241,7 @@ func registerBuildActionForParFile(ctx android.ModuleContext, embedded_launcher
 	} else {
 		// added launcher_path to the implicits Ninja dependencies.
 		implicits = append(implicits, launcher_path)
+		implicits = append(implicits, precompiledZips...)
 
 		// .intermediate output path for entry_point.txt
 		entryPoint := android.PathForModuleOut(ctx, entryPointFile).String()
@@ -175,12 +256,12 @@ func registerBuildActionForParFile(ctx android.ModuleContext, embedded_launcher
 			Output:      binFile,
 			Implicits:   implicits,
 			Args: map[string]string{
-				"initFile":    initFile,
-				"main":        main,
-				"entry_point": entryPoint,
-				"parFile":     parFile.String(),
-				"parArgs":     strings.Join(parArgs, " "),
-				"launcher":    launcher_path.String(),
+				"main":            main,
+				"entry_point":     entryPoint,
+				"parFile":         parFile.String(),
+				"parArgs":         strings.Join(parArgs, " "),
+				"launcher":        launcher_path.String(),
+				"precompiledZips": strings.Join(precompiledZips.Strings(), " "),
 			},
 		})
 	}
@@ -22,6 +22,8 @@ import (
 
 type pythonInstaller struct {
 	dir string
+	// the directory within dir to install into, if any.
+	relative string
 
 	path android.OutputPath
 }
@@ -34,7 +36,10 @@ func NewPythonInstaller(dir string) *pythonInstaller {
 
 var _ installer = (*pythonInstaller)(nil)
 
+func (installer *pythonInstaller) installDir(ctx android.ModuleContext) android.OutputPath {
+	return android.PathForModuleInstall(ctx, installer.dir, installer.relative)
+}
+
 func (installer *pythonInstaller) install(ctx android.ModuleContext, file android.Path) {
-	installer.path = ctx.InstallFile(android.PathForModuleInstall(ctx, installer.dir),
-		file.Base(), file)
+	installer.path = ctx.InstallFile(installer.installDir(ctx), file.Base(), file)
 }
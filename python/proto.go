@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package python
+
+// This file contains the build actions for compiling the .proto files in srcs to Python.
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+func init() {
+	pctx.HostBinToolVariable("protocCmd", "aprotoc")
+}
+
+var (
+	proto = pctx.AndroidStaticRule("protoc",
+		blueprint.RuleParams{
+			Command:     "$protocCmd --python_out=$outDir $protoFlags $in",
+			CommandDeps: []string{"$protocCmd"},
+		}, "protoFlags", "outDir")
+
+	protoExt        = ".proto"
+	protoRuntimeLib = "libprotobuf-python"
+)
+
+// genProto creates a rule to convert a .proto file to a generated _pb2.py file, and returns the
+// generated file along with its path relative to the package path of the module.
+func genProto(ctx android.ModuleContext, protoFile android.Path,
+	protoFlags string) (pyFile android.Path, rel string) {
+
+	// protoc places the generated file at the path of the .proto file within the output
+	// directory, while the file is packaged at its path relative to the module like the other
+	// srcs.
+	outFile := android.PathForModuleGen(ctx, "proto",
+		strings.TrimSuffix(protoFile.String(), protoExt)+"_pb2"+pyExt)
+
+	ctx.ModuleBuild(pctx, android.ModuleBuildParams{
+		Rule:        proto,
+		Description: "protoc " + protoFile.Rel(),
+		Output:      outFile,
+		Input:       protoFile,
+		Args: map[string]string{
+			"outDir":     android.ProtoDir(ctx).String(),
+			"protoFlags": protoFlags,
+		},
+	})
+
+	return outFile, strings.TrimSuffix(protoFile.Rel(), protoExt) + "_pb2" + pyExt
+}
+
+// protoDeps returns libs with the Python protobuf runtime library added if srcs contain .proto
+// files.
+func protoDeps(srcs, libs []string) []string {
+	for _, src := range srcs {
+		if filepath.Ext(src) == protoExt {
+			for _, lib := range libs {
+				if lib == protoRuntimeLib {
+					return libs
+				}
+			}
+			return append(libs, protoRuntimeLib)
+		}
+	}
+	return libs
+}
@@ -40,7 +40,7 @@ type VersionProperties struct {
 	// true, if the module is required to be built with this version.
 	Enabled *bool `android:"arch_variant"`
 
-	// non-empty list of .py files under this strict Python version.
+	// non-empty list of .py and .proto files under this strict Python version.
 	// srcs may reference the outputs of other modules that produce source files like genrule
 	// or filegroup using the syntax ":module".
 	Srcs []string `android:"arch_variant"`
@@ -53,7 +53,7 @@ type VersionProperties struct {
 	Libs []string `android:"arch_variant"`
 
 	// true, if the binary is required to be built with embedded launcher.
-	// TODO(nanzhang): Remove this flag when embedded Python3 is supported later.
+	// The Python3 files of binaries with an embedded launcher are also precompiled to .pyc files.
 	Embedded_launcher *bool `android:"arch_variant"`
 }
 
@@ -72,6 +72,8 @@ type BaseProperties struct {
 
 	// list of source (.py) files compatible both with Python2 and Python3 used to compile the
 	// Python module.
+	// .proto files are compiled to _pb2.py files placed at the path of the .proto file under
+	// pkg_path, and add a dependency on the Python protobuf runtime library.
 	// srcs may reference the outputs of other modules that produce source files like genrule
 	// or filegroup using the syntax ":module".
 	// Srcs has to be non-empty.
@@ -111,7 +113,8 @@ type Module struct {
 	android.ModuleBase
 	android.DefaultableModuleBase
 
-	properties BaseProperties
+	properties      BaseProperties
+	protoProperties android.ProtoProperties
 
 	// initialize before calling Init
 	hod      android.HostOrDeviceSupported
@@ -144,6 +147,12 @@ type Module struct {
 	// the soong_zip arguments for zipping current module source/data files.
 	parSpec parSpec
 
+	// the zip of the .pyc files compiled from current module Python3 files.
+	precompiledZip android.OptionalPath
+
+	// the zips of the .pyc files of all its dependencies.
+	depsPrecompiledZips android.Paths
+
 	subAndroidMkOnce map[subAndroidMkProvider]bool
 }
 
@@ -158,7 +167,8 @@ type bootstrapper interface {
 	bootstrapperProps() []interface{}
 	bootstrap(ctx android.ModuleContext, Actual_version string, embedded_launcher bool,
 		srcsPathMappings []pathMapping, parSpec parSpec,
-		depsPyRunfiles []string, depsParSpecs []parSpec) android.OptionalPath
+		depsPyRunfiles []string, depsParSpecs []parSpec,
+		precompiledZips android.Paths) android.OptionalPath
 }
 
 type installer interface {
@@ -169,6 +179,7 @@ type PythonDependency interface {
 	GetSrcsPathMappings() []pathMapping
 	GetDataPathMappings() []pathMapping
 	GetParSpec() parSpec
+	GetPrecompiledZip() android.OptionalPath
 }
 
 func (p *Module) GetSrcsPathMappings() []pathMapping {
@@ -183,13 +194,17 @@ func (p *Module) GetParSpec() parSpec {
 	return p.parSpec
 }
 
+func (p *Module) GetPrecompiledZip() android.OptionalPath {
+	return p.precompiledZip
+}
+
 var _ PythonDependency = (*Module)(nil)
 
 var _ android.AndroidMkDataProvider = (*Module)(nil)
 
 func (p *Module) Init() android.Module {
 
-	p.AddProperties(&p.properties)
+	p.AddProperties(&p.properties, &p.protoProperties)
 	if p.bootstrapper != nil {
 		p.AddProperties(p.bootstrapper.bootstrapperProps()...)
 	}
@@ -214,6 +229,7 @@ var (
 	pyVersion3         = "PY3"
 	initFileName       = "__init__.py"
 	mainFileName       = "__main__.py"
+	testMainFileName   = "__soong_test_main__.py"
 	entryPointFile     = "entry_point.txt"
 	parFileExt         = ".zip"
 	runFiles           = "runfiles"
@@ -264,9 +280,11 @@ func (p *Module) DepsMutator(ctx android.BottomUpMutatorContext) {
 		// deps from "version.py2.srcs" property.
 		android.ExtractSourcesDeps(ctx, p.properties.Version.Py2.Srcs)
 
-		ctx.AddVariationDependencies(nil, pythonLibTag,
-			uniqueLibs(ctx, p.properties.Libs, "version.py2.libs",
-				p.properties.Version.Py2.Libs)...)
+		libs := uniqueLibs(ctx, p.properties.Libs, "version.py2.libs",
+			p.properties.Version.Py2.Libs)
+		libs = protoDeps(p.properties.Srcs, libs)
+		libs = protoDeps(p.properties.Version.Py2.Srcs, libs)
+		ctx.AddVariationDependencies(nil, pythonLibTag, libs...)
 
 		if p.bootstrapper != nil && p.isEmbeddedLauncherEnabled(pyVersion2) {
 			ctx.AddVariationDependencies(nil, pythonLibTag, "py2-stdlib")
@@ -279,14 +297,17 @@ func (p *Module) DepsMutator(ctx android.BottomUpMutatorContext) {
 		// deps from "version.py3.srcs" property.
 		android.ExtractSourcesDeps(ctx, p.properties.Version.Py3.Srcs)
 
-		ctx.AddVariationDependencies(nil, pythonLibTag,
-			uniqueLibs(ctx, p.properties.Libs, "version.py3.libs",
-				p.properties.Version.Py3.Libs)...)
+		libs := uniqueLibs(ctx, p.properties.Libs, "version.py3.libs",
+			p.properties.Version.Py3.Libs)
+		libs = protoDeps(p.properties.Srcs, libs)
+		libs = protoDeps(p.properties.Version.Py3.Srcs, libs)
+		ctx.AddVariationDependencies(nil, pythonLibTag, libs...)
 
 		if p.bootstrapper != nil && p.isEmbeddedLauncherEnabled(pyVersion3) {
-			//TODO(nanzhang): Add embedded launcher for Python3.
-			ctx.PropertyErrorf("version.py3.embedded_launcher",
-				"is not supported yet for Python3.")
+			ctx.AddVariationDependencies(nil, pythonLibTag, "py3-stdlib")
+			ctx.AddFarVariationDependencies([]blueprint.Variation{
+				{"arch", ctx.Target().String()},
+			}, launcherTag, "py3-launcher")
 		}
 	default:
 		panic(fmt.Errorf("unknown Python Actual_version: %q for module: %q.",
@@ -326,15 +347,22 @@ func (p *Module) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	p.GeneratePythonBuildActions(ctx)
 
 	if p.bootstrapper != nil {
-		// TODO(nanzhang): Since embedded launcher is not supported for Python3 for now,
-		// so we initialize "embedded_launcher" to false.
-		embedded_launcher := false
-		if p.properties.Actual_version == pyVersion2 {
-			embedded_launcher = p.isEmbeddedLauncherEnabled(pyVersion2)
+		embedded_launcher := p.isEmbeddedLauncherEnabled(p.properties.Actual_version)
+
+		// .pyc files are only packaged with the embedded Python3 launcher, as the interpreter
+		// that compiles them must be the one that runs them.  Python2 .pyc files are checked
+		// against the modification times of the sources, which are not reproducible.
+		var precompiledZips android.Paths
+		if embedded_launcher && p.properties.Actual_version == pyVersion3 {
+			if p.precompiledZip.Valid() {
+				precompiledZips = append(precompiledZips, p.precompiledZip.Path())
+			}
+			precompiledZips = append(precompiledZips, p.depsPrecompiledZips...)
 		}
+
 		p.installSource = p.bootstrapper.bootstrap(ctx, p.properties.Actual_version,
 			embedded_launcher, p.srcsPathMappings, p.parSpec, p.depsPyRunfiles,
-			p.depsParSpecs)
+			p.depsParSpecs, precompiledZips)
 	}
 
 	if p.installer != nil && p.installSource.Valid() {
@@ -398,6 +426,12 @@ func (p *Module) GeneratePythonBuildActions(ctx android.ModuleContext) {
 
 	p.parSpec = p.dumpFileList(ctx, pkg_path)
 
+	// the .pyc files are only built if a binary with an embedded launcher packages them.
+	if p.properties.Actual_version == pyVersion3 && len(p.srcsPathMappings) > 0 {
+		p.precompiledZip = android.OptionalPathForPath(
+			registerBuildActionForPrecompile(ctx, p.srcsPathMappings))
+	}
+
 	p.uniqWholeRunfilesTree(ctx)
 }
 
@@ -410,12 +444,17 @@ func (p *Module) genModulePathMappings(ctx android.ModuleContext, pkg_path strin
 	destToPySrcs := make(map[string]string)
 	destToPyData := make(map[string]string)
 
+	protoFlags := strings.Join(android.ProtoFlags(ctx, &p.protoProperties), " ")
+
 	for _, s := range expandedSrcs {
-		if s.Ext() != pyExt {
+		rel := s.Rel()
+		if s.Ext() == protoExt {
+			s, rel = genProto(ctx, s, protoFlags)
+		} else if s.Ext() != pyExt {
 			ctx.PropertyErrorf("srcs", "found non (.py) file: %q!", s.String())
 			continue
 		}
-		runfilesPath := filepath.Join(pkg_path, s.Rel())
+		runfilesPath := filepath.Join(pkg_path, rel)
 		identifiers := strings.Split(strings.TrimSuffix(runfilesPath, pyExt), "/")
 		for _, token := range identifiers {
 			if !pyIdentifierRegexp.MatchString(token) {
@@ -451,11 +490,12 @@ func (p *Module) dumpFileList(ctx android.ModuleContext, pkg_path string) parSpe
 
 	pathMappings := append(p.srcsPathMappings, p.dataPathMappings...)
 
-	// "srcs" or "data" properties may have filegroup so it might happen that
-	// the relative root for each source path is different.
+	// "srcs" or "data" properties may have filegroup or generated .proto files so it might
+	// happen that the relative root for each source path is different.
 	for _, path := range pathMappings {
 		var relativeRoot string
-		relativeRoot = strings.TrimSuffix(path.src.String(), path.src.Rel())
+		relativeRoot = strings.TrimSuffix(path.src.String(),
+			strings.TrimPrefix(path.dest, pkg_path+"/"))
 		if v, found := relativeRootMap[relativeRoot]; found {
 			relativeRootMap[relativeRoot] = append(v, path.src)
 		} else {
@@ -539,6 +579,9 @@ func (p *Module) uniqWholeRunfilesTree(ctx android.ModuleContext) {
 			// binary needs the soong_zip arguments from all its
 			// dependencies to generate executable par file.
 			p.depsParSpecs = append(p.depsParSpecs, dep.GetParSpec())
+			if zip := dep.GetPrecompiledZip(); zip.Valid() {
+				p.depsPrecompiledZips = append(p.depsPrecompiledZips, zip.Path())
+			}
 		}
 	})
 }
@@ -467,3 +467,302 @@ func fail(t *testing.T, errs []error) {
 		t.FailNow()
 	}
 }
+
+func TestPythonTest(t *testing.T) {
+	config, buildDir := setupBuildEnv(t)
+	defer tearDownBuildEnv(buildDir)
+
+	ctx := android.NewTestArchContext()
+	ctx.PreDepsMutators(func(ctx android.RegisterMutatorsContext) {
+		ctx.BottomUp("version_split", versionSplitMutator()).Parallel()
+	})
+	ctx.RegisterModuleType("python_test_host",
+		android.ModuleFactoryAdaptor(PythonTestHostFactory))
+	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
+	ctx.Register()
+	ctx.MockFileSystem(map[string][]byte{
+		bpFile: []byte(`
+			python_test_host {
+				name: "foo",
+				pkg_path: "foo",
+				srcs: ["foo_test.py", "util/bar_test.py"],
+				data: ["testdata/input.txt"],
+				test_suites: ["vts"],
+				test_config: "AndroidTest.xml",
+			}
+
+			python_test_host {
+				name: "baz",
+				srcs: ["baz.py", "baz_test.py"],
+			}
+		`),
+		"foo_test.py":        nil,
+		"util/bar_test.py":   nil,
+		"testdata/input.txt": nil,
+		"AndroidTest.xml":    nil,
+		"baz.py":             nil,
+		"baz_test.py":        nil,
+		testMainTemplate:     nil,
+		stubTemplateHost:     nil,
+	})
+	_, errs := ctx.ParseBlueprintsFiles(bpFile)
+	fail(t, errs)
+	_, errs = ctx.PrepareBuildActions(config)
+	fail(t, errs)
+
+	variant := android.BuildOs.String() + "_x86_64_PY3"
+	foo := ctx.ModuleForTests("foo", variant)
+
+	testMain := foo.Rule("test_main")
+	if expected := `"foo.foo_test", "foo.util.bar_test"`; testMain.Args["testModules"] != expected {
+		t.Errorf("foo testModules %q, expected %q", testMain.Args["testModules"], expected)
+	}
+	par := foo.Rule("host_par")
+	if par.Args["main"] != testMainFileName {
+		t.Errorf("foo main %q, expected %q", par.Args["main"], testMainFileName)
+	}
+
+	hostOut := "host/linux-x86"
+	if android.BuildOs == android.Darwin {
+		hostOut = "host/darwin-x86"
+	}
+	for _, dir := range []string{
+		hostOut + "/nativetest/foo",
+		hostOut + "/testcases/foo",
+		hostOut + "/vts/android-vts/testcases",
+	} {
+		foo.Output(dir + "/foo")
+		foo.Output(dir + "/foo.config")
+		foo.Output(dir + "/testdata/input.txt")
+	}
+
+	// baz has a main program named after the module, so it does not get a generated one.
+	baz := ctx.ModuleForTests("baz", variant)
+	if main := baz.Rule("host_par").Args["main"]; main != "baz.py" {
+		t.Errorf("baz main %q, expected %q", main, "baz.py")
+	}
+	baz.Output(hostOut + "/nativetest/baz/baz")
+}
+
+func TestPythonProto(t *testing.T) {
+	config, buildDir := setupBuildEnv(t)
+	defer tearDownBuildEnv(buildDir)
+
+	ctx := android.NewTestContext()
+	ctx.PreDepsMutators(func(ctx android.RegisterMutatorsContext) {
+		ctx.BottomUp("version_split", versionSplitMutator()).Parallel()
+	})
+	ctx.RegisterModuleType("python_library_host",
+		android.ModuleFactoryAdaptor(PythonLibraryHostFactory))
+	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
+	ctx.Register()
+	ctx.MockFileSystem(map[string][]byte{
+		bpFile: []byte(`subdirs = ["dir"]`),
+		filepath.Join("dir", bpFile): []byte(`
+			python_library_host {
+				name: "libprotobuf-python",
+				pkg_path: "google/protobuf",
+				srcs: ["protobuf.py"],
+				version: {
+					py2: {
+						enabled: true,
+					},
+				},
+			}
+
+			python_library_host {
+				name: "lib",
+				pkg_path: "a",
+				srcs: ["lib.py", "protos/foo.proto"],
+				version: {
+					py2: {
+						enabled: true,
+					},
+				},
+			}
+		`),
+		filepath.Join("dir", "protobuf.py"):      nil,
+		filepath.Join("dir", "lib.py"):           nil,
+		filepath.Join("dir", "protos/foo.proto"): nil,
+	})
+	_, errs := ctx.ParseBlueprintsFiles(bpFile)
+	fail(t, errs)
+	_, errs = ctx.PrepareBuildActions(config)
+	fail(t, errs)
+
+	for _, variant := range []string{pyVersion2, pyVersion3} {
+		lib := ctx.ModuleForTests("lib", variant)
+
+		protoc := lib.Rule("protoc")
+		if protoc.Input.String() != "dir/protos/foo.proto" {
+			t.Errorf("%s protoc input %q, expected %q", variant, protoc.Input,
+				"dir/protos/foo.proto")
+		}
+		expectedOut := filepath.Join(buildDir, ".intermediates/dir/lib", variant,
+			"gen/proto/dir/protos/foo_pb2.py")
+		if protoc.Output.String() != expectedOut {
+			t.Errorf("%s protoc output %q, expected %q", variant, protoc.Output, expectedOut)
+		}
+
+		base := lib.Module().(*Module)
+		var pyRunfiles []string
+		for _, path := range base.srcsPathMappings {
+			pyRunfiles = append(pyRunfiles, path.dest)
+		}
+		expectedRunfiles := []string{"runfiles/a/lib.py", "runfiles/a/protos/foo_pb2.py"}
+		if !reflect.DeepEqual(pyRunfiles, expectedRunfiles) {
+			t.Errorf("%s pyRunfiles %q, expected %q", variant, pyRunfiles, expectedRunfiles)
+		}
+
+		// the generated file is zipped relative to the directory of the .proto file.
+		expectedRoot := filepath.Join(buildDir, ".intermediates/dir/lib", variant,
+			"gen/proto/dir") + "/"
+		foundRoot := false
+		for _, spec := range base.parSpec.fileListSpecs {
+			if spec.relativeRoot == expectedRoot {
+				foundRoot = true
+			}
+		}
+		if !foundRoot {
+			t.Errorf("%s parSpec %q does not have relative root %q", variant,
+				base.parSpec.soongParArgs(), expectedRoot)
+		}
+
+		// the generated files are precompiled along with the other Python3 files.
+		if variant == pyVersion3 {
+			srcs := lib.Output("lib.pyc.zip").Args["srcs"]
+			if !strings.Contains(srcs, ":runfiles/a/protos/foo_pb2.py") {
+				t.Errorf("%s precompiled srcs %q do not contain %q", variant, srcs,
+					"runfiles/a/protos/foo_pb2.py")
+			}
+		}
+
+		expectedDepsRunfiles := []string{"runfiles/google/protobuf/protobuf.py"}
+		if !reflect.DeepEqual(base.depsPyRunfiles, expectedDepsRunfiles) {
+			t.Errorf("%s depsPyRunfiles %q, expected %q", variant, base.depsPyRunfiles,
+				expectedDepsRunfiles)
+		}
+	}
+}
+
+func TestPythonEmbeddedLauncher(t *testing.T) {
+	_, buildDir := setupBuildEnv(t)
+	defer tearDownBuildEnv(buildDir)
+	config := android.TestArchConfig(buildDir, nil)
+
+	ctx := android.NewTestArchContext()
+	ctx.PreDepsMutators(func(ctx android.RegisterMutatorsContext) {
+		ctx.BottomUp("version_split", versionSplitMutator()).Parallel()
+	})
+	ctx.RegisterModuleType("python_library_host",
+		android.ModuleFactoryAdaptor(PythonLibraryHostFactory))
+	ctx.RegisterModuleType("python_binary_host",
+		android.ModuleFactoryAdaptor(PythonBinaryHostFactory))
+	ctx.RegisterModuleType("launcher", android.ModuleFactoryAdaptor(newLauncherModule))
+	ctx.PreArchMutators(android.RegisterDefaultsPreArchMutators)
+	ctx.Register()
+	ctx.MockFileSystem(map[string][]byte{
+		bpFile: []byte(`
+			python_binary_host {
+				name: "bin",
+				srcs: ["bin.py"],
+				libs: ["lib"],
+				version: {
+					py3: {
+						embedded_launcher: true,
+					},
+				},
+			}
+
+			python_library_host {
+				name: "lib",
+				srcs: ["lib.py"],
+			}
+
+			python_library_host {
+				name: "py3-stdlib",
+				srcs: ["stdlib.py"],
+			}
+
+			launcher {
+				name: "py3-launcher",
+			}
+		`),
+		"bin.py":    nil,
+		"lib.py":    nil,
+		"stdlib.py": nil,
+	})
+	_, errs := ctx.ParseBlueprintsFiles(bpFile)
+	fail(t, errs)
+	_, errs = ctx.PrepareBuildActions(config)
+	fail(t, errs)
+
+	hostVariant := android.BuildOs.String() + "_x86_64"
+	variant := hostVariant + "_" + pyVersion3
+	bin := ctx.ModuleForTests("bin", variant)
+
+	// the launcher of the target of the binary is prepended to the par file.
+	launcher := ctx.ModuleForTests("py3-launcher", hostVariant).Module().(*launcherModule)
+	par := bin.Rule("embedded_par")
+	if par.Args["launcher"] != launcher.outputFile.String() {
+		t.Errorf("bin launcher %q, expected %q", par.Args["launcher"], launcher.outputFile)
+	}
+	if !inList(launcher.outputFile.String(), par.Implicits.Strings()) {
+		t.Errorf("bin implicits %q do not contain the launcher %q", par.Implicits,
+			launcher.outputFile)
+	}
+
+	// the .pyc files of the binary, of its libs and of py3-stdlib are merged into the par file.
+	var precompiledZips []string
+	for _, m := range []string{"bin", "lib", "py3-stdlib"} {
+		zip := ctx.ModuleForTests(m, variant).Output(m + ".pyc.zip").Output.String()
+		precompiledZips = append(precompiledZips, zip)
+		if !inList(zip, par.Implicits.Strings()) {
+			t.Errorf("bin implicits %q do not contain %q", par.Implicits, zip)
+		}
+	}
+	sort.Strings(precompiledZips)
+	actualZips := strings.Fields(par.Args["precompiledZips"])
+	sort.Strings(actualZips)
+	if !reflect.DeepEqual(actualZips, precompiledZips) {
+		t.Errorf("bin precompiled zips %q, expected %q", actualZips, precompiledZips)
+	}
+
+	// __init__.py is an empty file.
+	if initFile := bin.Output(initFileName); initFile.Rule != android.Touch {
+		t.Errorf("bin %s rule %s, expected %s", initFileName, initFile.Rule, android.Touch)
+	}
+}
+
+func inList(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+type launcherModule struct {
+	android.ModuleBase
+	outputFile android.Path
+}
+
+func newLauncherModule() android.Module {
+	m := &launcherModule{}
+	android.InitAndroidArchModule(m, android.HostSupported, android.MultilibFirst)
+	return m
+}
+
+func (m *launcherModule) DepsMutator(ctx android.BottomUpMutatorContext) {
+}
+
+func (m *launcherModule) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	m.outputFile = android.PathForModuleOut(ctx, ctx.ModuleName())
+}
+
+func (m *launcherModule) IntermPathForModuleOut() android.OptionalPath {
+	return android.OptionalPathForPath(m.outputFile)
+}
+
+var _ IntermPathProvider = (*launcherModule)(nil)
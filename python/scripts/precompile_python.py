@@ -0,0 +1,63 @@
+#!/usr/bin/env python3
+
+# Compiles Python 3 source files to .pyc files and writes them to a zip file,
+# at the paths that the sources have in a par file with the "py" extension
+# replaced by "pyc".  The .pyc files are unchecked hash-based .pyc files, which
+# do not depend on the modification times of the sources, and the zip file
+# entries are sorted and have a fixed timestamp, so the output only depends on
+# the sources and the interpreter.
+#
+# usage: precompile_python.py <output zip> <source file>:<path in par>...
+
+import importlib.util
+import marshal
+import struct
+import sys
+import zipfile
+
+# The timestamp that soong_zip uses for all its entries.
+ZIP_TIMESTAMP = (2008, 1, 1, 0, 0, 0)
+
+# Flags of an unchecked hash-based .pyc file (PEP 552).
+UNCHECKED_HASH_PYC_FLAGS = 0b01
+
+def CompileToPyc(source, path):
+  code = compile(source, path, 'exec', dont_inherit=True)
+  return (importlib.util.MAGIC_NUMBER +
+          struct.pack('<I', UNCHECKED_HASH_PYC_FLAGS) +
+          importlib.util.source_hash(source) +
+          marshal.dumps(code))
+
+def Main():
+  # Hash-based .pyc files were added in Python 3.7.
+  if sys.version_info < (3, 7):
+    sys.exit('error: %s needs Python 3.7 or later, found %d.%d' %
+             (sys.argv[0], sys.version_info[0], sys.version_info[1]))
+
+  if len(sys.argv) < 2:
+    sys.exit('usage: %s <output zip> <source file>:<path in par>...' % sys.argv[0])
+
+  sources = {}
+  for arg in sys.argv[2:]:
+    src, _, dest = arg.rpartition(':')
+    if not src or not dest.endswith('.py'):
+      sys.exit('error: %r is not <source file>:<path in par>.py' % arg)
+    sources[dest] = src
+
+  with zipfile.ZipFile(sys.argv[1], 'w', zipfile.ZIP_DEFLATED) as out:
+    for dest in sorted(sources):
+      with open(sources[dest], 'rb') as f:
+        source = f.read()
+      try:
+        pyc = CompileToPyc(source, dest)
+      except SyntaxError:
+        # Files that are not valid Python 3, like the test data of the standard
+        # library, are only packaged as sources.
+        continue
+      info = zipfile.ZipInfo(dest + 'c', date_time=ZIP_TIMESTAMP)
+      info.compress_type = zipfile.ZIP_DEFLATED
+      info.external_attr = 0o644 << 16
+      out.writestr(info, pyc)
+
+if __name__ == '__main__':
+  Main()
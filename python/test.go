@@ -15,6 +15,9 @@
 package python
 
 import (
+	"path/filepath"
+	"strings"
+
 	"android/soong/android"
 )
 
@@ -24,12 +27,99 @@ func init() {
 	android.RegisterModuleType("python_test_host", PythonTestHostFactory)
 }
 
+type TestProperties struct {
+	// list of compatibility suites (for example "cts", "vts") that the module should be
+	// installed into.
+	Test_suites []string `android:"arch_variant"`
+
+	// the name of the test configuration (for example "AndroidTest.xml") that should be
+	// installed with the module.
+	Test_config *string `android:"arch_variant"`
+}
+
 type testDecorator struct {
 	*binaryDecorator
+
+	testProperties TestProperties
+}
+
+func (test *testDecorator) bootstrapperProps() []interface{} {
+	return append(test.binaryDecorator.bootstrapperProps(), &test.testProperties)
+}
+
+func (test *testDecorator) bootstrap(ctx android.ModuleContext, actual_version string,
+	embedded_launcher bool, srcsPathMappings []pathMapping, parSpec parSpec,
+	depsPyRunfiles []string, depsParSpecs []parSpec,
+	precompiledZips android.Paths) android.OptionalPath {
+	if len(srcsPathMappings) == 0 || test.binaryProperties.Main != "" ||
+		test.findPyMainFile(ctx, srcsPathMappings) != "" {
+		return test.binaryDecorator.bootstrap(ctx, actual_version, embedded_launcher,
+			srcsPathMappings, parSpec, depsPyRunfiles, depsParSpecs, precompiledZips)
+	}
+
+	// the test has no main program, so it runs the tests in its srcs with a generated one.
+	var testModules []string
+	for _, path := range srcsPathMappings {
+		if !strings.HasPrefix(path.dest, runFiles+"/") || filepath.Base(path.dest) == initFileName {
+			continue
+		}
+		testModule := strings.TrimSuffix(strings.TrimPrefix(path.dest, runFiles+"/"), pyExt)
+		testModules = append(testModules, strings.Replace(testModule, "/", ".", -1))
+	}
+
+	testMain := registerBuildActionForTestMain(ctx, testModules)
+	main := filepath.Join(runFiles, testMainFileName)
+
+	return test.bootstrapPar(ctx, actual_version, embedded_launcher, main,
+		append(srcsPathMappings, pathMapping{dest: main, src: testMain}), parSpec,
+		depsPyRunfiles, append(depsParSpecs, testMainParSpec(ctx, testMain)), precompiledZips)
+}
+
+// the soong_zip arguments for placing the generated test main program at the root of the
+// runfiles tree.
+func testMainParSpec(ctx android.ModuleContext, testMain android.Path) parSpec {
+	return parSpec{
+		rootPrefix: runFiles,
+		fileListSpecs: []fileListSpec{{
+			fileList: registerBuildActionForModuleFileList(ctx, "test_main",
+				android.Paths{testMain}),
+			relativeRoot: strings.TrimSuffix(testMain.String(), testMainFileName),
+		}},
+	}
 }
 
+// install installs the test, its data and its test config into nativetest/<name> like cc_test,
+// and into the testcases directories.
 func (test *testDecorator) install(ctx android.ModuleContext, file android.Path) {
+	test.binaryDecorator.baseInstaller.relative = ctx.ModuleName()
 	test.binaryDecorator.baseInstaller.install(ctx, file)
+
+	var testConfig android.Path
+	if test.testProperties.Test_config != nil {
+		testConfig = android.PathForModuleSrc(ctx, *test.testProperties.Test_config)
+	}
+	data := ctx.Module().(*Module).dataPathMappings
+
+	dirs := append([]android.OutputPath{test.binaryDecorator.baseInstaller.installDir(ctx)},
+		test.testcasesDirs(ctx)...)
+	for i, dir := range dirs {
+		if i > 0 {
+			ctx.InstallFile(dir, file.Base(), file)
+		}
+		if testConfig != nil {
+			ctx.InstallFile(dir, ctx.ModuleName()+".config", testConfig)
+		}
+		for _, d := range data {
+			ctx.InstallFile(dir, d.src.Rel(), d.src)
+		}
+	}
+}
+
+// testcasesDirs returns the testcases directory of the host, and the testcases directory of each
+// of the compatibility suites in test_suites.
+func (test *testDecorator) testcasesDirs(ctx android.ModuleContext) []android.OutputPath {
+	dirs := []android.OutputPath{android.PathForModuleInstall(ctx, "testcases", ctx.ModuleName())}
+	return append(dirs, android.PathsForTestSuites(ctx, test.testProperties.Test_suites)...)
 }
 
 func NewTest(hod android.HostOrDeviceSupported) *Module {
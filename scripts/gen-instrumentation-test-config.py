@@ -0,0 +1,67 @@
+#!/usr/bin/env python
+#
+# Copyright (C) 2017 The Android Open Source Project
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+"""Generates a test config that runs the instrumentation declared in the manifest of a test apk.
+
+Usage: gen-instrumentation-test-config.py <module name> <AndroidManifest.xml> <output>
+"""
+
+import sys
+from xml.dom import minidom
+
+ANDROID_NS = 'http://schemas.android.com/apk/res/android'
+
+TEMPLATE = """<?xml version="1.0" encoding="utf-8"?>
+<!-- This file was generated by the build system, do not edit. -->
+<configuration description="Runs {module}.">
+    <target_preparer class="com.android.tradefed.targetprep.suite.SuiteApkInstaller">
+        <option name="cleanup-apks" value="true" />
+        <option name="test-file-name" value="{module}.apk" />
+    </target_preparer>
+
+    <test class="com.android.tradefed.testtype.AndroidJUnitTest" >
+        <option name="package" value="{package}" />
+        <option name="runner" value="{runner}" />
+    </test>
+</configuration>
+"""
+
+
+def main(argv):
+  if len(argv) != 4:
+    sys.stderr.write(__doc__)
+    return 1
+
+  module, manifest_file, output = argv[1:]
+
+  manifest = minidom.parse(manifest_file).documentElement
+  package = manifest.getAttribute('package')
+
+  instrumentations = manifest.getElementsByTagName('instrumentation')
+  if not instrumentations:
+    sys.stderr.write('error: %s: no <instrumentation> element\n' % manifest_file)
+    return 1
+  runner = instrumentations[0].getAttributeNS(ANDROID_NS, 'name')
+  if runner.startswith('.'):
+    runner = package + runner
+
+  with open(output, 'w') as f:
+    f.write(TEMPLATE.format(module=module, package=package, runner=runner))
+  return 0
+
+
+if __name__ == '__main__':
+  sys.exit(main(sys.argv))
@@ -22,7 +22,24 @@ import (
 const DataDescriptorFlag = 0x8
 const ExtendedTimeStampTag = 0x5455
 
+// AlignmentExtraID is the header ID of the extra field used to pad the local file header of a
+// stored entry so that its data starts at an aligned offset.  The data of the extra field is a
+// 16-bit alignment followed by the padding.
+const AlignmentExtraID = 0xd935
+
 func (w *Writer) CopyFrom(orig *File, newName string) error {
+	return w.copyFrom(orig, newName, 0)
+}
+
+// CopyFromAligned is like CopyFrom, but if the entry is stored (not compressed) the extra field
+// of its local file header is padded so that the data of the entry starts at an offset that is a
+// multiple of align.  Any existing alignment padding in the entry is replaced, the central
+// directory header of the entry is written without any.
+func (w *Writer) CopyFromAligned(orig *File, newName string, align uint16) error {
+	return w.copyFrom(orig, newName, align)
+}
+
+func (w *Writer) copyFrom(orig *File, newName string, align uint16) error {
 	if w.last != nil && !w.last.closed {
 		if err := w.last.close(); err != nil {
 			return err
@@ -38,13 +55,23 @@ func (w *Writer) CopyFrom(orig *File, newName string) error {
 	// and Local File Header.
 	fh.Extra = stripExtras(fh.Extra)
 
+	// The padding is only needed in the Local File Header, which precedes the data.
+	localFh := fh
+	if align > 0 && fh.Method == Store {
+		fh.Extra = stripAlignmentExtras(fh.Extra)
+		localFileHeader := *fh
+		localFileHeader.Extra = alignExtras(fh.Extra,
+			w.cw.count+fileHeaderLen+int64(len(fh.Name)), align)
+		localFh = &localFileHeader
+	}
+
 	h := &header{
 		FileHeader: fh,
 		offset:     uint64(w.cw.count),
 	}
 	w.dir = append(w.dir, h)
 
-	if err := writeHeader(w.cw, fh); err != nil {
+	if err := writeHeader(w.cw, localFh); err != nil {
 		return err
 	}
 	dataOffset, err := orig.DataOffset()
@@ -107,6 +134,46 @@ func stripExtras(input []byte) []byte {
 	return ret
 }
 
+// stripAlignmentExtras removes any alignment extra fields from extras.
+func stripAlignmentExtras(input []byte) []byte {
+	ret := []byte{}
+
+	for len(input) >= 4 {
+		r := readBuf(input)
+		tag := r.uint16()
+		size := r.uint16()
+		if int(size) > len(r) {
+			break
+		}
+		if tag != AlignmentExtraID {
+			ret = append(ret, input[:4+size]...)
+		}
+		input = input[4+size:]
+	}
+
+	// Keep any trailing data
+	return append(ret, input...)
+}
+
+// alignExtras appends an alignment extra field to extras that pads them so that data following a
+// local file header ending at offset plus the extras is aligned.
+func alignExtras(input []byte, offset int64, align uint16) []byte {
+	ret := append([]byte{}, input...)
+
+	// The alignment extra field needs at least 6 bytes: the header ID, the size and the
+	// alignment.
+	end := offset + int64(len(ret)) + 6
+	padding := (int64(align) - end%int64(align)) % int64(align)
+
+	extra := make([]byte, 6+padding)
+	b := writeBuf(extra)
+	b.uint16(AlignmentExtraID)
+	b.uint16(uint16(2 + padding))
+	b.uint16(align)
+
+	return append(ret, extra...)
+}
+
 // CreateCompressedHeader adds a file to the zip file using the provied
 // FileHeader for the file metadata.
 // It returns a Writer to which the already compressed file contents
@@ -16,6 +16,7 @@ package zip
 
 import (
 	"bytes"
+	"io/ioutil"
 	"testing"
 )
 
@@ -74,3 +75,89 @@ func TestStripZip64Extras(t *testing.T) {
 		}
 	}
 }
+
+func TestCopyFromAligned(t *testing.T) {
+	in := &bytes.Buffer{}
+	w := NewWriter(in)
+	files := []struct {
+		name   string
+		method uint16
+		align  uint16
+	}{
+		{"a", Store, 4},
+		{"bc", Deflate, 4},
+		{"lib/arm/libfoo.so", Store, 4096},
+		{"def", Store, 4},
+		{"resources.arsc", Store, 0},
+	}
+	for _, f := range files {
+		fw, err := w.CreateHeader(&FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(f.name))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Align the entries twice, the second pass must replace the padding from the first.
+	for i := 0; i < 2; i++ {
+		r, err := NewReader(bytes.NewReader(in.Bytes()), int64(in.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		out.WriteString("x")
+		w = NewWriter(out)
+		w.SetOffset(1)
+		for j, f := range r.File {
+			if err := w.CopyFromAligned(f, f.Name, files[j].align); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		in = out
+	}
+
+	r, err := NewReader(bytes.NewReader(in.Bytes()), int64(in.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range r.File {
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[i].method == Store && files[i].align > 0 && offset%int64(files[i].align) != 0 {
+			t.Errorf("%s: data offset %d is not aligned to %d", f.Name, offset, files[i].align)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != files[i].name {
+			t.Errorf("%s: contents %q != %q", f.Name, data, files[i].name)
+		}
+		if n := bytes.Count(f.Extra, []byte{0x35, 0xd9}); n != 0 {
+			t.Errorf("%s: expected no alignment extra in the central directory, found %d in %v",
+				f.Name, n, f.Extra)
+		}
+
+		// The padding is in the local file header, which ends with the name and the extras.
+		localExtra := in.Bytes()[f.headerOffset+fileHeaderLen+int64(len(f.Name)) : offset]
+		n := bytes.Count(localExtra, []byte{0x35, 0xd9})
+		if files[i].method == Store && files[i].align > 0 && n != 1 {
+			t.Errorf("%s: expected one alignment extra in the local header, found %d in %v",
+				f.Name, n, localExtra)
+		}
+	}
+}
@@ -144,15 +144,38 @@ func init() {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: zip -o zipfile [-m manifest] -C dir [-f|-l file]...\n")
+	fmt.Fprintf(os.Stderr, "usage: zip -o zipfile [-m manifest] -C dir [-f|-l file]... [@argsfile]\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
+// expandArgs replaces each argument of the form @file with the whitespace separated arguments in
+// the file, so that long lists of arguments can be passed in a ninja rspfile.
+func expandArgs(args []string) ([]string, error) {
+	var ret []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			ret = append(ret, arg)
+			continue
+		}
+		contents, err := ioutil.ReadFile(strings.TrimPrefix(arg, "@"))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, strings.Fields(string(contents))...)
+	}
+	return ret, nil
+}
+
 func main() {
-	flag.Parse()
+	args, err := expandArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	flag.CommandLine.Parse(args)
 
-	err := zip.Run(zip.ZipArgs{
+	err = zip.Run(zip.ZipArgs{
 		FileArgs:                 fArgs,
 		OutputFilePath:           *out,
 		CpuProfileFilePath:       *cpuProfile,
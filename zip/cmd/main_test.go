@@ -0,0 +1,50 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExpandArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsp := filepath.Join(dir, "args.rsp")
+	if err := ioutil.WriteFile(rsp, []byte("-C dir -f dir/a\n-f dir/b  -C . -f c"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := expandArgs([]string{"-o", "out.zip", "@" + rsp, "-f", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-o", "out.zip", "-C", "dir", "-f", "dir/a", "-f", "dir/b", "-C", ".",
+		"-f", "c", "-f", "d"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected args %q, got %q", expected, args)
+	}
+
+	if _, err := expandArgs([]string{"@" + filepath.Join(dir, "missing.rsp")}); err == nil {
+		t.Errorf("expected an error for a missing rspfile")
+	}
+}